@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/server"
+)
+
+const explainUsage = `Usage: credwrap-server auth explain CONFIG [--listener ADDR] [--ip IP]
+                [--token-id ID | --token | --ssh-key [--principal P]] [--cert NAME]
+                [--uid N] [--gid N] [--tailscale-node NAME] [--tailscale-user LOGIN]
+                [--tailscale-tag TAG]...`
+
+func handleAuthCommand() {
+	if len(os.Args) < 4 || os.Args[2] != "explain" {
+		fmt.Println(explainUsage)
+		fmt.Println("")
+		fmt.Println("Shows how the auth rules treat a request with the given properties:")
+		fmt.Println("which rules were tried, which conditions failed and which rule decided.")
+		fmt.Println("  --listener ADDR   Use the auth section of this listener")
+		fmt.Println("  --ip IP           Client address")
+		fmt.Println("  --token-id ID     A valid hashed token with this ID (and its principal)")
+		fmt.Println("  --token           A valid token without an ID")
+		fmt.Println("  --ssh-key         A verified SSH key, of --principal if given")
+		fmt.Println("  --cert NAME       A verified client certificate name")
+		fmt.Println("  --uid/--gid N     A local process on a unix socket")
+		fmt.Println("  --tailscale-node, --tailscale-user, --tailscale-tag")
+		fmt.Println("                    The client's Tailscale node, its owner and tags")
+		os.Exit(1)
+	}
+
+	configPath := os.Args[3]
+	var listener, tokenID string
+	var req server.AuthRequest
+	var ts server.TailscaleIdentity
+	sshKey := false
+	for i := 4; i < len(os.Args); i++ {
+		opt := os.Args[i]
+		switch opt {
+		case "--token":
+			req.Token = true
+			continue
+		case "--ssh-key":
+			req.Token, sshKey = true, true
+			continue
+		}
+		if i+1 >= len(os.Args) {
+			log.Fatalf("Missing value for %s", opt)
+		}
+		i++
+		value := os.Args[i]
+		var err error
+		switch opt {
+		case "--listener":
+			listener = value
+		case "--ip":
+			req.IP = value
+		case "--token-id":
+			tokenID = value
+		case "--principal":
+			req.Principal = value
+		case "--cert":
+			req.CertNames = append(req.CertNames, value)
+		case "--uid":
+			req.Local = true
+			req.UID, err = strconv.Atoi(value)
+		case "--gid":
+			req.Local = true
+			req.GID, err = strconv.Atoi(value)
+		case "--tailscale-node":
+			ts.Node = strings.TrimSuffix(value, ".")
+		case "--tailscale-user":
+			ts.User = value
+		case "--tailscale-tag":
+			ts.Tags = append(ts.Tags, value)
+		default:
+			log.Fatalf("Unknown option: %s\n%s", opt, explainUsage)
+		}
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", opt, err)
+		}
+	}
+	if req.Principal != "" && !sshKey {
+		log.Fatal("--principal describes an SSH key; use it with --ssh-key, or use --token-id")
+	}
+	if ts.Node != "" || ts.User != "" || len(ts.Tags) > 0 {
+		req.Tailscale = &ts
+	}
+
+	if err := authExplain(configPath, listener, tokenID, &req); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+func authExplain(configPath, listener, tokenID string, req *server.AuthRequest) error {
+	cfg, err := config.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	auth, where := &cfg.Auth, "auth"
+	if listener != "" {
+		found := false
+		for _, lc := range cfg.Server.ListenerConfigs() {
+			if lc.Address == listener {
+				found = true
+				if lc.Auth != nil {
+					auth, where = lc.Auth, fmt.Sprintf("auth of listener %s", listener)
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("no listener %s", listener)
+		}
+	}
+
+	var note string
+	if tokenID != "" {
+		tok, principal := tokenByID(auth, tokenID)
+		if tok == nil {
+			return fmt.Errorf("no token with ID %s in %s", tokenID, where)
+		}
+		req.Token, req.TokenID = true, tokenID
+		if principal != nil {
+			req.Principal = principal.Name
+		}
+		if !tok.Active(time.Now()) {
+			note = fmt.Sprintf("Token %s is expired or not yet valid: allowed requests get token_expired.", tokenID)
+		}
+	}
+
+	d := server.Decide(auth, req)
+	rules := auth.EffectiveRules()
+	if len(auth.Rules) == 0 {
+		fmt.Printf("Rules for %s, derived from its require_token, allowed_ips, tailscale_*,\nclient_certs and peers settings:\n\n", where)
+	} else {
+		fmt.Printf("Rules for %s:\n\n", where)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tNAME\tACTION\tCONDITIONS\tRESULT")
+	for i, rule := range rules {
+		result := "not reached"
+		if i < len(d.Tried) {
+			result = "matched"
+			if unmet := d.Tried[i].Unmet; len(unmet) > 0 {
+				result = "unmet: " + strings.Join(unmet, ", ")
+			}
+		}
+		name := rule.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", i+1, name, rule.Action, rule.String(), result)
+	}
+	w.Flush()
+	fmt.Println()
+
+	switch {
+	case !d.Matched:
+		fmt.Println("Denied: no rule matched")
+	case d.Allowed:
+		fmt.Printf("Allowed by %s\n", rules[len(d.Tried)-1].Label(len(d.Tried)-1))
+	default:
+		fmt.Printf("Denied by %s\n", rules[len(d.Tried)-1].Label(len(d.Tried)-1))
+	}
+	if note != "" && d.Allowed {
+		fmt.Println(note)
+	}
+	return nil
+}
+
+// tokenByID returns the token with id in auth, and its principal.
+func tokenByID(auth *config.AuthConfig, id string) (*config.Token, *config.Principal) {
+	for i := range auth.Tokens {
+		if auth.Tokens[i].ID == id {
+			return &auth.Tokens[i], nil
+		}
+	}
+	for i := range auth.Principals {
+		p := &auth.Principals[i]
+		for j := range p.Tokens {
+			if p.Tokens[j].ID == id {
+				return &p.Tokens[j], p
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/server"
+	"gopkg.in/yaml.v3"
+)
+
+func handleBansCommand() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: credwrap-server bans <command> CONFIG [args]")
+		fmt.Println("")
+		fmt.Println("Commands:")
+		fmt.Println("  list CONFIG      List banned addresses and principals")
+		fmt.Println("  clear CONFIG KEY...")
+		fmt.Println("                   Lift bans; KEY is an address or principal:NAME")
+		fmt.Println("  clear CONFIG --all")
+		fmt.Println("                   Lift every ban")
+		fmt.Println("")
+		fmt.Println("Bans are kept in the server.state file; a running server picks up cleared bans.")
+		os.Exit(1)
+	}
+
+	cmd := os.Args[2]
+	configPath := os.Args[3]
+	var err error
+
+	switch cmd {
+	case "list":
+		err = bansList(configPath)
+
+	case "clear":
+		keys := os.Args[4:]
+		if len(keys) == 0 {
+			log.Fatal("Usage: credwrap-server bans clear CONFIG KEY... | --all")
+		}
+		if len(keys) == 1 && keys[0] == "--all" {
+			keys = nil
+		}
+		err = bansClear(configPath, keys)
+
+	default:
+		log.Fatalf("Unknown bans command: %s", cmd)
+	}
+
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// statePath returns the server.state path configured in configPath.
+func statePath(configPath string) (string, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return "", fmt.Errorf("reading config: %w", err)
+	}
+	var cfg struct {
+		Server struct {
+			State string `yaml:"state"`
+		} `yaml:"server"`
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return "", fmt.Errorf("parsing config: %w", err)
+	}
+	if cfg.Server.State == "" {
+		return "", fmt.Errorf("server.state is not set, so bans last only until the server restarts")
+	}
+	return cfg.Server.State, nil
+}
+
+func bansList(configPath string) error {
+	path, err := statePath(configPath)
+	if err != nil {
+		return err
+	}
+	bans, err := server.Bans(path)
+	if err != nil {
+		return err
+	}
+	if len(bans) == 0 {
+		fmt.Println("No bans in force")
+		return nil
+	}
+
+	keys := make([]string, 0, len(bans))
+	for key := range bans {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSINCE\tUNTIL\tLEFT\tFAILURES")
+	for _, key := range keys {
+		ban := bans[key]
+		left := time.Until(ban.Until).Round(time.Second)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", key, ban.Since.UTC().Format(time.RFC3339), ban.Until.UTC().Format(time.RFC3339), left, ban.Failures)
+	}
+	return w.Flush()
+}
+
+func bansClear(configPath string, keys []string) error {
+	path, err := statePath(configPath)
+	if err != nil {
+		return err
+	}
+	cleared, err := server.ClearBans(path, keys...)
+	if err != nil {
+		return err
+	}
+	if len(cleared) == 0 {
+		fmt.Println("No matching bans")
+		return nil
+	}
+	for _, key := range cleared {
+		fmt.Printf("✓ Lifted ban on %s\n", key)
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/openclaw/credwrap/internal/config"
 	"github.com/openclaw/credwrap/internal/server"
+	"github.com/openclaw/credwrap/internal/systemd"
 	"golang.org/x/term"
 )
 
@@ -36,6 +37,26 @@ Tools management:
   credwrap-server tools list CONFIG    List configured tools
   credwrap-server tools rm CONFIG NAME Remove tool from config
 
+Token management:
+  credwrap-server tokens create CONFIG NAME [--principal P] [--listener ADDR]
+                [--expires WHEN] [--not-before WHEN] [--max-uses N] [--sign]
+                                       Generate a token and store only its hash
+  credwrap-server tokens list CONFIG   List token IDs and names
+  credwrap-server tokens revoke CONFIG ID
+                                       Remove a token
+  credwrap-server tokens rotate CONFIG ID [--expires WHEN]
+                                       Issue a new secret for a token
+  credwrap-server tokens hash CONFIG   Replace plaintext tokens with hashes
+
+Auth policy:
+  credwrap-server auth explain CONFIG [--ip IP] [--token-id ID] [...]
+                                       Show which auth rule a request matches
+
+Lockout management:
+  credwrap-server bans list CONFIG     List clients banned for failed authentications
+  credwrap-server bans clear CONFIG KEY... | --all
+                                       Lift bans on addresses or principal:NAME
+
 Server flags:`)
 	flag.PrintDefaults()
 }
@@ -50,6 +71,15 @@ func main() {
 		case "tools":
 			handleToolsCommand()
 			return
+		case "tokens":
+			handleTokensCommand()
+			return
+		case "bans":
+			handleBansCommand()
+			return
+		case "auth":
+			handleAuthCommand()
+			return
 		case "version", "--version", "-v":
 			fmt.Printf("credwrap-server version %s\n", version)
 			return
@@ -74,6 +104,7 @@ func main() {
 	// Load credentials
 	var creds map[string]string
 	if *encrypted {
+		systemd.Notify("STATUS=Waiting to unlock credentials")
 		var password string
 		if *keyfile != "" {
 			// Read password from keyfile
@@ -106,6 +137,7 @@ func main() {
 	cfg.Credentials = creds
 
 	// Create and start server
+	server.Version = version
 	srv := server.New(cfg)
 
 	// Handle shutdown
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/server"
+	"gopkg.in/yaml.v3"
+)
+
+func handleTokensCommand() {
+	if len(os.Args) < 4 {
+		fmt.Println("Usage: credwrap-server tokens <command> CONFIG [args]")
+		fmt.Println("")
+		fmt.Println("Commands:")
+		fmt.Println("  create CONFIG NAME [--principal P] [--listener ADDR] [--expires WHEN] [--not-before WHEN] [--max-uses N] [--sign]")
+		fmt.Println("                   Generate a token, print it once and store its hash.")
+		fmt.Println("                   WHEN is a date, an RFC 3339 time or a duration from now (90d, 12h).")
+		fmt.Println("                   --listener stores it in that listener's auth section")
+		fmt.Println("                   --sign also stores the key to check signed requests with")
+		fmt.Println("  list CONFIG      List tokens (IDs and names, never secrets)")
+		fmt.Println("  revoke CONFIG ID Remove a token")
+		fmt.Println("  rotate CONFIG ID [--expires WHEN]")
+		fmt.Println("                   Replace a token's secret, keeping its ID, name and limits;")
+		fmt.Println("                   its use count starts over, and an expired token needs --expires")
+		fmt.Println("  hash CONFIG      Replace plaintext tokens with hashes; clients keep working")
+		fmt.Println("")
+		fmt.Println("Commands cover the auth sections of listeners too. Restart the server to apply changes.")
+		os.Exit(1)
+	}
+
+	cmd := os.Args[2]
+	configPath := os.Args[3]
+	var err error
+
+	switch cmd {
+	case "create", "add":
+		if len(os.Args) < 5 {
+			log.Fatal("Usage: credwrap-server tokens create CONFIG NAME [--principal P] [--listener ADDR] [--expires WHEN] [--not-before WHEN] [--max-uses N] [--sign]")
+		}
+		var principal, listener string
+		var limits config.Token
+		sign := false
+		for i := 5; i < len(os.Args); i++ {
+			opt := os.Args[i]
+			if opt == "--sign" {
+				sign = true
+				continue
+			}
+			if i+1 >= len(os.Args) {
+				log.Fatalf("Missing value for %s", opt)
+			}
+			i++
+			value := os.Args[i]
+			switch opt {
+			case "--principal":
+				principal = value
+			case "--listener":
+				listener = value
+			case "--expires":
+				limits.Expires, err = tokenTime(value)
+			case "--not-before":
+				limits.NotBefore, err = tokenTime(value)
+			case "--max-uses":
+				limits.MaxUses, err = strconv.Atoi(value)
+			default:
+				log.Fatalf("Unknown option: %s", opt)
+			}
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", opt, err)
+			}
+		}
+		err = tokensCreate(configPath, os.Args[4], listener, principal, limits, sign)
+
+	case "list":
+		err = tokensList(configPath)
+
+	case "revoke", "rm":
+		if len(os.Args) < 5 {
+			log.Fatal("Usage: credwrap-server tokens revoke CONFIG ID")
+		}
+		err = tokensRevoke(configPath, os.Args[4])
+
+	case "rotate":
+		if len(os.Args) < 5 {
+			log.Fatal("Usage: credwrap-server tokens rotate CONFIG ID [--expires WHEN]")
+		}
+		var expires string
+		for i := 5; i < len(os.Args); i++ {
+			opt := os.Args[i]
+			if i+1 >= len(os.Args) {
+				log.Fatalf("Missing value for %s", opt)
+			}
+			i++
+			value := os.Args[i]
+			switch opt {
+			case "--expires":
+				expires, err = tokenTime(value)
+			default:
+				log.Fatalf("Unknown option: %s", opt)
+			}
+			if err != nil {
+				log.Fatalf("Invalid %s: %v", opt, err)
+			}
+		}
+		err = tokensRotate(configPath, os.Args[4], expires)
+
+	case "hash":
+		err = tokensHash(configPath)
+
+	default:
+		log.Fatalf("Unknown tokens command: %s", cmd)
+	}
+
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+// tokenTime converts a --expires or --not-before value to the form stored
+// in the config. Durations count from now; "d" means days.
+func tokenTime(value string) (string, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			value = strconv.Itoa(n*24) + "h"
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(d).UTC().Format(time.RFC3339), nil
+	}
+	if _, err := config.ParseTokenTime(value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+func tokensCreate(configPath, name, listener, principal string, limits config.Token, sign bool) error {
+	f, err := config.OpenConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	list, err := f.TokenList(listener, principal)
+	if err != nil {
+		return err
+	}
+
+	secret, tok, err := config.NewToken(name)
+	if err != nil {
+		return err
+	}
+	tok.NotBefore, tok.Expires, tok.MaxUses = limits.NotBefore, limits.Expires, limits.MaxUses
+	if sign {
+		tok.EnableSigning(secret)
+	}
+	if err := list.Add(tok); err != nil {
+		return err
+	}
+	if err := f.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Token %s created", tok.ID)
+	if principal != "" {
+		fmt.Printf(" for principal '%s'", principal)
+	}
+	if listener != "" {
+		fmt.Printf(" in the %s", list.Section())
+	}
+	fmt.Println()
+	fmt.Println("")
+	fmt.Printf("  %s\n", secret)
+	fmt.Println("")
+	if tok.Expires != "" {
+		fmt.Printf("  Expires %s.\n", tok.Expires)
+	}
+	fmt.Println("  This is the only time the token is shown. Only its hash is stored.")
+	return nil
+}
+
+func tokensList(configPath string) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	var cfg struct {
+		Server struct {
+			State string `yaml:"state"`
+		} `yaml:"server"`
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+	uses := map[string]int{}
+	if cfg.Server.State != "" {
+		if uses, err = server.TokenUses(cfg.Server.State); err != nil {
+			return err
+		}
+	}
+	f, err := config.OpenConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPRINCIPAL\tLISTENER\tCREATED\tEXPIRES\tUSES")
+	plaintext := 0
+	for _, l := range f.TokenLists() {
+		tokens, err := l.Tokens()
+		if err != nil {
+			return err
+		}
+		for _, t := range tokens {
+			id, name, created := t.ID, t.Name, t.Created
+			if !t.Hashed() {
+				plaintext++
+				name, created = "(plaintext)", "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", dash(id), dash(name), dash(l.Principal), dash(l.Listener), dash(created), dash(t.Expires), tokenUses(t, uses))
+		}
+	}
+	w.Flush()
+
+	if plaintext > 0 {
+		fmt.Printf("\n⚠ %d plaintext token(s); run 'credwrap-server tokens hash %s' to store hashes instead\n", plaintext, configPath)
+	}
+	return nil
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// tokenUses describes how often t has been used, out of its limit.
+func tokenUses(t config.Token, uses map[string]int) string {
+	if t.MaxUses == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d", uses[t.ID], t.MaxUses)
+}
+
+func tokensRevoke(configPath, id string) error {
+	f, err := config.OpenConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	refs, err := f.FindTokens(id)
+	if err != nil {
+		return err
+	}
+	// Backwards, so that indexes in the same list stay valid
+	for i := len(refs) - 1; i >= 0; i-- {
+		refs[i].List.Remove(refs[i].Index)
+	}
+	if err := f.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Token %s revoked", id)
+	if len(refs) > 1 {
+		fmt.Printf(" (%d copies)", len(refs))
+	}
+	fmt.Println()
+	fmt.Println("  Restart server to apply changes.")
+	return nil
+}
+
+func tokensRotate(configPath, id, expires string) error {
+	f, err := config.OpenConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	refs, err := f.FindTokens(id)
+	if err != nil {
+		return err
+	}
+
+	// A new secret that expires at once would be refused from the start
+	for _, ref := range refs {
+		when := ref.Token.Expires
+		if expires != "" {
+			when = expires
+		}
+		if at, _ := config.ParseTokenTime(when); !at.IsZero() && !time.Now().Before(at) {
+			if expires != "" {
+				return fmt.Errorf("--expires %s is in the past", expires)
+			}
+			return fmt.Errorf("token %s expired at %s; give a new expiry with --expires", id, when)
+		}
+	}
+
+	// Copies of the token in several auth sections get the same new secret
+	secret, fresh, err := refs[0].Token.Rotate()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		tok := ref.Token
+		tok.Plain, tok.Hash, tok.Created = "", fresh.Hash, fresh.Created
+		if tok.SignKey != "" {
+			tok.EnableSigning(secret)
+		}
+		if expires != "" {
+			tok.Expires = expires
+		}
+		if err := ref.List.Set(ref.Index, tok); err != nil {
+			return err
+		}
+	}
+	if err := f.Save(); err != nil {
+		return err
+	}
+
+	// The new secret starts with none of max_uses used
+	if path, err := statePath(configPath); err == nil {
+		if err := server.ResetTokenUses(path, id); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("✓ Token %s rotated\n", id)
+	fmt.Println("")
+	fmt.Printf("  %s\n", secret)
+	fmt.Println("")
+	fmt.Println("  The old secret stops working when the server restarts.")
+	return nil
+}
+
+func tokensHash(configPath string) error {
+	f, err := config.OpenConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, l := range f.TokenLists() {
+		tokens, err := l.Tokens()
+		if err != nil {
+			return err
+		}
+		for i, tok := range tokens {
+			if tok.Hashed() {
+				continue
+			}
+			// A plaintext token with limits keeps them
+			hashed, err := config.HashedToken(tok.Plain, "hashed legacy token")
+			if err != nil {
+				return err
+			}
+			tok.Plain, tok.Hash = "", hashed.Hash
+			if tok.ID == "" {
+				tok.ID = hashed.ID
+			}
+			if tok.Name == "" {
+				tok.Name = hashed.Name
+			}
+			if tok.Created == "" {
+				tok.Created = hashed.Created
+			}
+			if err := l.Set(i, tok); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+	if count == 0 {
+		fmt.Println("No plaintext tokens found.")
+		return nil
+	}
+	if err := f.Save(); err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ Replaced %d plaintext token(s) with hashes\n", count)
+	fmt.Println("  Clients keep using the same tokens. Restart server to apply changes.")
+	return nil
+}
@@ -6,9 +6,15 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/openclaw/credwrap/internal/client"
+	"github.com/openclaw/credwrap/internal/protocol"
+	"golang.org/x/term"
 	"gopkg.in/yaml.v3"
 )
 
@@ -18,8 +24,10 @@ func main() {
 	// Flags
 	serverAddr := flag.String("server", "", "Server address (overrides config)")
 	token := flag.String("token", "", "Auth token (overrides config)")
+	sign := flag.Bool("sign", false, "Sign requests with the token instead of sending it")
 	configPath := flag.String("config", "", "Path to client config file")
 	interactive := flag.Bool("i", false, "Interactive mode (forward stdin)")
+	allocTTY := flag.Bool("t", false, "Run the tool on a pseudo-terminal (implies -i)")
 	ping := flag.Bool("ping", false, "Ping the server and exit")
 	showVersion := flag.Bool("version", false, "Show version")
 	flag.Parse()
@@ -39,17 +47,26 @@ func main() {
 	if *token != "" {
 		cfg.Token = *token
 	}
+	if *sign {
+		cfg.Sign = true
+	}
 
 	// Validate
 	if cfg.Server == "" {
 		log.Fatal("Server address required (use -server or config file)")
 	}
-	if cfg.Token == "" {
+	// Unix socket peers, client certificates and SSH keys can authenticate without
+	// a token.
+	if cfg.Token == "" && cfg.SSHKey == "" && !cfg.SSHAgent && !strings.HasPrefix(cfg.Server, protocol.UnixPrefix) && cfg.Cert == "" {
 		log.Fatal("Auth token required (use -token or config file)")
 	}
 
 	// Create client
-	c := client.New(cfg.Server, cfg.Token)
+	client.Version = version
+	c, err := client.NewFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("Invalid client config: %v", err)
+	}
 	if err := c.Connect(); err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
@@ -57,11 +74,18 @@ func main() {
 
 	// Ping mode
 	if *ping {
-		version, err := c.Ping()
+		status, err := c.Status()
 		if err != nil {
 			log.Fatalf("Ping failed: %v", err)
 		}
-		fmt.Printf("Server version: %s\n", version)
+		fmt.Printf("Server version: %s\n", status.Version)
+		fmt.Printf("Protocol: %d\n", c.ProtocolVersion())
+		if !status.TokenExpires.IsZero() {
+			fmt.Printf("Token expires: %s\n", status.TokenExpires.Local().Format(time.RFC1123))
+		}
+		if status.Warning != "" {
+			fmt.Fprintf(os.Stderr, "⚠ %s\n", status.Warning)
+		}
 		os.Exit(0)
 	}
 
@@ -69,29 +93,122 @@ func main() {
 	args := flag.Args()
 	if len(args) < 1 {
 		fmt.Fprintln(os.Stderr, "Usage: credwrap [flags] <tool> [args...]")
+		fmt.Fprintln(os.Stderr, "       credwrap [flags] tools")
+		fmt.Fprintln(os.Stderr, "       credwrap [flags] describe <tool>")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "Flags:")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
+	// Discovery commands; "credwrap -- tools" runs a tool named tools
+	if !explicitTool(args) {
+		switch args[0] {
+		case "tools":
+			listTools(c)
+			os.Exit(0)
+		case "describe":
+			if len(args) != 2 {
+				log.Fatal("Usage: credwrap describe <tool>")
+			}
+			describeTool(c, args[1])
+			os.Exit(0)
+		}
+	}
+
 	tool := args[0]
 	toolArgs := args[1:]
 
-	var exitCode int
-	var err error
-	if *interactive {
-		exitCode, err = c.ExecInteractive(tool, toolArgs)
+	opts := client.ExecOptions{Stdout: os.Stdout, Stderr: os.Stderr}
+	stdinFd := int(os.Stdin.Fd())
+	if *allocTTY {
+		if !term.IsTerminal(stdinFd) {
+			log.Fatal("-t requires stdin to be a terminal")
+		}
+		opts.PTY = true
+		opts.Rows, opts.Cols = terminalSize(stdinFd)
+	}
+
+	p, err := c.Start(tool, toolArgs, opts)
+	if err != nil {
+		log.Fatalf("Exec failed: %v", err)
+	}
+	// Servers without signal support only notice an interrupt when the
+	// connection drops, so leave the default signal handling in place.
+	if c.Supports(protocol.FeatureSignals) {
+		stop := forwardSignals(p)
+		defer stop()
+	}
+
+	restore := func() {}
+	if *allocTTY {
+		restore, err = enterRawMode(stdinFd, p)
+		if err != nil {
+			p.Cancel()
+			log.Fatalf("Failed to set raw mode: %v", err)
+		}
+	}
+
+	if *interactive || *allocTTY {
+		go p.CopyStdin(os.Stdin)
 	} else {
-		exitCode, err = c.Exec(tool, toolArgs)
+		p.CloseStdin()
 	}
 
+	exitCode, err := p.Wait()
+	restore()
 	if err != nil {
 		log.Fatalf("Exec failed: %v", err)
 	}
 	os.Exit(exitCode)
 }
 
+// forwardedSignals maps local signals to the names sent to the server.
+var forwardedSignals = map[os.Signal]string{
+	syscall.SIGHUP:  protocol.SignalHangup,
+	syscall.SIGINT:  protocol.SignalInterrupt,
+	syscall.SIGQUIT: protocol.SignalQuit,
+	syscall.SIGTERM: protocol.SignalTerminate,
+}
+
+// cancelAfterInterrupts is how many Ctrl-C presses make the client give up
+// on a tool that ignores SIGINT and cancel it instead.
+const cancelAfterInterrupts = 3
+
+// forwardSignals relays signals received by credwrap to the remote tool
+// until the returned function is called.
+func forwardSignals(p *client.Process) func() {
+	sigChan := make(chan os.Signal, 4)
+	for sig := range forwardedSignals {
+		signal.Notify(sigChan, sig)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		interrupts := 0
+		for {
+			select {
+			case sig := <-sigChan:
+				if sig == syscall.SIGINT {
+					interrupts++
+					if interrupts >= cancelAfterInterrupts {
+						p.Cancel()
+						continue
+					}
+				}
+				p.Signal(forwardedSignals[sig])
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigChan)
+		close(done)
+	}
+}
+
 func loadConfig(path string) client.ClientConfig {
 	var cfg client.ClientConfig
 
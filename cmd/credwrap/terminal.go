@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/openclaw/credwrap/internal/client"
+	"golang.org/x/term"
+)
+
+// terminalSize returns the size of the terminal on fd, or zeros if it cannot
+// be determined.
+func terminalSize(fd int) (rows, cols uint16) {
+	w, h, err := term.GetSize(fd)
+	if err != nil {
+		return 0, 0
+	}
+	return uint16(h), uint16(w)
+}
+
+// enterRawMode puts the local terminal on fd in raw mode so keystrokes,
+// including Ctrl-C, reach the remote PTY untouched, and forwards window size
+// changes to p. The returned function restores the terminal.
+func enterRawMode(fd int, p *client.Process) (func(), error) {
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-winch:
+				if rows, cols := terminalSize(fd); rows > 0 && cols > 0 {
+					p.Resize(rows, cols)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(winch)
+		close(done)
+		term.Restore(fd, state)
+	}, nil
+}
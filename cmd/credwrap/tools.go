@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/openclaw/credwrap/internal/client"
+)
+
+// explicitTool reports whether args were preceded by "--" on the command
+// line, which marks them as a tool invocation rather than a command.
+func explicitTool(args []string) bool {
+	i := len(os.Args) - len(args) - 1
+	return i > 0 && os.Args[i] == "--"
+}
+
+func listTools(c *client.Client) {
+	tools, err := c.ListTools()
+	if err != nil {
+		log.Fatalf("Listing tools failed: %v", err)
+	}
+	if len(tools) == 0 {
+		fmt.Println("No tools available")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tARGS\tDESCRIPTION")
+	for _, t := range tools {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", t.Name, argsPolicy(t.PassArgs, t.ArgsPattern, t.Usage), t.Description)
+	}
+	w.Flush()
+}
+
+func describeTool(c *client.Client, name string) {
+	t, err := c.DescribeTool(name)
+	if err != nil {
+		log.Fatalf("Describing tool failed: %v", err)
+	}
+
+	fmt.Printf("Name:        %s\n", t.Name)
+	if t.Description != "" {
+		fmt.Printf("Description: %s\n", t.Description)
+	}
+	fmt.Printf("Args:        %s\n", argsPolicy(t.PassArgs, t.ArgsPattern, t.Usage))
+	for i, line := range t.Usage {
+		if i == 0 {
+			fmt.Printf("Usage:       %s %s\n", t.Name, line)
+		} else {
+			fmt.Printf("             %s %s\n", t.Name, line)
+		}
+	}
+	if t.Stdin {
+		fmt.Println("Stdin:       accepted")
+	} else {
+		fmt.Println("Stdin:       not accepted")
+	}
+	if t.Path != "" {
+		fmt.Printf("Path:        %s\n", t.Path)
+	}
+	if len(t.Credentials) > 0 {
+		fmt.Printf("Credentials: %s\n", strings.Join(t.Credentials, ", "))
+	}
+}
+
+// argsPolicy summarizes which arguments a tool accepts, mirroring
+// config.Tool.ValidateArgs.
+func argsPolicy(passArgs bool, pattern string, usage []string) string {
+	switch {
+	case passArgs:
+		return "any"
+	case pattern != "" && len(usage) > 0:
+		return "schema, each matching " + pattern
+	case pattern != "":
+		return "each matching " + pattern
+	case len(usage) > 0:
+		return "schema"
+	}
+	return "any"
+}
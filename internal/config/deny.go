@@ -0,0 +1,259 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// denyList is a set of flags and argument patterns a tool refuses.
+type denyList struct {
+	flags    []string
+	args     []string
+	commands [][]string // subcommands, as the words that invoke them
+	values   string     // letters of the short flags that always take a value
+}
+
+// dangerous is the catalog deny_dangerous draws on: flags and arguments
+// that let an allowlisted tool read or write arbitrary files, run local
+// commands or send its credentials elsewhere. It is a best effort for
+// common uses, not a substitute for an args schema. The args patterns are
+// matched against flag values as well as whole arguments (see checkDeny).
+var dangerous = map[string]denyList{
+	"ssh": {
+		flags: []string{
+			"-F",                   // config file, which can hold ProxyCommand
+			"-S",                   // control socket of another connection
+			"-E",                   // log to an arbitrary file
+			"-I",                   // PKCS#11 library, loaded into ssh
+			"-L", "-R", "-D", "-w", // port forwarding and tunnels
+		},
+		args: []string{
+			// -o options that load local commands or libraries, read other
+			// config or send local environment variables to the server
+			`^\s*(?i:proxycommand|localcommand|permitlocalcommand|knownhostscommand|proxyusefdpass|include|match|controlpath|controlmaster|pkcs11provider|securitykeyprovider|sendenv)\s*[= ]`,
+		},
+		values: "BbcDEeFIiJLlmOopQRSWw",
+	},
+	"curl": {
+		flags: []string{
+			"-K", "--config",
+			"-o", "--output", "--output-dir",
+			"-O", "--remote-name", "--remote-name-all",
+			"-T", "--upload-file",
+			"-D", "--dump-header",
+			"-c", "--cookie-jar",
+			"--trace", "--trace-ascii", "--libcurl", "--stderr",
+			"-x", "--proxy", "--preproxy", "--connect-to", "--resolve",
+			"--netrc-file",
+		},
+		args: []string{
+			`^@`,                                  // -d @file, -H @file, -w @file and the like
+			`^[0-9A-Za-z_.][0-9A-Za-z_.-]*=[@<]`,  // -F name=@file or name=<file
+			`^--(data-u|url-q|var)[a-z-]*=[^=]*@`, // --data-urlencode, --url-query and --variable name@file
+			`%output\{`,                           // --write-out to a file
+			`(?i)^(\{[^}]*)?file[^:/]*:`,          // file:// URLs, also in a {glob}
+		},
+		values: "AbcCdDeEFHKmoPQrtTuUwxXyYz",
+	},
+	"git": {
+		flags: []string{
+			"-c", "--config-env", // config overrides, such as core.sshCommand
+			"-C", "--git-dir", "--work-tree", "--exec-path",
+			"-u", "--upload-pack", "--receive-pack", // clone -u, fetch --upload-pack
+			"-x", "--exec", "--extcmd", // rebase -x, difftool -x
+			"--template",
+			"-O", "--open-files-in-pager",
+			"--output", "--output-directory",
+		},
+		args: []string{
+			`^ext::`, // remote helper that runs a command
+		},
+		commands: [][]string{ // run a command of the caller's choosing
+			{"submodule", "foreach"},
+			{"bisect", "run"},
+		},
+		// Short flags mean different things to different subcommands (rebase
+		// -m takes no value, commit -m does), so none is trusted to end a group.
+	},
+}
+
+// dangerousNames lists the tools the catalog covers.
+func dangerousNames() string {
+	names := make([]string, 0, len(dangerous))
+	for name := range dangerous {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// compileDeny checks the tool's deny_flags, deny_args and deny_dangerous
+// and merges them with the catalog.
+func (t *Tool) compileDeny() error {
+	list := denyList{flags: t.DenyFlags, args: t.DenyArgs}
+	if t.DenyDangerous != "" {
+		builtin, ok := dangerous[t.DenyDangerous]
+		if !ok {
+			return fmt.Errorf("deny_dangerous: no catalog for %q (have %s)", t.DenyDangerous, dangerousNames())
+		}
+		list.flags = append(append([]string{}, list.flags...), builtin.flags...)
+		list.args = append(append([]string{}, list.args...), builtin.args...)
+		list.commands = builtin.commands
+		list.values = builtin.values
+	}
+
+	for _, flag := range list.flags {
+		if !isFlag(flag) || strings.Contains(flag, "=") {
+			return fmt.Errorf("deny_flags: %q is not a flag", flag)
+		}
+	}
+	for _, flag := range t.ValueFlags {
+		if len(flag) != 2 || !isFlag(flag) || !isFlagLetter(rune(flag[1])) {
+			return fmt.Errorf("value_flags: %q is not a short flag", flag)
+		}
+		list.values += flag[1:]
+	}
+	t.denyFlags = list.flags
+	t.denyCommands = list.commands
+	t.valueFlags = list.values
+	t.denyArgs = nil
+	for _, pattern := range list.args {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid deny_args pattern %q: %w", pattern, err)
+		}
+		t.denyArgs = append(t.denyArgs, regex)
+	}
+	return nil
+}
+
+// checkDeny refuses args that use a denied flag, match a denied pattern
+// or invoke a denied subcommand, wherever they appear. Patterns are also
+// matched against the value of each flag, alone and joined to the flag as
+// -ovalue or --name=value, whether it is attached (-sH@file, --data=@file)
+// or the next argument (--data-urlencode name@file).
+func (t *Tool) checkDeny(args []string) error {
+	for i, arg := range args {
+		if flag := deniedFlag(arg, t.denyFlags, t.valueFlags); flag != "" {
+			return fmt.Errorf("argument %d: flag %s is denied", i+1, flag)
+		}
+		if err := t.checkDenyArgs(i, arg); err != nil {
+			return err
+		}
+		flag, value, attached := flagValue(arg, t.valueFlags)
+		switch {
+		case attached:
+			if err := t.checkDenyArgs(i, value, joinFlag(flag, value)); err != nil {
+				return err
+			}
+		case flag != "" && i+1 < len(args):
+			if err := t.checkDenyArgs(i+1, args[i+1], joinFlag(flag, args[i+1])); err != nil {
+				return err
+			}
+		}
+	}
+	return checkDenyCommands(args, t.denyCommands)
+}
+
+// checkDenyArgs matches strings taken from argument i against the denied
+// patterns.
+func (t *Tool) checkDenyArgs(i int, strs ...string) error {
+	for _, str := range strs {
+		for _, regex := range t.denyArgs {
+			if regex.MatchString(str) {
+				return fmt.Errorf("argument %d: %q matches denied pattern %s", i+1, str, regex)
+			}
+		}
+	}
+	return nil
+}
+
+// checkDenyCommands refuses args whose arguments other than flags include
+// the words of a denied subcommand in a row. Flags may come between them,
+// as in git submodule --quiet foreach.
+func checkDenyCommands(args []string, commands [][]string) error {
+	var words []int // positions of the arguments that are not flags
+	for i, arg := range args {
+		if !isFlag(arg) {
+			words = append(words, i)
+		}
+	}
+	for _, command := range commands {
+		for w := 0; w+len(command) <= len(words); w++ {
+			n := 0
+			for n < len(command) && args[words[w+n]] == command[n] {
+				n++
+			}
+			if n == len(command) {
+				return fmt.Errorf("argument %d: subcommand %q is denied", words[w+n-1]+1, strings.Join(command, " "))
+			}
+		}
+	}
+	return nil
+}
+
+// deniedFlag returns the flag in flags that arg uses, if any. values holds
+// the letters of short flags that take a value. Since the tool's own
+// option parser is unknown, it errs towards refusing:
+//
+//   - a long flag matches with a value (--config=x) and abbreviated to
+//     three letters or more (--conf), as curl and git accept;
+//   - a short flag matches with a value attached (-oFile) and anywhere in
+//     a group of short flags (-sSo), up to the first flag known to take a
+//     value (in -HX-Foo, X-Foo is the value of -H) or the first character
+//     that cannot name a flag.
+func deniedFlag(arg string, flags []string, values string) string {
+	if !isFlag(arg) {
+		return ""
+	}
+	if strings.HasPrefix(arg, "--") {
+		name, _, _ := strings.Cut(arg, "=")
+		for _, flag := range flags {
+			if name == flag || len(name) >= len("--abc") && strings.HasPrefix(flag, name) {
+				return flag
+			}
+		}
+		return ""
+	}
+	for _, flag := range flags {
+		if len(flag) > 2 && !strings.HasPrefix(flag, "--") { // a single-dash long flag, as in find -exec
+			if arg == flag || strings.HasPrefix(arg, flag+"=") {
+				return flag
+			}
+		}
+	}
+	return groupFlag(arg, flags, values)
+}
+
+// flagValue returns the flag in arg that takes a value and that value. If
+// the value is not attached, as in -sH value or --name value, it returns
+// the flag alone: the next argument may be its value. A short flag takes a
+// value if its letter is in values; a long one may always take one.
+func flagValue(arg, values string) (flag, value string, attached bool) {
+	if !isFlag(arg) {
+		return "", "", false
+	}
+	if strings.HasPrefix(arg, "--") {
+		return strings.Cut(arg, "=")
+	}
+	for i, c := range arg[1:] {
+		if !isFlagLetter(c) {
+			break
+		}
+		if strings.ContainsRune(values, c) {
+			value = arg[i+2:]
+			return "-" + string(c), value, value != ""
+		}
+	}
+	return "", "", false
+}
+
+// joinFlag attaches value to flag, as -ovalue or --name=value.
+func joinFlag(flag, value string) string {
+	if strings.HasPrefix(flag, "--") {
+		return flag + "=" + value
+	}
+	return flag + value
+}
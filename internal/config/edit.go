@@ -0,0 +1,307 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is a config file opened for editing its tokens. Everything
+// else, comments and key order included, is written back as it was.
+type ConfigFile struct {
+	path string
+	doc  yaml.Node
+}
+
+// TokenList is the tokens list of one auth section, or of one principal
+// in it, within a ConfigFile.
+type TokenList struct {
+	Listener  string // Address of the listener whose auth section this is; "" for the top-level auth
+	Principal string // "" for the section's shared tokens
+
+	owner  *yaml.Node // mapping that holds (or will hold) the tokens key
+	parent *yaml.Node // mapping or sequence holding owner
+}
+
+// TokenRef is one token in a ConfigFile.
+type TokenRef struct {
+	List  *TokenList
+	Index int
+	Token Token
+}
+
+// OpenConfigFile reads a config file for editing.
+func OpenConfigFile(path string) (*ConfigFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	f := &ConfigFile{path: path}
+	if err := yaml.Unmarshal(data, &f.doc); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+	if f.doc.Kind == 0 {
+		f.doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if f.doc.Kind != yaml.DocumentNode || len(f.doc.Content) != 1 || f.doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("parsing config: %s is not a YAML mapping", path)
+	}
+	return f, nil
+}
+
+// Save writes the file back, keeping its mode. The new contents go to a
+// temporary file that then replaces the config, so a crash or a full disk
+// cannot leave the server with half a config.
+func (f *ConfigFile) Save() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&f.doc); err != nil {
+		return fmt.Errorf("serializing config: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("serializing config: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path)
+	}
+	if err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	return nil
+}
+
+// TokenLists returns the token lists of every auth section in the file:
+// the top-level auth, then each listener's, each followed by its
+// principals'.
+func (f *ConfigFile) TokenLists() []*TokenList {
+	root := f.doc.Content[0]
+	var lists []*TokenList
+	addSection := func(listener string, parent *yaml.Node) {
+		auth := mapValue(parent, "auth")
+		if auth == nil || auth.Kind != yaml.MappingNode {
+			return
+		}
+		lists = append(lists, &TokenList{Listener: listener, owner: auth, parent: parent})
+		if principals := mapValue(auth, "principals"); principals != nil && principals.Kind == yaml.SequenceNode {
+			for _, p := range principals.Content {
+				if p.Kind == yaml.MappingNode {
+					name := ""
+					if n := mapValue(p, "name"); n != nil {
+						name = n.Value
+					}
+					lists = append(lists, &TokenList{Listener: listener, Principal: name, owner: p, parent: principals})
+				}
+			}
+		}
+	}
+
+	addSection("", root)
+	if server := mapValue(root, "server"); server != nil && server.Kind == yaml.MappingNode {
+		if listeners := mapValue(server, "listeners"); listeners != nil && listeners.Kind == yaml.SequenceNode {
+			for _, l := range listeners.Content {
+				if l.Kind != yaml.MappingNode {
+					continue
+				}
+				addr := ""
+				if n := mapValue(l, "address"); n != nil {
+					addr = n.Value
+				}
+				addSection(addr, l)
+			}
+		}
+	}
+	return lists
+}
+
+// TokenList returns the tokens list of principal ("" for the shared
+// tokens) in the auth section of listener ("" for the top-level one). The
+// top-level auth section is added if the file has none; a listener's is
+// not, since adding one would stop the listener using the top-level auth.
+func (f *ConfigFile) TokenList(listener, principal string) (*TokenList, error) {
+	for _, l := range f.TokenLists() {
+		if l.Listener == listener && l.Principal == principal {
+			return l, nil
+		}
+	}
+	switch {
+	case principal != "":
+		return nil, fmt.Errorf("principal '%s' not found in %s", principal, sectionName(listener))
+	case listener != "":
+		return nil, fmt.Errorf("listener %s not found, or it has no auth section of its own", listener)
+	}
+	auth := &yaml.Node{Kind: yaml.MappingNode}
+	setMapValue(f.doc.Content[0], "auth", auth)
+	return &TokenList{owner: auth, parent: f.doc.Content[0]}, nil
+}
+
+// FindTokens returns every token with id, in all auth sections. Copies of
+// a token in several sections share its ID.
+func (f *ConfigFile) FindTokens(id string) ([]TokenRef, error) {
+	var refs []TokenRef
+	for _, l := range f.TokenLists() {
+		tokens, err := l.Tokens()
+		if err != nil {
+			return nil, err
+		}
+		for i, tok := range tokens {
+			if tok.ID == id {
+				refs = append(refs, TokenRef{List: l, Index: i, Token: tok})
+			}
+		}
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no token with ID %s", id)
+	}
+	return refs, nil
+}
+
+// Section names the auth section of the list, as "auth" or "auth of
+// listener ADDR".
+func (l *TokenList) Section() string {
+	return sectionName(l.Listener)
+}
+
+func sectionName(listener string) string {
+	if listener == "" {
+		return "auth"
+	}
+	return "auth of listener " + listener
+}
+
+// Tokens decodes the tokens in the list.
+func (l *TokenList) Tokens() ([]Token, error) {
+	seq := l.seq()
+	if seq == nil {
+		return nil, nil
+	}
+	tokens := make([]Token, len(seq.Content))
+	for i, item := range seq.Content {
+		if err := item.Decode(&tokens[i]); err != nil {
+			return nil, fmt.Errorf("%s tokens[%d]: %w", l.Section(), i, err)
+		}
+	}
+	return tokens, nil
+}
+
+// Add appends tok to the list.
+func (l *TokenList) Add(tok Token) error {
+	var item yaml.Node
+	if err := item.Encode(tok); err != nil {
+		return err
+	}
+	seq := l.seq()
+	if seq == nil {
+		seq = &yaml.Node{Kind: yaml.SequenceNode}
+		setMapValue(l.owner, "tokens", seq)
+	}
+	l.blockStyle()
+	seq.Content = append(seq.Content, &item)
+	return nil
+}
+
+// Set replaces the token at index i, keeping the comments around it.
+func (l *TokenList) Set(i int, tok Token) error {
+	seq := l.seq()
+	var item yaml.Node
+	if err := item.Encode(tok); err != nil {
+		return err
+	}
+	old := seq.Content[i]
+	item.HeadComment, item.LineComment, item.FootComment = old.HeadComment, old.LineComment, old.FootComment
+	if item.Kind == yaml.MappingNode {
+		l.blockStyle()
+	}
+	seq.Content[i] = &item
+	return nil
+}
+
+// Remove deletes the token at index i.
+func (l *TokenList) Remove(i int) {
+	seq := l.seq()
+	seq.Content = append(seq.Content[:i:i], seq.Content[i+1:]...)
+}
+
+// blockStyle writes the list and its owner one entry per line, since
+// tokens with fields are unreadable inline.
+func (l *TokenList) blockStyle() {
+	unflow(l.parent, l.owner)
+	unflow(l.owner, l.seq())
+}
+
+// unflow turns n, a value in parent, from flow to block style. A comment
+// at the end of its line moves to the line it starts on, where it stays.
+func unflow(parent, n *yaml.Node) {
+	if n == nil || n.Style&yaml.FlowStyle == 0 {
+		return
+	}
+	n.Style &^= yaml.FlowStyle
+	if n.LineComment == "" {
+		return
+	}
+	var line *yaml.Node
+	if parent != nil && parent.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(parent.Content); i += 2 {
+			if parent.Content[i+1] == n {
+				line = parent.Content[i] // key: # comment
+			}
+		}
+	} else if n.Kind == yaml.MappingNode && len(n.Content) > 0 {
+		line = n.Content[0] // - key: value # comment
+	}
+	if line != nil && line.LineComment == "" {
+		line.LineComment, n.LineComment = n.LineComment, ""
+	}
+}
+
+func (l *TokenList) seq() *yaml.Node {
+	seq := mapValue(l.owner, "tokens")
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return seq
+}
+
+// mapValue returns the value of key in mapping m, or nil.
+func mapValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMapValue sets key in mapping m, adding it at the end if it is new.
+func setMapValue(m *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content[i+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
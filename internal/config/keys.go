@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKey is one parsed auth.authorized_keys entry. Entries use the
+// authorized_keys format, with a principal option naming the principal the
+// key authenticates as:
+//
+//	authorized_keys:
+//	  - 'principal="ops-agent" ssh-ed25519 AAAAC3Nza... ops@build-1'
+//	  - "ssh-ed25519 AAAAC3Nza... admin@laptop"
+//
+// A key without a principal may run every tool, like a shared token.
+type AuthorizedKey struct {
+	Key       ssh.PublicKey
+	Principal string // Name of the principal, or "" for shared access
+	Comment   string
+}
+
+// Fingerprint returns the key's SHA256 fingerprint, as shown by ssh-keygen.
+func (k *AuthorizedKey) Fingerprint() string {
+	return ssh.FingerprintSHA256(k.Key)
+}
+
+// parseAuthorizedKey parses an authorized_keys line. Options other than
+// principal are refused rather than ignored, since they would restrict the
+// key in OpenSSH.
+func parseAuthorizedKey(line string) (AuthorizedKey, error) {
+	key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return AuthorizedKey{}, err
+	}
+	if len(strings.TrimSpace(string(rest))) > 0 {
+		return AuthorizedKey{}, fmt.Errorf("one key per entry")
+	}
+	k := AuthorizedKey{Key: key, Comment: comment}
+	for _, opt := range options {
+		name, value, _ := strings.Cut(opt, "=")
+		if name != "principal" {
+			return AuthorizedKey{}, fmt.Errorf("unsupported option %s", name)
+		}
+		if k.Principal, err = strconv.Unquote(value); err != nil || k.Principal == "" {
+			return AuthorizedKey{}, fmt.Errorf("principal option needs a quoted name")
+		}
+	}
+	return k, nil
+}
+
+// LookupKey returns the authorized_keys entry for key, with its principal
+// (nil for shared access).
+func (a *AuthConfig) LookupKey(key ssh.PublicKey) (*AuthorizedKey, *Principal, bool) {
+	want := key.Marshal()
+	for i := range a.keys {
+		k := &a.keys[i]
+		if string(k.Key.Marshal()) != string(want) {
+			continue
+		}
+		for j := range a.Principals {
+			if a.Principals[j].Name == k.Principal {
+				return k, &a.Principals[j], true
+			}
+		}
+		return k, nil, true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Actions an auth rule can take.
+const (
+	RuleAllow = "allow"
+	RuleDeny  = "deny"
+)
+
+// AuthRule is one entry of auth.rules. Rules are tried in order; the first
+// whose conditions all hold decides whether the request is allowed, and a
+// request no rule matches is refused. A rule without conditions matches
+// every request, so it can end the list with a default.
+//
+//	rules:
+//	  - {name: lan, cidrs: [192.168.0.0/16], action: deny}
+//	  - {name: agents, token: true, tailscale_tags: ["tag:agents"], action: allow}
+//	  - {name: ops, client_certs: [ops], action: allow}
+//
+// Tokens and SSH keys are still checked as usual; the token, token_ids and
+// principals conditions only say which of them a rule requires. The three
+// tailscale_* lists together form one condition, met by a node matching
+// any of them, as in the auth section itself.
+type AuthRule struct {
+	Name   string `yaml:"name"`   // Shown by `auth explain` and in the log (optional)
+	Action string `yaml:"action"` // allow or deny
+
+	Token          *bool    `yaml:"token"`           // A valid token or SSH key was presented (true) or not (false)
+	TokenIDs       []string `yaml:"token_ids"`       // The hashed token presented has one of these IDs
+	Principals     []string `yaml:"principals"`      // The token or SSH key belongs to one of these principals
+	CIDRs          []string `yaml:"cidrs"`           // The client address is one of these IPs or CIDR ranges
+	TailscaleNodes []string `yaml:"tailscale_nodes"` // The client is one of these Tailscale nodes,
+	TailscaleUsers []string `yaml:"tailscale_users"` // or an untagged node one of these users owns,
+	TailscaleTags  []string `yaml:"tailscale_tags"`  // or a node with one of these ACL tags
+	ClientCerts    []string `yaml:"client_certs"`    // The client certificate has one of these names
+	Local          *bool    `yaml:"local"`           // The client is a local process on a unix socket (true) or not (false)
+	PeerUsers      []string `yaml:"peer_users"`      // The local process runs as one of these users (names or uids)
+	PeerGroups     []string `yaml:"peer_groups"`     // The local process runs with one of these primary groups
+}
+
+// Label names the rule in messages: its name, or its position.
+func (r *AuthRule) Label(i int) string {
+	if r.Name != "" {
+		return fmt.Sprintf("rule %d (%s)", i+1, r.Name)
+	}
+	return fmt.Sprintf("rule %d", i+1)
+}
+
+// UsesTailscale reports whether the rule has Tailscale conditions.
+func (r *AuthRule) UsesTailscale() bool {
+	return len(r.TailscaleNodes) > 0 || len(r.TailscaleUsers) > 0 || len(r.TailscaleTags) > 0
+}
+
+// String summarizes the rule's conditions, as in "token cidrs=[10.0.0.0/8]".
+func (r *AuthRule) String() string {
+	var conds []string
+	flag := func(name string, v *bool) {
+		if v != nil {
+			if *v {
+				conds = append(conds, name)
+			} else {
+				conds = append(conds, "!"+name)
+			}
+		}
+	}
+	list := func(name string, v []string) {
+		if len(v) > 0 {
+			conds = append(conds, fmt.Sprintf("%s=[%s]", name, strings.Join(v, ",")))
+		}
+	}
+	flag("token", r.Token)
+	list("token_ids", r.TokenIDs)
+	list("principals", r.Principals)
+	list("cidrs", r.CIDRs)
+	if r.UsesTailscale() {
+		var ids []string
+		ids = append(ids, r.TailscaleNodes...)
+		ids = append(ids, r.TailscaleUsers...)
+		list("tailscale", append(ids, r.TailscaleTags...))
+	}
+	list("client_certs", r.ClientCerts)
+	flag("local", r.Local)
+	list("peer_users", r.PeerUsers)
+	list("peer_groups", r.PeerGroups)
+	if len(conds) == 0 {
+		return "any request"
+	}
+	return strings.Join(conds, " ")
+}
+
+func (r *AuthRule) validate(auth *AuthConfig) error {
+	if r.Action != RuleAllow && r.Action != RuleDeny {
+		return fmt.Errorf("action must be allow or deny")
+	}
+	for _, cidr := range r.CIDRs {
+		if net.ParseIP(cidr) == nil {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("cidrs: %q is not an IP or CIDR range", cidr)
+			}
+		}
+	}
+	for _, tag := range r.TailscaleTags {
+		if !strings.HasPrefix(tag, "tag:") {
+			return fmt.Errorf("tailscale_tags: %q is not a tag:name", tag)
+		}
+	}
+	for _, name := range r.Principals {
+		if auth.principal(name) == nil {
+			return fmt.Errorf("names unknown principal %s", name)
+		}
+	}
+	return nil
+}
+
+func (a *AuthConfig) principal(name string) *Principal {
+	for i := range a.Principals {
+		if a.Principals[i].Name == name {
+			return &a.Principals[i]
+		}
+	}
+	return nil
+}
+
+// EffectiveRules returns the rules requests are checked against: auth.rules,
+// or if there are none, rules equivalent to the older require_token,
+// allowed_ips, tailscale_*, client_certs and peers settings:
+//
+//   - With require_token, or tokens but none of the other settings, a
+//     request needs a token (or SSH key) and, if allowed_ips is set, an
+//     allowed address.
+//   - Otherwise any one of a token, an allowed address, an allowed Tailscale
+//     identity, an allowed client certificate or an allowed local peer is
+//     enough.
+//
+// Either way, when peers is set a local process must match one of them.
+func (a *AuthConfig) EffectiveRules() []AuthRule {
+	if len(a.Rules) > 0 {
+		return a.Rules
+	}
+	yes := true
+	var rules []AuthRule
+	tokenMode := a.RequireToken || a.HasTokens() && len(a.AllowedIPs) == 0 && !a.UsesTailscale() && len(a.ClientCerts) == 0 && len(a.Peers) == 0
+
+	for _, p := range a.Peers {
+		rule := AuthRule{Name: "peers", Action: RuleAllow}
+		if p.User != "" {
+			rule.PeerUsers = []string{p.User}
+		}
+		if p.Group != "" {
+			rule.PeerGroups = []string{p.Group}
+		}
+		if tokenMode {
+			rule.Token, rule.CIDRs = &yes, a.AllowedIPs
+		}
+		rules = append(rules, rule)
+	}
+	if len(a.Peers) > 0 {
+		rules = append(rules, AuthRule{Name: "other local users", Action: RuleDeny, Local: &yes})
+	}
+
+	if tokenMode {
+		return append(rules, AuthRule{Name: "require_token", Action: RuleAllow, Token: &yes, CIDRs: a.AllowedIPs})
+	}
+	rules = append(rules, AuthRule{Name: "tokens", Action: RuleAllow, Token: &yes})
+	if len(a.AllowedIPs) > 0 {
+		rules = append(rules, AuthRule{Name: "allowed_ips", Action: RuleAllow, CIDRs: a.AllowedIPs})
+	}
+	if a.UsesTailscale() {
+		rules = append(rules, AuthRule{Name: "tailscale", Action: RuleAllow,
+			TailscaleNodes: a.TailscaleNodes, TailscaleUsers: a.TailscaleUsers, TailscaleTags: a.TailscaleTags})
+	}
+	if len(a.ClientCerts) > 0 {
+		rules = append(rules, AuthRule{Name: "client_certs", Action: RuleAllow, ClientCerts: a.ClientCerts})
+	}
+	return rules
+}
+
+// validateRules checks auth.rules, which replace the settings they are
+// derived from otherwise.
+func (a *AuthConfig) validateRules() error {
+	if len(a.Rules) == 0 {
+		return nil
+	}
+	if a.RequireToken || len(a.AllowedIPs) > 0 || len(a.TailscaleNodes) > 0 || len(a.TailscaleUsers) > 0 || len(a.TailscaleTags) > 0 || len(a.ClientCerts) > 0 {
+		return fmt.Errorf("rules replace require_token, allowed_ips, tailscale_nodes, tailscale_users, tailscale_tags and client_certs; use rule conditions instead")
+	}
+	for i := range a.Rules {
+		if err := a.Rules[i].validate(a); err != nil {
+			return fmt.Errorf("%s: %w", a.Rules[i].Label(i), err)
+		}
+	}
+	return nil
+}
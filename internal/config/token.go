@@ -0,0 +1,278 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// TokenPrefix starts every token generated by NewToken.
+const TokenPrefix = "cw_"
+
+// hashScheme names the hash function in Token.Hash.
+const hashScheme = "sha256"
+
+// Token is one accepted token. The config holds either the token itself, a
+// legacy form written as a plain string, or a salted hash of it written by
+// `credwrap-server tokens`:
+//
+//	tokens:
+//	  - "plaintext-token"
+//	  - {id: 3f9a1c2e, hash: "sha256:<salt>:<digest>", name: laptop, created: 2026-10-16}
+//	  - {id: 7b20d4f1, hash: "...", expires: 2026-12-31, max_uses: 100}
+//	  - {id: 0c5e9a43, hash: "...", sign_key: "<base64>"}
+//
+// A plaintext token that needs limits is written as a mapping with a token
+// key instead of a string.
+type Token struct {
+	ID        string `yaml:"id,omitempty"`         // Public handle; generated tokens start with cw_<id>_
+	Hash      string `yaml:"hash,omitempty"`       // "sha256:" salt ":" digest, base64
+	Plain     string `yaml:"token,omitempty"`      // Legacy plaintext token
+	Name      string `yaml:"name,omitempty"`       // Label shown by `tokens list`
+	Created   string `yaml:"created,omitempty"`    // Date the token was issued
+	NotBefore string `yaml:"not_before,omitempty"` // Token is rejected before this time (optional)
+	Expires   string `yaml:"expires,omitempty"`    // Token is rejected from this time on (optional)
+	MaxUses   int    `yaml:"max_uses,omitempty"`   // Requests the token may authenticate; unlimited if 0
+	SignKey   string `yaml:"sign_key,omitempty"`   // Key to check request signatures with, base64 (hashed tokens only)
+
+	notBefore time.Time // Parsed NotBefore
+	expires   time.Time // Parsed Expires
+	signKey   []byte    // Decoded SignKey
+}
+
+// NewToken generates a token and returns it with its hashed config entry.
+// The token is not stored anywhere and must be shown to the user once.
+func NewToken(name string) (secret string, tok Token, err error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", Token{}, err
+	}
+	return issueToken(id, name)
+}
+
+// Rotate generates a new secret for the token, keeping its ID and name. A
+// token that can check signatures gets the new secret's signing key.
+func (t Token) Rotate() (secret string, tok Token, err error) {
+	secret, tok, err = issueToken(t.ID, t.Name)
+	if err == nil && t.SignKey != "" {
+		tok.EnableSigning(secret)
+	}
+	return secret, tok, err
+}
+
+// EnableSigning stores the signing key of secret, this token's plaintext,
+// so that the server can check requests signed with it. Like a plaintext
+// token, the key lets anyone who reads the config sign requests.
+func (t *Token) EnableSigning(secret string) {
+	t.signKey = protocol.SigningKey(secret)
+	t.SignKey = base64.StdEncoding.EncodeToString(t.signKey)
+}
+
+// SigningKey returns the key requests signed with this token are checked
+// with, or nil for a hashed token without a sign_key.
+func (t *Token) SigningKey() []byte {
+	if !t.Hashed() {
+		return protocol.SigningKey(t.Plain)
+	}
+	return t.signKey
+}
+
+func issueToken(id, name string) (secret string, tok Token, err error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", Token{}, err
+	}
+	secret = TokenPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(key)
+	tok = Token{ID: id, Name: name, Created: time.Now().UTC().Format("2006-01-02")}
+	if tok.Hash, err = hashToken(secret); err != nil {
+		return "", Token{}, err
+	}
+	return secret, tok, nil
+}
+
+// TokenID returns the ID a generated token names after TokenPrefix, or ""
+// if token does not have that form. The ID is not secret, and says nothing
+// about whether the rest of the token is right.
+func TokenID(token string) string {
+	rest, ok := strings.CutPrefix(token, TokenPrefix)
+	id, _, found := strings.Cut(rest, "_")
+	if !ok || !found {
+		return ""
+	}
+	return id
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// HashedToken returns a hashed entry for an existing plaintext token, so a
+// legacy token can be kept without storing it.
+func HashedToken(secret, name string) (Token, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return Token{}, err
+	}
+	hash, err := hashToken(secret)
+	if err != nil {
+		return Token{}, err
+	}
+	return Token{ID: id, Hash: hash, Name: name, Created: time.Now().UTC().Format("2006-01-02")}, nil
+}
+
+// hashToken hashes secret with a fresh salt.
+func hashToken(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return hashScheme + ":" + base64.RawStdEncoding.EncodeToString(salt) + ":" +
+		base64.RawStdEncoding.EncodeToString(digest(salt, secret)), nil
+}
+
+func digest(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
+
+// Hashed reports whether the config stores only a hash of the token.
+func (t *Token) Hashed() bool {
+	return t.Plain == ""
+}
+
+// Matches reports whether presented is this token. It takes the same time
+// whether or not presented matches.
+func (t *Token) Matches(presented string) bool {
+	if !t.Hashed() {
+		return subtle.ConstantTimeCompare([]byte(presented), []byte(t.Plain)) == 1
+	}
+	salt, want, err := t.parseHash()
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(digest(salt, presented), want) == 1
+}
+
+func (t *Token) parseHash() (salt, sum []byte, err error) {
+	parts := strings.Split(t.Hash, ":")
+	if len(parts) != 3 || parts[0] != hashScheme {
+		return nil, nil, fmt.Errorf("token %s: hash must be %s:<salt>:<digest>", t.ID, hashScheme)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return nil, nil, fmt.Errorf("token %s: bad salt: %w", t.ID, err)
+	}
+	if sum, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil || len(sum) != sha256.Size {
+		return nil, nil, fmt.Errorf("token %s: bad digest", t.ID)
+	}
+	return salt, sum, nil
+}
+
+// Active reports whether now is within the token's not_before and expires
+// times.
+func (t *Token) Active(now time.Time) bool {
+	if !t.notBefore.IsZero() && now.Before(t.notBefore) {
+		return false
+	}
+	return t.expires.IsZero() || now.Before(t.expires)
+}
+
+// ValidFrom returns the token's not_before time, or the zero time if it has
+// none.
+func (t *Token) ValidFrom() time.Time {
+	return t.notBefore
+}
+
+// ExpiresAt returns the token's expiry time, or the zero time if it does not
+// expire.
+func (t *Token) ExpiresAt() time.Time {
+	return t.expires
+}
+
+func (t *Token) validate() error {
+	var err error
+	if t.notBefore, err = ParseTokenTime(t.NotBefore); err != nil {
+		return fmt.Errorf("not_before: %w", err)
+	}
+	if t.expires, err = ParseTokenTime(t.Expires); err != nil {
+		return fmt.Errorf("expires: %w", err)
+	}
+	if !t.notBefore.IsZero() && !t.expires.IsZero() && !t.notBefore.Before(t.expires) {
+		return fmt.Errorf("not_before must be before expires")
+	}
+	if t.MaxUses < 0 {
+		return fmt.Errorf("max_uses must not be negative")
+	}
+	if t.MaxUses > 0 && t.ID == "" {
+		return fmt.Errorf("token with max_uses needs an id")
+	}
+	if !t.Hashed() {
+		if t.Hash != "" || t.SignKey != "" {
+			return fmt.Errorf("plaintext token cannot have a hash or sign_key")
+		}
+		return nil
+	}
+	if t.SignKey != "" {
+		if t.signKey, err = base64.StdEncoding.DecodeString(t.SignKey); err != nil || len(t.signKey) != sha256.Size {
+			return fmt.Errorf("token %s: bad sign_key", t.ID)
+		}
+	}
+	if t.ID == "" {
+		return fmt.Errorf("hashed token needs an id")
+	}
+	_, _, err = t.parseHash()
+	return err
+}
+
+// tokenTimeLayouts are the accepted forms of not_before and expires. A bare
+// date means midnight UTC.
+var tokenTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"}
+
+// ParseTokenTime parses a not_before or expires value. An empty value is
+// the zero time.
+func ParseTokenTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range tokenTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date or RFC 3339 time", value)
+}
+
+// UnmarshalYAML accepts a plain string as a legacy plaintext token.
+func (t *Token) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		if value.Value == "" {
+			return fmt.Errorf("line %d: empty token", value.Line)
+		}
+		*t = Token{Plain: value.Value}
+		return nil
+	}
+	type plain Token
+	return value.Decode((*plain)(t))
+}
+
+// MarshalYAML writes legacy tokens without limits back as plain strings.
+func (t Token) MarshalYAML() (interface{}, error) {
+	if !t.Hashed() && t.ID == "" && t.NotBefore == "" && t.Expires == "" && t.MaxUses == 0 {
+		return t.Plain, nil
+	}
+	type plain Token
+	return plain(t), nil
+}
@@ -0,0 +1,15 @@
+package protocol
+
+import "strings"
+
+// UnixPrefix marks a server address as a unix domain socket path.
+const UnixPrefix = "unix:"
+
+// SplitAddress returns the network and address to dial or listen on for a
+// credwrap address: "unix:/path/to.sock" or a TCP "host:port".
+func SplitAddress(addr string) (network, address string) {
+	if strings.HasPrefix(addr, UnixPrefix) {
+		return "unix", strings.TrimPrefix(addr, UnixPrefix)
+	}
+	return "tcp", addr
+}
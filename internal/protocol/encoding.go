@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// MaxChunkSize bounds the decoded size of a single data field, so a small
+// compressed frame cannot expand without limit.
+const MaxChunkSize = 1 << 20
+
+// ValidEncoding reports whether the encoding is supported.
+func ValidEncoding(encoding string) bool {
+	switch encoding {
+	case EncodingText, EncodingBase64, EncodingDeflate:
+		return true
+	}
+	return false
+}
+
+// EncodingFeature returns the feature a peer must have negotiated to use
+// the encoding, or "" if it is always available.
+func EncodingFeature(encoding string) string {
+	switch encoding {
+	case EncodingBase64:
+		return FeatureBinary
+	case EncodingDeflate:
+		return FeatureCompression
+	}
+	return ""
+}
+
+// EncodeData encodes raw bytes for a data field using the given encoding.
+func EncodeData(p []byte, encoding string) (string, error) {
+	switch encoding {
+	case EncodingText:
+		return string(p), nil
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString(p), nil
+	case EncodingDeflate:
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write(p); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+	}
+	return "", fmt.Errorf("unsupported encoding: %s", encoding)
+}
+
+// DecodeData decodes a data field back to raw bytes.
+func DecodeData(data, encoding string) ([]byte, error) {
+	switch encoding {
+	case EncodingText:
+		return []byte(data), nil
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(data)
+	case EncodingDeflate:
+		compressed, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, err
+		}
+		r := flate.NewReader(bytes.NewReader(compressed))
+		defer r.Close()
+		p, err := io.ReadAll(io.LimitReader(r, MaxChunkSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(p) > MaxChunkSize {
+			return nil, fmt.Errorf("chunk exceeds %d bytes", MaxChunkSize)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+}
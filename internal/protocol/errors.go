@@ -0,0 +1,29 @@
+package protocol
+
+// Error codes carried in ErrorResponse.ErrorCode. Codes for rejected execs
+// are the same strings the server writes as the audit log status.
+const (
+	ErrorAuthFailed        = "auth_failed"
+	ErrorTokenExpired      = "token_expired"   // token outside its not_before/expires window
+	ErrorTokenExhausted    = "token_exhausted" // token used max_uses times
+	ErrorThrottled         = "throttled"       // too many failed authentications; banned or backing off
+	ErrorUnknownTool       = "unknown_tool"
+	ErrorToolDenied        = "tool_denied" // authenticated, but not allowed to run the tool
+	ErrorInvalidArgs       = "invalid_args"
+	ErrorCredentialMissing = "credential_missing"
+	ErrorStartFailed       = "start_failed"
+	ErrorInvalidRequest    = "invalid_request" // malformed or inconsistent request
+	ErrorUnsupported       = "unsupported"     // message type or feature not available
+	ErrorBusy              = "busy"            // exec ID in use or too many execs
+	ErrorInternal          = "internal"
+)
+
+// Retryable reports whether a request that failed with the given code may
+// succeed if sent again unchanged.
+func Retryable(code string) bool {
+	switch code {
+	case ErrorBusy, ErrorInternal:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package protocol
+
+// Paths served by the HTTP gateway.
+const (
+	HTTPPathExec  = "/v1/exec"
+	HTTPPathTools = "/v1/tools" // GET lists tools; GET /v1/tools/{name} describes one
+	HTTPPathPing  = "/v1/ping"
+)
+
+// Content types that make POST /v1/exec stream frames instead of returning
+// a single result.
+const (
+	ContentTypeNDJSON = "application/x-ndjson"
+	ContentTypeSSE    = "text/event-stream"
+)
+
+// HTTPExecRequest is the body of POST /v1/exec. The token travels in the
+// Authorization header as a bearer token.
+type HTTPExecRequest struct {
+	Tool string            `json:"tool"`
+	Args []string          `json:"args,omitempty"`
+	Env  map[string]string `json:"env,omitempty"`
+
+	// Encoding of the output: EncodingText (the default), EncodingBase64
+	// or EncodingDeflate.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Stdin is written to the tool's stdin, which is then closed.
+	Stdin         string `json:"stdin,omitempty"`
+	StdinEncoding string `json:"stdin_encoding,omitempty"`
+
+	// A signature in place of the Authorization header, made as for an
+	// ExecRequest of type "exec" with the same tool, args and env.
+	RequestSignature
+}
+
+// HTTPExecResult is the buffered response to POST /v1/exec. Stdout and
+// Stderr hold the complete output in the requested encoding; Truncated is
+// set if the output exceeded the server's limit.
+type HTTPExecResult struct {
+	Type      string `json:"type"` // TypeExit
+	Code      int    `json:"code"`
+	Signal    string `json:"signal,omitempty"`
+	Canceled  bool   `json:"canceled,omitempty"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
@@ -1,12 +1,45 @@
 // Package protocol defines the wire protocol for credwrap client-server communication.
 package protocol
 
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+)
+
+// Protocol versions. Version 1 is the original protocol, spoken by peers
+// that never send hello; it has text output, one exec at a time and none of
+// the optional features.
+const (
+	ProtocolV1      = 1
+	ProtocolVersion = 2 // the highest version this package implements
+)
+
+// Optional features negotiated by hello. A peer must not use a feature that
+// was not negotiated on its connection.
+const (
+	FeatureBinary      = "binary"      // base64 output and stdin chunks
+	FeatureMultiplex   = "multiplex"   // concurrent execs tagged with IDs
+	FeatureSignals     = "signals"     // signal and cancel messages
+	FeaturePTY         = "pty"         // pseudo-terminal execs and resize
+	FeatureCompression = "compression" // deflate output and stdin chunks
+	FeatureDiscovery   = "discovery"   // list_tools and describe_tool
+	FeatureSSHAuth     = "ssh_auth"    // ssh_auth challenge-response after hello
+)
+
 // Request types
 const (
-	TypeExec       = "exec"
-	TypeStdin      = "stdin"
-	TypeStdinClose = "stdin_close"
-	TypePing       = "ping"
+	TypeHello        = "hello"
+	TypeExec         = "exec"
+	TypeStdin        = "stdin"
+	TypeStdinClose   = "stdin_close"
+	TypePing         = "ping"
+	TypeSignal       = "signal"
+	TypeCancel       = "cancel"
+	TypeResize       = "resize"
+	TypeListTools    = "list_tools"
+	TypeDescribeTool = "describe_tool"
+	TypeSSHAuth      = "ssh_auth"
 )
 
 // Response types
@@ -17,54 +50,297 @@ const (
 	TypeExit    = "exit"
 	TypeError   = "error"
 	TypePong    = "pong"
+	TypeTools   = "tools"
+	TypeTool    = "tool"
+	// ssh_auth is answered with a frame of the same type
 )
 
+// Data encodings for output and stdin frames. An empty encoding means the
+// legacy line-oriented text mode.
+const (
+	EncodingText    = ""
+	EncodingBase64  = "base64"
+	EncodingDeflate = "deflate" // base64 of a raw DEFLATE stream
+)
+
+// Signals a client may deliver to a running tool.
+const (
+	SignalHangup    = "SIGHUP"
+	SignalInterrupt = "SIGINT"
+	SignalQuit      = "SIGQUIT"
+	SignalKill      = "SIGKILL"
+	SignalTerminate = "SIGTERM"
+)
+
+// Every frame carries an optional ID. The client picks a unique ID for each
+// exec (and ping) on a connection; the server copies it onto every frame it
+// sends for that request and routes stdin frames by it. This lets a single
+// connection multiplex many concurrent execs. Frames without an ID belong to
+// the connection's single unnamed exec, as in the original protocol.
+
+// Sequenced is implemented by response frames. The server numbers frames
+// per connection, starting at 1, in the order they are written, so clients
+// can reconstruct the relative ordering of stdout and stderr and detect gaps.
+type Sequenced interface {
+	SetSeq(seq uint64)
+}
+
+// HelloRequest is the first message a client sends. It offers the highest
+// protocol version and the features the client supports.
+type HelloRequest struct {
+	Type     string   `json:"type"`
+	Protocol int      `json:"protocol"`
+	Features []string `json:"features,omitempty"`
+	Client   string   `json:"client,omitempty"` // client software version
+}
+
+// HelloResponse answers a hello with the protocol version and the subset of
+// the offered features that are in effect for the rest of the connection.
+type HelloResponse struct {
+	Type     string   `json:"type"`
+	Seq      uint64   `json:"seq,omitempty"`
+	Protocol int      `json:"protocol"`
+	Features []string `json:"features"`
+	Server   string   `json:"server"` // server software version
+
+	// Challenge is a random base64 nonce for ssh_auth, sent when that
+	// feature is agreed.
+	Challenge string `json:"challenge,omitempty"`
+}
+
+// SSHAuthRequest proves the client holds an SSH key by signing the hello
+// challenge. It must come straight after hello, before any other request;
+// on success every later request on the connection is authenticated as the
+// key's principal. The server answers with an SSHAuthResponse or an
+// auth_failed error, after which the client may try another key.
+type SSHAuthRequest struct {
+	Type      string `json:"type"`
+	PublicKey string `json:"public_key"` // authorized_keys format
+	Signature string `json:"signature"`  // base64 of an SSH wire-format signature of SSHAuthData(challenge, binding)
+}
+
+// SSHAuthResponse accepts an SSHAuthRequest.
+type SSHAuthResponse struct {
+	Type        string `json:"type"`
+	Seq         uint64 `json:"seq,omitempty"`
+	Fingerprint string `json:"fingerprint"`         // SHA256 fingerprint of the key
+	Principal   string `json:"principal,omitempty"` // principal the key is mapped to
+}
+
+// SSHAuthData returns what the client signs for ssh_auth: the challenge
+// and the ChannelBinding of the connection it arrived on. The prefix keeps
+// the signature from being valid for any other purpose, and the binding
+// keeps it from being valid on any other connection, so a server that
+// passes another server's challenge on to a client cannot use the answer.
+func SSHAuthData(challenge, binding string) []byte {
+	return []byte("credwrap-ssh-auth-v1\x00" + challenge + "\x00" + binding)
+}
+
+// ChannelBinding identifies conn the same way at both ends: by keying
+// material exported from its TLS session, or failing that by the address
+// of its server end, which a relay cannot share with the server behind it.
+// server says which end of conn the caller is.
+func ChannelBinding(conn net.Conn, server bool) string {
+	if wc, ok := conn.(*WebSocketConn); ok {
+		conn = wc.NetConn()
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		if key, err := state.ExportKeyingMaterial("EXPORTER-credwrap-ssh-auth", nil, 32); err == nil {
+			return "tls:" + base64.StdEncoding.EncodeToString(key)
+		}
+	}
+	addr := conn.RemoteAddr()
+	if server {
+		addr = conn.LocalAddr()
+	}
+	return addr.Network() + ":" + addr.String()
+}
+
 // ExecRequest is sent by client to execute a tool.
 type ExecRequest struct {
 	Type  string            `json:"type"`
+	ID    string            `json:"id,omitempty"`
 	Token string            `json:"token"`
 	Tool  string            `json:"tool"`
 	Args  []string          `json:"args,omitempty"`
 	Env   map[string]string `json:"env,omitempty"`
+	RequestSignature
+
+	// Encoding selects how output is framed. EncodingBase64 streams raw
+	// byte chunks and EncodingDeflate compressed ones; the default streams
+	// text lines.
+	Encoding string `json:"encoding,omitempty"`
+
+	// PTY runs the tool on a pseudo-terminal of the given size instead of
+	// pipes. Its stdout and stderr are merged into the stdout stream.
+	PTY  bool   `json:"pty,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
 }
 
 // StdinData is sent by client to write to the process stdin.
 type StdinData struct {
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"`
+	Data     string `json:"data,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// SignalRequest is sent by client to deliver a signal to a running tool's
+// process group.
+type SignalRequest struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	Signal string `json:"signal"`
+}
+
+// CancelRequest is sent by client to stop a running tool. The server sends
+// SIGTERM to its process group and SIGKILL if it has not exited shortly after.
+type CancelRequest struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+}
+
+// ResizeRequest is sent by client when its terminal changes size during a
+// PTY exec.
+type ResizeRequest struct {
 	Type string `json:"type"`
-	Data string `json:"data,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// ListToolsRequest asks which tools the client may run.
+type ListToolsRequest struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	Token string `json:"token"`
+	RequestSignature
+}
+
+// DescribeToolRequest asks for the details of a single tool.
+type DescribeToolRequest struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	Token string `json:"token"`
+	Tool  string `json:"tool"`
+	RequestSignature
+}
+
+// ToolInfo describes a tool to clients. Path and Credentials are only
+// filled in when the server is configured to reveal them.
+type ToolInfo struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	PassArgs    bool     `json:"pass_args"`
+	ArgsPattern string   `json:"args_pattern,omitempty"`
+	Usage       []string `json:"usage,omitempty"` // Command lines the tool's args schema accepts
+	Stdin       bool     `json:"stdin"`
+	Path        string   `json:"path,omitempty"`
+	Credentials []string `json:"credentials,omitempty"` // "ENV=secret-name" entries
+}
+
+// ToolsResponse answers list_tools, sorted by name.
+type ToolsResponse struct {
+	Type  string     `json:"type"`
+	ID    string     `json:"id,omitempty"`
+	Seq   uint64     `json:"seq,omitempty"`
+	Tools []ToolInfo `json:"tools"`
+}
+
+// ToolResponse answers describe_tool.
+type ToolResponse struct {
+	Type string   `json:"type"`
+	ID   string   `json:"id,omitempty"`
+	Seq  uint64   `json:"seq,omitempty"`
+	Tool ToolInfo `json:"tool"`
 }
 
 // StartedResponse indicates the process has started.
 type StartedResponse struct {
 	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	Seq  uint64 `json:"seq,omitempty"`
 	PID  int    `json:"pid"`
 }
 
 // OutputResponse carries stdout or stderr data.
+// In text mode Data is a single line without its trailing newline; with
+// EncodingBase64 it is an arbitrary chunk of raw bytes.
 type OutputResponse struct {
-	Type string `json:"type"`
-	Data string `json:"data"`
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"`
 }
 
 // ExitResponse indicates the process has exited.
+// If the process was terminated by a signal, Signal names it and Code is
+// 128 plus the signal number, as in a shell.
 type ExitResponse struct {
-	Type string `json:"type"`
-	Code int    `json:"code"`
+	Type     string `json:"type"`
+	ID       string `json:"id,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`
+	Code     int    `json:"code"`
+	Signal   string `json:"signal,omitempty"`
+	Canceled bool   `json:"canceled,omitempty"`
 }
 
-// ErrorResponse indicates an error occurred.
+// ErrorResponse indicates an error occurred. ErrorCode is one of the
+// Error* constants; Message is meant for humans and may change.
 type ErrorResponse struct {
-	Type    string `json:"type"`
-	Message string `json:"message"`
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable,omitempty"`
 }
 
-// PingRequest is a health check.
+// PingRequest is a health check. A client may include its token to learn
+// when the token expires; the ping succeeds either way.
 type PingRequest struct {
-	Type string `json:"type"`
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
 }
 
-// PongResponse is the health check response.
+// PongResponse is the health check response. TokenExpires and Warning are
+// set only when the ping carried a valid token with an expiry time.
 type PongResponse struct {
-	Type    string `json:"type"`
-	Version string `json:"version"`
+	Type         string `json:"type"`
+	ID           string `json:"id,omitempty"`
+	Seq          uint64 `json:"seq,omitempty"`
+	Version      string `json:"version"`
+	TokenExpires string `json:"token_expires,omitempty"` // RFC 3339
+	Warning      string `json:"warning,omitempty"`       // e.g. the token expires soon
 }
+
+// SetSeq implements Sequenced.
+func (r *HelloResponse) SetSeq(seq uint64) { r.Seq = seq }
+
+// SetSeq implements Sequenced.
+func (r *StartedResponse) SetSeq(seq uint64) { r.Seq = seq }
+
+// SetSeq implements Sequenced.
+func (r *OutputResponse) SetSeq(seq uint64) { r.Seq = seq }
+
+// SetSeq implements Sequenced.
+func (r *ExitResponse) SetSeq(seq uint64) { r.Seq = seq }
+
+// SetSeq implements Sequenced.
+func (r *ErrorResponse) SetSeq(seq uint64) { r.Seq = seq }
+
+// SetSeq implements Sequenced.
+func (r *PongResponse) SetSeq(seq uint64) { r.Seq = seq }
+
+// SetSeq implements Sequenced.
+func (r *ToolsResponse) SetSeq(seq uint64) { r.Seq = seq }
+
+// SetSeq implements Sequenced.
+func (r *ToolResponse) SetSeq(seq uint64) { r.Seq = seq }
+
+// SetSeq implements Sequenced.
+func (r *SSHAuthResponse) SetSeq(seq uint64) { r.Seq = seq }
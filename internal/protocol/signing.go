@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RequestSignature authenticates a request without sending the token. It
+// is embedded in the requests that carry a token; when Signature is set the
+// token field is left empty.
+//
+// The signature is an HMAC-SHA256, keyed with SigningKey(token), of the
+// request's SigningString, which covers the message type, tool, arguments,
+// environment, timestamp and nonce. The server rejects signatures with a
+// stale timestamp and nonces it has seen, so a captured request can be
+// neither changed nor replayed.
+type RequestSignature struct {
+	Timestamp int64  `json:"timestamp,omitempty"` // Unix time in seconds
+	Nonce     string `json:"nonce,omitempty"`     // Unique per request
+	Signature string `json:"signature,omitempty"` // base64
+}
+
+// Signed reports whether the request carries a signature.
+func (s *RequestSignature) Signed() bool {
+	return s.Signature != ""
+}
+
+// Stamp returns the time and nonce the request was signed with.
+func (s *RequestSignature) Stamp() (time.Time, string) {
+	return time.Unix(s.Timestamp, 0), s.Nonce
+}
+
+func (s *RequestSignature) signature() *RequestSignature {
+	return s
+}
+
+// Signable is a request that can be signed in place of sending a token.
+type Signable interface {
+	SigningString() []byte
+	Signed() bool
+	Stamp() (time.Time, string)
+	signature() *RequestSignature
+}
+
+// SigningKey derives the key requests made with token are signed with. The
+// server needs it, or the token, to check signatures.
+func SigningKey(token string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte("credwrap request signing"))
+	return mac.Sum(nil)
+}
+
+// Sign stamps req with the current time and a fresh nonce and signs it
+// with token. Set every other field of req first.
+func Sign(req Signable, token string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sig := req.signature()
+	sig.Timestamp = time.Now().Unix()
+	sig.Nonce = base64.RawURLEncoding.EncodeToString(nonce)
+	sig.Signature = base64.StdEncoding.EncodeToString(sign(SigningKey(token), req.SigningString()))
+	return nil
+}
+
+// VerifySignature reports whether req was signed with the token key is
+// derived from. It does not check the timestamp or nonce.
+func VerifySignature(req Signable, key []byte) bool {
+	got, err := base64.StdEncoding.DecodeString(req.signature().Signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, sign(key, req.SigningString()))
+}
+
+func sign(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// signingString builds the canonical form of a request. Each field is on
+// its own line; arguments and environment entries are length-prefixed so
+// that no two requests share a signing string.
+func signingString(msgType, tool string, args []string, env map[string]string, sig *RequestSignature) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "credwrap-signature-v1\n%s\n%d:%s\n%d\n%s\n", msgType, len(tool), tool, sig.Timestamp, sig.Nonce)
+	fmt.Fprintf(&b, "%d\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "%d:%s\n", len(arg), arg)
+	}
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(&b, "%d\n", len(keys))
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%d:%s\n%d:%s\n", len(k), k, len(env[k]), env[k])
+	}
+	return b.Bytes()
+}
+
+// SigningString returns the bytes the request's signature covers.
+func (r *ExecRequest) SigningString() []byte {
+	return signingString(r.Type, r.Tool, r.Args, r.Env, &r.RequestSignature)
+}
+
+// SigningString returns the bytes the request's signature covers.
+func (r *ListToolsRequest) SigningString() []byte {
+	return signingString(r.Type, "", nil, nil, &r.RequestSignature)
+}
+
+// SigningString returns the bytes the request's signature covers.
+func (r *DescribeToolRequest) SigningString() []byte {
+	return signingString(r.Type, r.Tool, nil, nil, &r.RequestSignature)
+}
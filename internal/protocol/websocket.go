@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HTTPPathWebSocket is the HTTP gateway endpoint that upgrades to a
+// WebSocket carrying the socket protocol.
+const HTTPPathWebSocket = "/v1/ws"
+
+// IsWebSocketURL reports whether a server address is a ws:// or wss:// URL.
+func IsWebSocketURL(addr string) bool {
+	return strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://")
+}
+
+// WebSocketConn carries protocol messages over a WebSocket, one message per
+// text frame, and presents them as the newline-delimited stream that
+// sessions and clients read and write.
+type WebSocketConn struct {
+	ws *websocket.Conn
+
+	r io.Reader // rest of the current message
+
+	writeMu sync.Mutex
+	wbuf    []byte // partial line not yet sent
+}
+
+// NewWebSocketConn wraps an established WebSocket.
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{ws: ws}
+}
+
+// Read returns the next message followed by a newline. The peer closing
+// the WebSocket, or dropping the connection under it, reads as io.EOF.
+func (c *WebSocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.r != nil {
+			n, err := c.r.Read(p)
+			if err == io.EOF {
+				c.r = nil
+				err = nil
+			}
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway,
+				websocket.CloseNoStatusReceived, websocket.CloseAbnormalClosure) {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		msg = bytes.TrimRight(msg, "\r\n")
+		if len(msg) == 0 {
+			continue
+		}
+		c.r = io.MultiReader(bytes.NewReader(msg), strings.NewReader("\n"))
+	}
+}
+
+// Write sends each complete line in p as one message, holding back a
+// trailing partial line until the rest of it is written.
+func (c *WebSocketConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		i := bytes.IndexByte(c.wbuf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := c.wbuf[:i]
+		if len(line) > 0 {
+			if err := c.ws.WriteMessage(websocket.TextMessage, line); err != nil {
+				return 0, err
+			}
+		}
+		c.wbuf = c.wbuf[i+1:]
+	}
+}
+
+// Close sends a close frame and closes the connection.
+func (c *WebSocketConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+// NetConn returns the connection the WebSocket runs over.
+func (c *WebSocketConn) NetConn() net.Conn { return c.ws.NetConn() }
+
+func (c *WebSocketConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *WebSocketConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// handleListTools answers a list_tools request.
+func (s *Server) handleListTools(sess *session, req *protocol.ListToolsRequest) interface{} {
+	peer, code := s.authenticate(sess.auth, req.Token, req, sess.peer)
+	if code != "" {
+		return authError(req.ID, code)
+	}
+
+	names := make([]string, 0, len(s.cfg.Tools))
+	for name := range s.cfg.Tools {
+		if s.mayRun(sess.auth, peer, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	tools := make([]protocol.ToolInfo, 0, len(names))
+	for _, name := range names {
+		tools = append(tools, s.toolInfo(name, s.cfg.Tools[name]))
+	}
+	return &protocol.ToolsResponse{Type: protocol.TypeTools, ID: req.ID, Tools: tools}
+}
+
+// handleDescribeTool answers a describe_tool request.
+func (s *Server) handleDescribeTool(sess *session, req *protocol.DescribeToolRequest) interface{} {
+	peer, code := s.authenticate(sess.auth, req.Token, req, sess.peer)
+	if code != "" {
+		return authError(req.ID, code)
+	}
+
+	tool, ok := s.cfg.Tools[req.Tool]
+	if !ok {
+		return errorResponse(req.ID, protocol.ErrorUnknownTool, fmt.Sprintf("unknown tool: %s", req.Tool))
+	}
+	if !s.mayRun(sess.auth, peer, req.Tool) {
+		return errorResponse(req.ID, protocol.ErrorToolDenied, fmt.Sprintf("not allowed to run %s", req.Tool))
+	}
+	return &protocol.ToolResponse{Type: protocol.TypeTool, ID: req.ID, Tool: s.toolInfo(req.Tool, tool)}
+}
+
+// toolInfo describes a tool, revealing only what the discovery settings
+// allow.
+func (s *Server) toolInfo(name string, tool config.Tool) protocol.ToolInfo {
+	info := protocol.ToolInfo{
+		Name:        name,
+		Description: tool.Description,
+		PassArgs:    tool.PassArgs,
+		ArgsPattern: tool.ArgsPattern,
+		Stdin:       !tool.NoStdin,
+	}
+	if tool.Args != nil {
+		info.Usage = tool.Args.Usage()
+	}
+	if s.cfg.Discovery.ShowPaths {
+		info.Path = tool.Path
+	}
+	if s.cfg.Discovery.ShowCredentials {
+		for _, cred := range tool.Credentials {
+			if cred.Env != "" {
+				info.Credentials = append(info.Credentials, cred.Env+"="+cred.Secret)
+			}
+		}
+	}
+	return info
+}
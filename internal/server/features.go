@@ -0,0 +1,31 @@
+package server
+
+import "github.com/openclaw/credwrap/internal/protocol"
+
+// Version is the server software version reported by hello and ping.
+var Version = "dev"
+
+// supportedFeatures are the protocol features this server can negotiate.
+var supportedFeatures = map[string]bool{
+	protocol.FeatureBinary:      true,
+	protocol.FeatureMultiplex:   true,
+	protocol.FeatureSignals:     true,
+	protocol.FeaturePTY:         true,
+	protocol.FeatureCompression: true,
+	protocol.FeatureDiscovery:   true,
+	protocol.FeatureSSHAuth:     true,
+}
+
+// messageFeature returns the feature that introduced a message type, or ""
+// for message types every protocol version has.
+func messageFeature(msgType string) string {
+	switch msgType {
+	case protocol.TypeSignal, protocol.TypeCancel:
+		return protocol.FeatureSignals
+	case protocol.TypeResize:
+		return protocol.FeaturePTY
+	case protocol.TypeListTools, protocol.TypeDescribeTool:
+		return protocol.FeatureDiscovery
+	}
+	return ""
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// HTTP gateway limits.
+const (
+	maxRequestBody      = 32 << 20 // exec request, stdin included
+	maxBufferedOutput   = 16 << 20 // stdout plus stderr of a buffered exec
+	maxWebSocketMessage = 4 << 20  // one protocol message over a WebSocket
+)
+
+// connContextKey carries the accepted net.Conn into request contexts so
+// the gateway can identify the peer the same way sessions do.
+type connContextKey struct{}
+
+// gateway serves the HTTP/JSON API. It runs requests through the same code
+// as protocol sessions, so authentication, auditing and frame types are
+// shared with the socket protocol.
+type gateway struct {
+	srv      *Server
+	auth     *config.AuthConfig
+	origins  []string
+	upgrader websocket.Upgrader
+}
+
+// newGateway returns the gateway's handler. Pages from origins may open
+// WebSockets and post execs in addition to same-origin ones; "*" admits
+// any origin.
+func newGateway(s *Server, auth *config.AuthConfig, origins []string) http.Handler {
+	g := &gateway{srv: s, auth: auth, origins: origins}
+	g.upgrader.CheckOrigin = g.checkOrigin
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+protocol.HTTPPathExec, g.exec)
+	mux.HandleFunc("GET "+protocol.HTTPPathTools, g.listTools)
+	mux.HandleFunc("GET "+protocol.HTTPPathTools+"/{name}", g.describeTool)
+	mux.HandleFunc("GET "+protocol.HTTPPathPing, g.ping)
+	mux.HandleFunc("GET "+protocol.HTTPPathWebSocket, g.websocket)
+	return mux
+}
+
+// serveGateway serves the HTTP gateway configured by lc on listener until
+// it is closed.
+func (s *Server) serveGateway(listener net.Listener, lc config.ListenerConfig) error {
+	auth := lc.Auth
+	if auth == nil {
+		auth = &s.cfg.Auth
+	}
+	if !s.track(listener) {
+		return nil
+	}
+
+	hs := &http.Server{
+		Handler:           newGateway(s, auth, lc.AllowedOrigins),
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+	err := hs.Serve(listener)
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// session returns a session for one HTTP request. It has no connection of
+// its own; exec attaches a frame writer for the response.
+func (g *gateway) session(r *http.Request) *session {
+	p := &peer{addr: r.RemoteAddr}
+	if conn, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+		p = newPeer(conn)
+	}
+	return &session{
+		srv:      g.srv,
+		auth:     g.auth,
+		peer:     p,
+		protocol: protocol.ProtocolVersion,
+		features: supportedFeatures,
+	}
+}
+
+func (g *gateway) exec(w http.ResponseWriter, r *http.Request) {
+	// A page can post a form or text/plain body anywhere without a CORS
+	// preflight; a JSON content type and the origin check keep other
+	// sites, and DNS-rebound ones, from running tools on a listener that
+	// trusts the network.
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeJSON(w, errorResponse("", protocol.ErrorInvalidRequest, "exec request must be application/json"))
+		return
+	}
+	if !g.checkOrigin(r) {
+		writeJSON(w, errorResponse("", protocol.ErrorInvalidRequest, "origin not allowed: "+r.Header.Get("Origin")))
+		return
+	}
+
+	var body protocol.HTTPExecRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBody)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSON(w, errorResponse("", protocol.ErrorInvalidRequest, "invalid exec request"))
+		return
+	}
+	stdin, err := protocol.DecodeData(body.Stdin, body.StdinEncoding)
+	if err != nil {
+		writeJSON(w, errorResponse("", protocol.ErrorInvalidRequest, "invalid stdin: "+err.Error()))
+		return
+	}
+	if !protocol.ValidEncoding(body.Encoding) {
+		writeJSON(w, errorResponse("", protocol.ErrorInvalidRequest, "unsupported encoding: "+body.Encoding))
+		return
+	}
+
+	req := &protocol.ExecRequest{
+		Type:     protocol.TypeExec,
+		Token:    bearerToken(r),
+		Tool:     body.Tool,
+		Args:     body.Args,
+		Env:      body.Env,
+		Encoding: body.Encoding,
+
+		RequestSignature: body.RequestSignature,
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, protocol.ContentTypeNDJSON):
+		w.Header().Set("Content-Type", protocol.ContentTypeNDJSON)
+		g.run(r, req, stdin, newFlushWriter(w))
+
+	case strings.Contains(accept, protocol.ContentTypeSSE):
+		w.Header().Set("Content-Type", protocol.ContentTypeSSE)
+		w.Header().Set("Cache-Control", "no-cache")
+		g.run(r, req, stdin, &sseWriter{w: newFlushWriter(w)})
+
+	default:
+		// Collect raw bytes and encode them once at the end
+		req.Encoding = protocol.EncodingBase64
+		result := &resultCollector{}
+		g.run(r, req, stdin, result)
+		if result.err != nil {
+			writeJSON(w, result.err)
+			return
+		}
+		result.exit.Encoding = body.Encoding
+		result.exit.Stdout, _ = protocol.EncodeData(result.stdout.Bytes(), body.Encoding)
+		result.exit.Stderr, _ = protocol.EncodeData(result.stderr.Bytes(), body.Encoding)
+		writeJSON(w, &result.exit)
+	}
+}
+
+// run executes req on behalf of an HTTP request, writing its frames to w.
+// A client that goes away cancels the tool.
+func (g *gateway) run(r *http.Request, req *protocol.ExecRequest, stdin []byte, w io.Writer) {
+	sess := g.session(r)
+	sess.out = newFrameWriter(w, frameQueueDepth)
+	ex := newExecution()
+
+	go func() {
+		ex.write(stdin)
+		ex.closeStdin()
+	}()
+	go func() {
+		select {
+		case <-r.Context().Done():
+			ex.cancel()
+		case <-ex.done:
+		}
+	}()
+
+	final := g.srv.handleExec(sess, req, ex)
+	ex.finish()
+	sess.out.Send(final)
+	sess.out.Close()
+}
+
+// websocket upgrades the request and runs a protocol session over it, so
+// interactive execs work where only HTTP gets through.
+func (g *gateway) websocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has replied with an HTTP error
+	}
+	ws.SetReadLimit(maxWebSocketMessage)
+	newSession(g.srv, protocol.NewWebSocketConn(ws), g.auth).serve()
+}
+
+// checkOrigin reports whether a request from a browser page may use the
+// gateway: one without an Origin header, from the gateway's own origin, or
+// from one of the allowed origins.
+func (g *gateway) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	for _, o := range g.origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return origin == "" || sameOrigin(r)
+}
+
+// sameOrigin reports whether the Origin header names the host the request
+// was sent to, the check Upgrader applies by default.
+func sameOrigin(r *http.Request) bool {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func (g *gateway) listTools(w http.ResponseWriter, r *http.Request) {
+	req := &protocol.ListToolsRequest{Type: protocol.TypeListTools, Token: bearerToken(r)}
+	writeJSON(w, g.srv.handleListTools(g.session(r), req))
+}
+
+func (g *gateway) describeTool(w http.ResponseWriter, r *http.Request) {
+	req := &protocol.DescribeToolRequest{Type: protocol.TypeDescribeTool, Token: bearerToken(r), Tool: r.PathValue("name")}
+	writeJSON(w, g.srv.handleDescribeTool(g.session(r), req))
+}
+
+func (g *gateway) ping(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, g.srv.pong(g.auth, "", bearerToken(r), g.session(r).peer))
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// writeJSON writes a response body, choosing the status from the error
+// code for error responses.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	status := http.StatusOK
+	if e, ok := v.(*protocol.ErrorResponse); ok {
+		status = httpStatus(e.ErrorCode)
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="credwrap"`)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// httpStatus maps an error code to an HTTP status.
+func httpStatus(code string) int {
+	switch code {
+	case protocol.ErrorAuthFailed, protocol.ErrorTokenExpired, protocol.ErrorTokenExhausted:
+		return http.StatusUnauthorized
+	case protocol.ErrorToolDenied:
+		return http.StatusForbidden
+	case protocol.ErrorUnknownTool:
+		return http.StatusNotFound
+	case protocol.ErrorInvalidArgs, protocol.ErrorInvalidRequest, protocol.ErrorUnsupported:
+		return http.StatusBadRequest
+	case protocol.ErrorBusy, protocol.ErrorThrottled:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// flushWriter flushes the response after every frame so streamed output
+// reaches the client as it is produced.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	f, _ := w.(http.Flusher)
+	return &flushWriter{w: w, f: f}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if fw.f != nil {
+		fw.f.Flush()
+	}
+	return n, err
+}
+
+// sseWriter turns each JSON frame into a Server-Sent Event named after the
+// frame type.
+type sseWriter struct {
+	w io.Writer
+}
+
+func (s *sseWriter) Write(p []byte) (int, error) {
+	var frame struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(p, &frame)
+
+	var buf bytes.Buffer
+	buf.WriteString("event: " + frame.Type + "\n")
+	buf.WriteString("data: ")
+	buf.Write(bytes.TrimRight(p, "\n"))
+	buf.WriteString("\n\n")
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// resultCollector accumulates the frames of a buffered exec.
+type resultCollector struct {
+	stdout, stderr bytes.Buffer
+	exit           protocol.HTTPExecResult
+	err            *protocol.ErrorResponse
+}
+
+func (c *resultCollector) Write(p []byte) (int, error) {
+	var frame struct {
+		protocol.ErrorResponse
+		Data     string `json:"data"`
+		Encoding string `json:"encoding"`
+		Code     int    `json:"code"`
+		Signal   string `json:"signal"`
+		Canceled bool   `json:"canceled"`
+	}
+	if err := json.Unmarshal(p, &frame); err != nil {
+		return 0, err
+	}
+
+	switch frame.Type {
+	case protocol.TypeStdout, protocol.TypeStderr:
+		data, err := protocol.DecodeData(frame.Data, frame.Encoding)
+		if err != nil {
+			return 0, err
+		}
+		buf := &c.stdout
+		if frame.Type == protocol.TypeStderr {
+			buf = &c.stderr
+		}
+		if room := maxBufferedOutput - c.stdout.Len() - c.stderr.Len(); len(data) > room {
+			data = data[:room]
+			c.exit.Truncated = true
+		}
+		buf.Write(data)
+
+	case protocol.TypeExit:
+		c.exit.Type = protocol.TypeExit
+		c.exit.Code = frame.Code
+		c.exit.Signal = frame.Signal
+		c.exit.Canceled = frame.Canceled
+
+	case protocol.TypeError:
+		e := frame.ErrorResponse
+		c.err = &e
+	}
+	return len(p), nil
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// listen opens the listener described by cfg: TCP, or a unix socket for
+// "unix:" addresses, wrapped in TLS if configured. A socket that systemd
+// passed in for the same address is used instead of binding a new one.
+func listen(cfg config.ListenerConfig, inherited *activated) (net.Listener, error) {
+	network, address := protocol.SplitAddress(cfg.Address)
+
+	listener := inherited.take(network, address)
+	var err error
+	switch {
+	case listener != nil:
+	case network == "unix":
+		listener, err = listenUnix(address, cfg)
+	default:
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", cfg.Address, err)
+	}
+
+	if cfg.TLS.Enabled() {
+		tlsCfg, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+	return listener, nil
+}
+
+// listenUnix creates a unix socket at path with the configured mode and
+// owner. A stale socket from an earlier run is replaced, but any other kind
+// of file is left alone.
+func listenUnix(path string, cfg config.ListenerConfig) (net.Listener, error) {
+	mode, err := cfg.SocketFileMode()
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+
+	// The socket starts out reachable by the server's own user only, and
+	// gets its owner before its mode, so no one else can connect to it
+	// before both are set.
+	var listener net.Listener
+	err = withUmask(0o177, func() (err error) {
+		listener, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SocketOwner != "" {
+		uid, gid, err := lookupOwner(cfg.SocketOwner)
+		if err == nil {
+			err = os.Chown(path, uid, gid)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("setting socket owner: %w", err)
+		}
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting socket mode: %w", err)
+	}
+	return listener, nil
+}
+
+// activated holds the sockets passed in by systemd socket activation until
+// configured listeners claim them.
+type activated []net.Listener
+
+// take removes and returns the socket bound to address, or nil.
+func (a *activated) take(network, address string) net.Listener {
+	if a == nil {
+		return nil
+	}
+	for i, l := range *a {
+		if l.Addr().Network() == network && sameAddress(network, l.Addr().String(), address) {
+			*a = append((*a)[:i], (*a)[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// sameAddress reports whether a bound socket address satisfies a configured
+// one. A configured wildcard host such as "" or "0.0.0.0" matches any
+// wildcard binding on the same port.
+func sameAddress(network, bound, configured string) bool {
+	if network == "unix" || bound == configured {
+		return bound == configured
+	}
+	bh, bp, err1 := net.SplitHostPort(bound)
+	ch, cp, err2 := net.SplitHostPort(configured)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	if port, err := net.LookupPort("tcp", cp); err != nil || strconv.Itoa(port) != bp {
+		return false
+	}
+	bip, cip := net.ParseIP(bh), net.ParseIP(ch)
+	if ch == "" || cip != nil && cip.IsUnspecified() {
+		return bip != nil && bip.IsUnspecified()
+	}
+	return bip != nil && bip.Equal(cip)
+}
+
+// lookupOwner resolves "user" or "user:group" to numeric IDs. A missing
+// group leaves the group unchanged.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, gid = -1, -1
+	if userName != "" {
+		if uid, err = lookupUID(userName); err != nil {
+			return 0, 0, err
+		}
+	}
+	if groupName != "" {
+		if gid, err = lookupGID(groupName); err != nil {
+			return 0, 0, err
+		}
+	}
+	return uid, gid, nil
+}
+
+// lookupUID resolves a user name or numeric uid.
+func lookupUID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID resolves a group name or numeric gid.
+func lookupGID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/config"
+)
+
+// lockout throttles clients that keep failing to authenticate (see
+// config.LockoutConfig). Failures are counted by ban key: the client's IP
+// address, and "principal:NAME" when the failed request used a principal's
+// credentials. Connections without an IP address, such as unix sockets,
+// are only counted by principal.
+type lockout struct {
+	cfg   *config.LockoutConfig
+	state *serverState
+
+	mu    sync.Mutex
+	fails map[string]*failures // by ban key
+	prune time.Time            // next sweep for forgettable failures
+}
+
+// failures is the run of failed attempts for one ban key.
+type failures struct {
+	count int
+	last  time.Time // of the latest failure
+	retry time.Time // attempts are refused until then
+}
+
+// addrKey returns the ban key for a client address, or "" if it has no IP.
+func addrKey(addr string) string {
+	ip := net.ParseIP(extractIP(addr))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// principalKey returns the ban key for a principal, or "" for none.
+func principalKey(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "principal:" + name
+}
+
+// exempt reports whether key is on the never_ban list.
+func (l *lockout) exempt(key string) bool {
+	for _, entry := range l.cfg.NeverBan {
+		if strings.HasPrefix(entry, "principal:") {
+			if key == entry {
+				return true
+			}
+		} else if !strings.HasPrefix(key, "principal:") && matchIP(key, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocked reports whether attempts for any of keys are refused, because
+// it is banned or the backoff after its last failure has not passed.
+func (l *lockout) blocked(keys ...string) bool {
+	if !l.cfg.Enabled() {
+		return false
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if key == "" || l.exempt(key) {
+			continue
+		}
+		if _, ok := l.state.banned(key, now); ok {
+			return true
+		}
+		l.mu.Lock()
+		f := l.fails[key]
+		wait := f != nil && now.Before(f.retry)
+		l.mu.Unlock()
+		if wait {
+			return true
+		}
+	}
+	return false
+}
+
+// fail counts a failed attempt for each of keys, banning those that have
+// failed max_failures times in a row.
+func (l *lockout) fail(keys ...string) {
+	if !l.cfg.Enabled() {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fails == nil {
+		l.fails = make(map[string]*failures)
+	}
+	if now.After(l.prune) {
+		for key, f := range l.fails {
+			if now.Sub(f.last) > l.cfg.Ban() {
+				delete(l.fails, key)
+			}
+		}
+		l.prune = now.Add(time.Minute)
+	}
+	for _, key := range keys {
+		if key == "" || l.exempt(key) {
+			continue
+		}
+		f := l.fails[key]
+		if f == nil || now.Sub(f.last) > l.cfg.Ban() {
+			f = &failures{}
+			l.fails[key] = f
+		}
+		f.count++
+		f.last = now
+		f.retry = now.Add(l.cfg.Wait(f.count))
+		if f.count >= l.cfg.MaxFailures {
+			delete(l.fails, key)
+			l.state.ban(key, Ban{Since: now, Until: now.Add(l.cfg.Ban()), Failures: f.count})
+			log.Printf("Banned %s for %s after %d failed authentications", key, l.cfg.Ban(), f.count)
+		}
+	}
+}
+
+// succeed forgets the failures of keys.
+func (l *lockout) succeed(keys ...string) {
+	if !l.cfg.Enabled() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.fails, key)
+	}
+}
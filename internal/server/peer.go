@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"os/user"
+	"strconv"
+
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// peer identifies the client on the other end of a connection, as far as
+// the transport can vouch for it.
+type peer struct {
+	addr          string    // remote address
+	certNames     []string  // names from a verified client certificate
+	cred          *peerCred // kernel-reported process, on unix sockets
+	principal     string    // authenticated identity, recorded in the audit log
+	sshKey        string    // fingerprint of an SSH key the client proved it holds
+	tailscaleNode string    // MagicDNS name of the tailnet node the client is on
+
+	grant   *config.Principal // principal a request's token or SSH key authenticated as
+	tokenID string            // ID of a hashed token the request presented
+}
+
+// peerCred is the identity of the process on the other end of a unix
+// socket. gid is -1 where the platform does not report it.
+type peerCred struct {
+	uid, gid, pid int
+}
+
+// newPeer collects what conn reveals about the client. For TLS connections
+// the handshake must already be complete.
+func newPeer(conn net.Conn) *peer {
+	// A WebSocket client is whoever holds the connection underneath.
+	if wc, ok := conn.(*protocol.WebSocketConn); ok {
+		conn = wc.NetConn()
+	}
+	p := &peer{addr: conn.RemoteAddr().String()}
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			p.certNames = certNames(state.VerifiedChains[0][0])
+			if len(p.certNames) > 0 {
+				p.principal = p.certNames[0]
+			}
+		}
+		conn = tc.NetConn()
+	}
+
+	if uc, ok := conn.(*net.UnixConn); ok {
+		// Unix clients are usually unnamed; name the socket instead.
+		p.addr = "unix:" + uc.LocalAddr().String()
+		cred, err := peerCredentials(uc)
+		if err != nil {
+			log.Printf("[%s] reading peer credentials: %v", p.addr, err)
+		} else {
+			p.cred = cred
+			if p.principal == "" {
+				p.principal = userName(cred.uid)
+			}
+		}
+	}
+	return p
+}
+
+// userName returns the login name for uid, or the number itself.
+func userName(uid int) string {
+	id := strconv.Itoa(uid)
+	if u, err := user.LookupId(id); err == nil {
+		return u.Username
+	}
+	return id
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials asks the kernel who is on the other end of a unix socket.
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var xucred *unix.Xucred
+	var pid int
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		xucred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+		if credErr == nil {
+			pid, credErr = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	cred := &peerCred{uid: int(xucred.Uid), gid: -1, pid: pid}
+	if xucred.Ngroups > 0 {
+		cred.gid = int(xucred.Groups[0])
+	}
+	return cred, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials is not available on this platform, so peer rules never
+// match.
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	return nil, errors.New("peer credentials are not supported on this platform")
+}
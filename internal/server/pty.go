@@ -0,0 +1,41 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/creack/pty"
+)
+
+// startPTY starts cmd on a new pseudo-terminal and returns the terminal's
+// master side. The tool becomes a session leader with the terminal as its
+// controlling tty, so its process group is its own PID, as with pipes.
+func startPTY(cmd *exec.Cmd, rows, cols uint16) (*os.File, error) {
+	var size *pty.Winsize
+	if rows > 0 && cols > 0 {
+		size = &pty.Winsize{Rows: rows, Cols: cols}
+	}
+	return pty.StartWithAttrs(cmd, size, &syscall.SysProcAttr{Setsid: true, Setctty: true})
+}
+
+// resizePTY sets the window size of a terminal started with startPTY.
+func resizePTY(tty *os.File, rows, cols uint16) error {
+	return pty.Setsize(tty, &pty.Winsize{Rows: rows, Cols: cols})
+}
+
+// ptyInput is the stdin side of a PTY exec. Closing it sends the terminal's
+// end-of-file character rather than closing the terminal, which also carries
+// the tool's output.
+type ptyInput struct {
+	tty *os.File
+}
+
+func (p ptyInput) Write(b []byte) (int, error) {
+	return p.tty.Write(b)
+}
+
+func (p ptyInput) Close() error {
+	_, err := p.tty.Write([]byte{4}) // ^D
+	return err
+}
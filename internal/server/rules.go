@@ -0,0 +1,122 @@
+package server
+
+import (
+	"github.com/openclaw/credwrap/internal/config"
+)
+
+// AuthRequest is what the server knows about a request when it applies
+// auth rules, once its credentials have been checked.
+type AuthRequest struct {
+	IP        string             // Client IP address; empty on unix sockets
+	Token     bool               // A valid token, token signature or SSH key was presented
+	TokenID   string             // ID of the hashed token presented
+	Principal string             // Principal of the token or SSH key
+	CertNames []string           // Names from a verified client certificate
+	Local     bool               // The client is a local process the kernel identified
+	UID, GID  int                // Of the local process
+	Tailscale *TailscaleIdentity // Tailnet node of the client, if it is on one
+}
+
+// RuleResult is how one auth rule treated a request.
+type RuleResult struct {
+	Rule  config.AuthRule
+	Unmet []string // Conditions that did not hold; none if the rule matched
+}
+
+// Decision is the outcome of applying auth rules to a request.
+type Decision struct {
+	Tried   []RuleResult // Rules tried, in order; the last decided if Matched
+	Matched bool         // False if no rule matched, so the request was refused
+	Allowed bool
+}
+
+// Decide applies the auth rules in force (see config.AuthConfig.
+// EffectiveRules) to req, stopping at the first rule that matches.
+func Decide(auth *config.AuthConfig, req *AuthRequest) Decision {
+	var d Decision
+	for _, rule := range auth.EffectiveRules() {
+		unmet := unmetConditions(&rule, req)
+		d.Tried = append(d.Tried, RuleResult{Rule: rule, Unmet: unmet})
+		if len(unmet) == 0 {
+			d.Matched = true
+			d.Allowed = rule.Action == config.RuleAllow
+			break
+		}
+	}
+	return d
+}
+
+// unmetConditions returns the names of rule's conditions req does not meet.
+func unmetConditions(rule *config.AuthRule, req *AuthRequest) []string {
+	var unmet []string
+	check := func(name string, ok bool) {
+		if !ok {
+			unmet = append(unmet, name)
+		}
+	}
+	if rule.Token != nil {
+		check("token", req.Token == *rule.Token)
+	}
+	if len(rule.TokenIDs) > 0 {
+		check("token_ids", req.TokenID != "" && contains(rule.TokenIDs, req.TokenID))
+	}
+	if len(rule.Principals) > 0 {
+		check("principals", req.Principal != "" && contains(rule.Principals, req.Principal))
+	}
+	if len(rule.CIDRs) > 0 {
+		ok := false
+		for _, cidr := range rule.CIDRs {
+			if req.IP != "" && matchIP(req.IP, cidr) {
+				ok = true
+				break
+			}
+		}
+		check("cidrs", ok)
+	}
+	if rule.UsesTailscale() {
+		check("tailscale", req.Tailscale != nil && req.Tailscale.matches(rule.TailscaleNodes, rule.TailscaleUsers, rule.TailscaleTags))
+	}
+	if len(rule.ClientCerts) > 0 {
+		ok := false
+		for _, name := range req.CertNames {
+			if contains(rule.ClientCerts, name) {
+				ok = true
+				break
+			}
+		}
+		check("client_certs", ok)
+	}
+	if rule.Local != nil {
+		check("local", req.Local == *rule.Local)
+	}
+	if len(rule.PeerUsers) > 0 {
+		ok := false
+		for _, name := range rule.PeerUsers {
+			if uid, err := lookupUID(name); req.Local && err == nil && uid == req.UID {
+				ok = true
+				break
+			}
+		}
+		check("peer_users", ok)
+	}
+	if len(rule.PeerGroups) > 0 {
+		ok := false
+		for _, name := range rule.PeerGroups {
+			if gid, err := lookupGID(name); req.Local && err == nil && gid == req.GID {
+				ok = true
+				break
+			}
+		}
+		check("peer_groups", ok)
+	}
+	return unmet
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
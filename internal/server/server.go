@@ -4,34 +4,56 @@ package server
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"net/http"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/openclaw/credwrap/internal/config"
 	"github.com/openclaw/credwrap/internal/protocol"
+	"github.com/openclaw/credwrap/internal/systemd"
 )
 
 // Server is the credwrap server.
+//
+// One server may accept connections on several listeners. They share the
+// tools, credentials and audit log, but each may have its own auth policy.
 type Server struct {
 	cfg       *config.Config
-	listener  net.Listener
 	auditFile *os.File
 	auditMu   sync.Mutex
+	state     *serverState
+	nonces    nonceCache
+	tailscale *tailscaleClient
+	lockout   *lockout
+
+	mu        sync.Mutex
+	listeners []net.Listener
+	stopped   bool
+	quit      chan struct{} // closed by Stop
 }
 
 // New creates a new server with the given configuration.
 func New(cfg *config.Config) *Server {
-	return &Server{cfg: cfg}
+	state := newServerState(cfg.Server.State)
+	return &Server{
+		cfg:       cfg,
+		state:     state,
+		tailscale: newTailscaleClient(cfg.Server.Tailscale),
+		lockout:   &lockout{cfg: &cfg.Server.Lockout, state: state},
+		quit:      make(chan struct{}),
+	}
 }
 
-// Start starts the server.
+// Start opens the audit log and all configured listeners, then serves them
+// until Stop is called.
 func (s *Server) Start() error {
 	// Open audit log if configured
 	if s.cfg.Server.Audit != "" {
@@ -41,123 +63,221 @@ func (s *Server) Start() error {
 		}
 		s.auditFile = f
 	}
+	if err := s.state.load(); err != nil {
+		return err
+	}
+	s.logTokenExpiry()
 
-	listener, err := net.Listen("tcp", s.cfg.Server.Listen)
+	// Open every listener before serving any, so a bad address fails
+	// startup instead of leaving a partial server running.
+	inherited, err := systemd.Listeners()
 	if err != nil {
-		return fmt.Errorf("listening on %s: %w", s.cfg.Server.Listen, err)
+		return err
+	}
+	sockets := activated(inherited)
+	configs := s.cfg.Server.ListenerConfigs()
+	listeners := make([]net.Listener, 0, len(configs))
+	for _, lc := range configs {
+		listener, err := listen(lc, &sockets)
+		if err != nil {
+			closeAll(listeners)
+			closeAll(sockets)
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(sockets) > 0 {
+		closeAll(listeners)
+		closeAll(sockets)
+		return fmt.Errorf("socket activation: %s matches no configured listener", sockets[0].Addr())
 	}
-	s.listener = listener
 
-	log.Printf("credwrap-server listening on %s", s.cfg.Server.Listen)
 	log.Printf("Loaded %d tools, %d credentials", len(s.cfg.Tools), len(s.cfg.Credentials))
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("accept error: %v", err)
-			continue
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		lc := configs[i]
+		kind := "listening"
+		if lc.Transport == config.TransportHTTP {
+			kind = "HTTP gateway listening"
+		}
+		if lc.TLS.Enabled() {
+			log.Printf("credwrap-server %s on %s (TLS)", kind, lc.Address)
+		} else {
+			log.Printf("credwrap-server %s on %s", kind, lc.Address)
+		}
+		if lc.Transport == config.TransportHTTP {
+			go func() { errs <- s.serveGateway(listener, lc) }()
+		} else {
+			go func() { errs <- s.Serve(listener, lc.Auth) }()
 		}
-		go s.handleConnection(conn)
 	}
-}
 
-// Stop stops the server.
-func (s *Server) Stop() error {
-	if s.listener != nil {
-		s.listener.Close()
-	}
-	if s.auditFile != nil {
-		s.auditFile.Close()
+	s.startWatchdog()
+	systemd.Notify(fmt.Sprintf("READY=1\nSTATUS=Serving %d tools with %d credentials", len(s.cfg.Tools), len(s.cfg.Credentials)))
+
+	var firstErr error
+	for range listeners {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			s.Stop()
+		}
 	}
-	return nil
+	return firstErr
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+// Serve accepts connections on listener until it is closed. Connections
+// are authenticated against auth, or the server-wide auth config if nil.
+// Serve returns nil once Stop has been called.
+func (s *Server) Serve(listener net.Listener, auth *config.AuthConfig) error {
+	if auth == nil {
+		auth = &s.cfg.Auth
+	}
 
-	remoteAddr := conn.RemoteAddr().String()
-	reader := bufio.NewReader(conn)
-	encoder := json.NewEncoder(conn)
+	if !s.track(listener) {
+		return nil
+	}
 
 	for {
-		line, err := reader.ReadBytes('\n')
+		conn, err := listener.Accept()
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("[%s] read error: %v", remoteAddr, err)
+			if errors.Is(err, net.ErrClosed) {
+				return nil
 			}
-			return
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				log.Printf("accept error: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return fmt.Errorf("accepting on %s: %w", listener.Addr(), err)
 		}
+		go newSession(s, conn, auth).serve()
+	}
+}
 
-		// Parse the message type first
-		var msg struct {
-			Type string `json:"type"`
-		}
-		if err := json.Unmarshal(line, &msg); err != nil {
-			s.sendError(encoder, "invalid JSON")
-			continue
-		}
+// track registers listener so that Stop closes it. It reports false, having
+// closed the listener, if the server has already been stopped.
+func (s *Server) track(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		listener.Close()
+		return false
+	}
+	s.listeners = append(s.listeners, listener)
+	return true
+}
 
-		switch msg.Type {
-		case protocol.TypePing:
-			encoder.Encode(protocol.PongResponse{
-				Type:    protocol.TypePong,
-				Version: "0.1.0",
-			})
-
-		case protocol.TypeExec:
-			var req protocol.ExecRequest
-			if err := json.Unmarshal(line, &req); err != nil {
-				s.sendError(encoder, "invalid exec request")
-				continue
-			}
-			s.handleExec(conn, remoteAddr, &req, encoder, reader)
+// closeAll closes every listener in listeners.
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
 
-		default:
-			s.sendError(encoder, fmt.Sprintf("unknown message type: %s", msg.Type))
+// startWatchdog pings the systemd watchdog, if enabled, until Stop.
+func (s *Server) startWatchdog() {
+	interval := systemd.WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				systemd.Notify("WATCHDOG=1")
+			case <-s.quit:
+				return
+			}
 		}
+	}()
+}
+
+// Stop stops the server.
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.quit)
+		systemd.Notify("STOPPING=1")
+	}
+	listeners := s.listeners
+	s.listeners = nil
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	if s.auditFile != nil {
+		s.auditFile.Close()
 	}
+	return nil
 }
 
-func (s *Server) handleExec(conn net.Conn, remoteAddr string, req *protocol.ExecRequest, encoder *json.Encoder, reader *bufio.Reader) {
+// handleExec runs one exec request to completion. Output frames are sent as
+// they are produced; the final exit or error frame is returned so the session
+// can go idle before the client sees it.
+func (s *Server) handleExec(sess *session, req *protocol.ExecRequest, ex *execution) interface{} {
 	startTime := time.Now()
+	peer := sess.peer
+	out := sess.out
 
 	// Authenticate
-	if !s.authenticate(req.Token, remoteAddr) {
-		s.sendError(encoder, "authentication failed")
-		s.audit(remoteAddr, req.Tool, req.Args, -1, time.Since(startTime), "auth_failed")
-		return
+	peer, code := s.authenticate(sess.auth, req.Token, req, peer)
+	if code != "" {
+		s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), code)
+		return authError(req.ID, code)
 	}
 
 	// Look up tool
 	tool, ok := s.cfg.Tools[req.Tool]
 	if !ok {
-		s.sendError(encoder, fmt.Sprintf("unknown tool: %s", req.Tool))
-		s.audit(remoteAddr, req.Tool, req.Args, -1, time.Since(startTime), "unknown_tool")
-		return
+		s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), protocol.ErrorUnknownTool)
+		return errorResponse(req.ID, protocol.ErrorUnknownTool, fmt.Sprintf("unknown tool: %s", req.Tool))
+	}
+
+	if !s.mayRun(sess.auth, peer, req.Tool) {
+		s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), protocol.ErrorToolDenied)
+		return errorResponse(req.ID, protocol.ErrorToolDenied, fmt.Sprintf("not allowed to run %s", req.Tool))
 	}
 
 	// Validate args
-	if err := tool.ValidateArgs(req.Args); err != nil {
-		s.sendError(encoder, err.Error())
-		s.audit(remoteAddr, req.Tool, req.Args, -1, time.Since(startTime), "invalid_args")
-		return
+	err := tool.ValidateArgs(req.Args)
+	if err == nil && peer.grant != nil {
+		err = peer.grant.ValidateArgs(req.Tool, req.Args)
+	}
+	if err != nil {
+		s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), protocol.ErrorInvalidArgs)
+		return errorResponse(req.ID, protocol.ErrorInvalidArgs, err.Error())
+	}
+
+	if !protocol.ValidEncoding(req.Encoding) {
+		s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), protocol.ErrorInvalidRequest)
+		return errorResponse(req.ID, protocol.ErrorInvalidRequest, fmt.Sprintf("unsupported encoding: %s", req.Encoding))
+	}
+	if req.PTY && tool.NoStdin {
+		s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), protocol.ErrorInvalidRequest)
+		return errorResponse(req.ID, protocol.ErrorInvalidRequest, fmt.Sprintf("tool %s does not accept stdin", req.Tool))
 	}
 
 	// Build environment with static env vars and credentials
-	env := os.Environ()
-	
+	env := systemd.Environ()
+
 	// Add static env vars from tool config
 	for k, v := range tool.Env {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
-	
+
 	// Add credentials
 	for _, cred := range tool.Credentials {
 		if cred.Env != "" {
 			value, ok := s.cfg.Credentials[cred.Secret]
 			if !ok {
-				s.sendError(encoder, fmt.Sprintf("credential not found: %s", cred.Secret))
-				return
+				s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), protocol.ErrorCredentialMissing)
+				return errorResponse(req.ID, protocol.ErrorCredentialMissing, fmt.Sprintf("credential not found: %s", cred.Secret))
 			}
 			env = append(env, fmt.Sprintf("%s=%s", cred.Env, value))
 		}
@@ -172,153 +292,324 @@ func (s *Server) handleExec(conn net.Conn, remoteAddr string, req *protocol.Exec
 	cmd := exec.Command(tool.Path, req.Args...)
 	cmd.Env = env
 
-	// Set up pipes
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		s.sendError(encoder, fmt.Sprintf("stdout pipe: %v", err))
-		return
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		s.sendError(encoder, fmt.Sprintf("stderr pipe: %v", err))
-		return
-	}
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		s.sendError(encoder, fmt.Sprintf("stdin pipe: %v", err))
-		return
-	}
+	var stdout, stderr io.Reader
+	var stdin io.WriteCloser
+	var tty *os.File
+	if req.PTY {
+		// The tool gets a terminal on all three streams; output arrives
+		// as a single stdout stream.
+		var err error
+		tty, err = startPTY(cmd, req.Rows, req.Cols)
+		if err != nil {
+			s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), protocol.ErrorStartFailed)
+			return errorResponse(req.ID, protocol.ErrorStartFailed, fmt.Sprintf("start: %v", err))
+		}
+		stdout = tty
+		stdin = ptyInput{tty}
+		ex.setTTY(tty)
+	} else {
+		// Own process group so signals reach the tool and its children
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	// Start the command
-	if err := cmd.Start(); err != nil {
-		s.sendError(encoder, fmt.Sprintf("start: %v", err))
-		s.audit(remoteAddr, req.Tool, req.Args, -1, time.Since(startTime), "start_failed")
-		return
+		// Set up pipes
+		var err error
+		stdout, err = cmd.StdoutPipe()
+		if err != nil {
+			return errorResponse(req.ID, protocol.ErrorInternal, fmt.Sprintf("stdout pipe: %v", err))
+		}
+		stderr, err = cmd.StderrPipe()
+		if err != nil {
+			return errorResponse(req.ID, protocol.ErrorInternal, fmt.Sprintf("stderr pipe: %v", err))
+		}
+		if tool.NoStdin {
+			stdin = discardStdin{}
+		} else {
+			stdin, err = cmd.StdinPipe()
+			if err != nil {
+				return errorResponse(req.ID, protocol.ErrorInternal, fmt.Sprintf("stdin pipe: %v", err))
+			}
+		}
+
+		// Start the command
+		if err := cmd.Start(); err != nil {
+			s.audit(peer, req.Tool, req.Args, -1, time.Since(startTime), protocol.ErrorStartFailed)
+			return errorResponse(req.ID, protocol.ErrorStartFailed, fmt.Sprintf("start: %v", err))
+		}
 	}
 
+	ex.started(cmd.Process.Pid)
+
 	// Send started response
-	encoder.Encode(protocol.StartedResponse{
+	out.Send(&protocol.StartedResponse{
 		Type: protocol.TypeStarted,
+		ID:   req.ID,
 		PID:  cmd.Process.Pid,
 	})
 
 	// Stream stdout/stderr in goroutines
 	var wg sync.WaitGroup
-	wg.Add(2)
-
+	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		s.streamOutput(encoder, stdout, protocol.TypeStdout)
+		s.streamOutput(out, req.ID, stdout, protocol.TypeStdout, req.Encoding)
 	}()
 
-	go func() {
-		defer wg.Done()
-		s.streamOutput(encoder, stderr, protocol.TypeStderr)
-	}()
+	if stderr != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.streamOutput(out, req.ID, stderr, protocol.TypeStderr, req.Encoding)
+		}()
+	}
 
-	// Handle stdin from client in a goroutine
-	go func() {
-		defer stdin.Close()
-		for {
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				return
-			}
-			var msg struct {
-				Type string `json:"type"`
-				Data string `json:"data"`
-			}
-			if err := json.Unmarshal(line, &msg); err != nil {
-				continue
-			}
-			switch msg.Type {
-			case protocol.TypeStdin:
-				stdin.Write([]byte(msg.Data))
-			case protocol.TypeStdinClose:
-				return
-			}
-		}
-	}()
+	// Feed stdin frames routed here by the session
+	ex.startPump(stdin)
 
 	// Wait for output to finish
 	wg.Wait()
 
 	// Wait for command to exit
 	exitCode := 0
+	var signaled string
 	if err := cmd.Wait(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitErr.ExitCode()
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				exitCode = 128 + int(ws.Signal())
+				signaled = signalName(ws.Signal())
+			}
 		} else {
 			exitCode = -1
 		}
 	}
+	ex.reaped()
 
-	encoder.Encode(protocol.ExitResponse{
-		Type: protocol.TypeExit,
-		Code: exitCode,
-	})
+	// Tear down the stdin pump before reporting the exit. Closing the
+	// terminal first unblocks a pump stuck writing to it.
+	if tty != nil {
+		tty.Close()
+	}
+	ex.finish()
 
-	s.audit(remoteAddr, req.Tool, req.Args, exitCode, time.Since(startTime), "ok")
-}
+	status := "ok"
+	canceled := ex.wasCanceled()
+	if canceled {
+		status = "canceled"
+	}
+	s.audit(peer, req.Tool, req.Args, exitCode, time.Since(startTime), status)
 
-func (s *Server) streamOutput(encoder *json.Encoder, r io.Reader, outputType string) {
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		encoder.Encode(protocol.OutputResponse{
-			Type: outputType,
-			Data: scanner.Text(),
-		})
+	return &protocol.ExitResponse{
+		Type:     protocol.TypeExit,
+		ID:       req.ID,
+		Code:     exitCode,
+		Signal:   signaled,
+		Canceled: canceled,
 	}
 }
 
-func (s *Server) authenticate(token string, remoteAddr string) bool {
-	tokenValid := false
-	ipValid := false
-	tailscaleValid := false
+// outputChunkSize is the largest payload carried by a single binary output frame.
+const outputChunkSize = 32 * 1024
+
+func (s *Server) streamOutput(out *frameWriter, id string, r io.Reader, outputType, encoding string) {
+	if encoding == protocol.EncodingText {
+		s.streamLines(out, id, r, outputType)
+		return
+	}
 
-	// Check token
-	for _, t := range s.cfg.Auth.Tokens {
-		if token == t {
-			tokenValid = true
-			break
+	buf := make([]byte, outputChunkSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			data, _ := protocol.EncodeData(buf[:n], encoding)
+			if err := out.Send(&protocol.OutputResponse{
+				Type:     outputType,
+				ID:       id,
+				Data:     data,
+				Encoding: encoding,
+			}); err != nil {
+				// Client is gone; keep draining so the tool can exit.
+				io.Copy(io.Discard, r)
+				return
+			}
+		}
+		if err != nil {
+			return
 		}
 	}
+}
 
-	// Check IP whitelist
-	if len(s.cfg.Auth.AllowedIPs) > 0 {
-		clientIP := extractIP(remoteAddr)
-		for _, allowed := range s.cfg.Auth.AllowedIPs {
-			if matchIP(clientIP, allowed) {
-				ipValid = true
-				break
+// streamLines sends output one line per frame for legacy text-mode clients.
+// Lines of any length are forwarded, as is a final line without a newline.
+func (s *Server) streamLines(out *frameWriter, id string, r io.Reader, outputType string) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if err := out.Send(&protocol.OutputResponse{
+				Type: outputType,
+				ID:   id,
+				Data: strings.TrimSuffix(line, "\n"),
+			}); err != nil {
+				io.Copy(io.Discard, reader)
+				return
 			}
 		}
-	} else {
-		// No IP whitelist = all IPs allowed
-		ipValid = true
+		if err != nil {
+			return
+		}
+	}
+}
+
+// authenticate checks a request's credentials against auth. It returns the
+// identity the request acts as: p itself, or a copy of p that carries the
+// principal and ID of the token presented, as it is or by signing req. On
+// failure it also returns the error code: auth_failed, throttled when the
+// client or principal has failed too often recently, or token_expired or
+// token_exhausted when the credentials were good but the token may no
+// longer be used.
+func (s *Server) authenticate(auth *config.AuthConfig, token string, req protocol.Signable, p *peer) (*peer, string) {
+	as, tok, code := s.checkCredentials(auth, token, req, p)
+	if code != "" || tok == nil {
+		return as, code
+	}
+	return as, s.checkToken(tok)
+}
+
+// checkCredentials is authenticate without the token's validity period and
+// use limit: it also returns the token presented, if any, for the caller
+// to check.
+func (s *Server) checkCredentials(auth *config.AuthConfig, token string, req protocol.Signable, p *peer) (*peer, *config.Token, string) {
+	// Clients that keep failing are refused before anything is checked
+	addr := addrKey(p.addr)
+	if s.lockout.blocked(addr) {
+		return p, nil, protocol.ErrorThrottled
+	}
+
+	// Check token, shared or a principal's, or the request's signature
+	match, principal, tokenValid := s.lookupToken(auth, token, req)
+
+	// Only a token or SSH key proves a principal; certificate and login
+	// names merely label the client in the audit log.
+	proved := p.grant
+	if principal != nil {
+		proved = principal
 	}
 
-	// Check Tailscale node identity
-	if len(s.cfg.Auth.TailscaleNodes) > 0 {
-		nodeID := s.getTailscaleNodeID(remoteAddr)
-		for _, allowed := range s.cfg.Auth.TailscaleNodes {
-			if nodeID == allowed {
-				tailscaleValid = true
-				break
+	// A principal whose credentials keep failing is refused too. A wrong
+	// token counts against the principal whose token ID it names, so
+	// guessing at one principal's token locks that principal out.
+	var who string
+	if proved != nil {
+		who = principalKey(proved.Name)
+	} else if claimed := auth.TokenPrincipal(token); claimed != nil {
+		who = principalKey(claimed.Name)
+	}
+	if s.lockout.blocked(who) {
+		return p, nil, protocol.ErrorThrottled
+	}
+
+	// Gather what the rules may ask about. An SSH key the session
+	// authenticated with stands in for a token.
+	ar := &AuthRequest{
+		IP:        addr,
+		Token:     tokenValid || p.sshKey != "",
+		CertNames: p.certNames,
+	}
+	if proved != nil {
+		ar.Principal = proved.Name
+	}
+	if tokenValid {
+		ar.TokenID = match.ID
+	}
+	if p.cred != nil {
+		ar.Local, ar.UID, ar.GID = true, p.cred.uid, p.cred.gid
+	}
+	if auth.UsesTailscale() {
+		if node := s.tailscale.whois(p.addr); node != nil {
+			ar.Tailscale = node.identity()
+		}
+	}
+
+	d := Decide(auth, ar)
+	if !d.Allowed {
+		if d.Matched {
+			last := len(d.Tried) - 1
+			log.Printf("[%s] denied by auth %s", p.addr, d.Tried[last].Rule.Label(last))
+		}
+		s.lockout.fail(addr, who)
+		return p, nil, protocol.ErrorAuthFailed
+	}
+	s.lockout.succeed(addr, principalKey(ar.Principal))
+	if !tokenValid && ar.Tailscale == nil {
+		return p, nil, ""
+	}
+
+	as := *p
+	if ar.Tailscale != nil {
+		as.tailscaleNode = ar.Tailscale.Node
+	}
+	if !tokenValid {
+		return &as, nil, ""
+	}
+	as.tokenID = match.ID
+	if principal != nil {
+		as.principal = principal.Name
+		as.grant = principal
+	}
+	return &as, match, ""
+}
+
+// peerRules returns the peer rules matching the kernel-reported identity
+// of p. Connections without one match none.
+func (s *Server) peerRules(auth *config.AuthConfig, p *peer) []config.PeerRule {
+	if p.cred == nil {
+		return nil
+	}
+	var matched []config.PeerRule
+	for _, rule := range auth.Peers {
+		if rule.User != "" {
+			uid, err := lookupUID(rule.User)
+			if err != nil || uid != p.cred.uid {
+				continue
+			}
+		}
+		if rule.Group != "" {
+			gid, err := lookupGID(rule.Group)
+			if err != nil || gid != p.cred.gid {
+				continue
 			}
 		}
+		matched = append(matched, rule)
 	}
+	return matched
+}
 
-	// Auth logic:
-	// - If require_token is true (default), token must be valid AND (IP or Tailscale must be valid)
-	// - If require_token is false, either token OR IP whitelist OR Tailscale is sufficient
-	if s.cfg.Auth.RequireToken || len(s.cfg.Auth.Tokens) > 0 && len(s.cfg.Auth.AllowedIPs) == 0 && len(s.cfg.Auth.TailscaleNodes) == 0 {
-		// Token required
-		return tokenValid && ipValid
+// mayRun reports whether p may run tool, under both the peer rules of auth
+// and the allow and deny lists of the principal it authenticated as.
+func (s *Server) mayRun(auth *config.AuthConfig, p *peer, tool string) bool {
+	if p.grant != nil && !p.grant.MayRun(tool) {
+		return false
 	}
+	return s.peerMayRun(auth, p, tool)
+}
 
-	// Token not required - any valid auth method works
-	return tokenValid || (ipValid && len(s.cfg.Auth.AllowedIPs) > 0) || tailscaleValid
+// peerMayRun reports whether the peer rules allow p to run tool. Only
+// connections with kernel-reported credentials are subject to them.
+func (s *Server) peerMayRun(auth *config.AuthConfig, p *peer, tool string) bool {
+	if p.cred == nil || len(auth.Peers) == 0 {
+		return true
+	}
+	for _, rule := range s.peerRules(auth, p) {
+		if len(rule.Tools) == 0 {
+			return true
+		}
+		for _, name := range rule.Tools {
+			if name == tool {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // extractIP gets the IP address from a "host:port" string
@@ -351,59 +642,57 @@ func matchIP(clientIP, allowed string) bool {
 	return cidr.Contains(ip)
 }
 
-// getTailscaleNodeID queries Tailscale local API for the node ID of a peer
-func (s *Server) getTailscaleNodeID(remoteAddr string) string {
-	clientIP := extractIP(remoteAddr)
-	
-	// Query Tailscale local API
-	// GET http://100.100.100.100/localapi/v0/whois?addr=<ip>:1
-	url := fmt.Sprintf("http://100.100.100.100/localapi/v0/whois?addr=%s:1", clientIP)
-	
-	resp, err := http.Get(url)
-	if err != nil {
-		return ""
-	}
-	defer resp.Body.Close()
+// discardStdin stands in for the stdin pipe of tools that do not accept
+// input. The tool reads /dev/null and stdin frames are dropped.
+type discardStdin struct{}
 
-	if resp.StatusCode != 200 {
-		return ""
-	}
+func (discardStdin) Write(p []byte) (int, error) { return len(p), nil }
+func (discardStdin) Close() error                { return nil }
 
-	var whois struct {
-		Node struct {
-			ID   string `json:"id"`
-			Name string `json:"name"`
-		} `json:"Node"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&whois); err != nil {
-		return ""
-	}
-
-	return whois.Node.ID
+func (s *Server) sendError(out *frameWriter, id, code, msg string) {
+	out.Send(errorResponse(id, code, msg))
 }
 
-func (s *Server) sendError(encoder *json.Encoder, msg string) {
-	encoder.Encode(protocol.ErrorResponse{
-		Type:    protocol.TypeError,
-		Message: msg,
-	})
+func errorResponse(id, code, msg string) *protocol.ErrorResponse {
+	return &protocol.ErrorResponse{
+		Type:      protocol.TypeError,
+		ID:        id,
+		ErrorCode: code,
+		Message:   msg,
+		Retryable: protocol.Retryable(code),
+	}
 }
 
-func (s *Server) audit(remoteAddr, tool string, args []string, exitCode int, duration time.Duration, status string) {
+func (s *Server) audit(p *peer, tool string, args []string, exitCode int, duration time.Duration, status string) {
 	if s.auditFile == nil {
 		return
 	}
 
 	entry := map[string]interface{}{
 		"ts":          time.Now().UTC().Format(time.RFC3339),
-		"client":      remoteAddr,
+		"client":      p.addr,
 		"tool":        tool,
 		"args":        args,
 		"exit_code":   exitCode,
 		"duration_ms": duration.Milliseconds(),
 		"status":      status,
 	}
+	if p.principal != "" {
+		entry["principal"] = p.principal
+	}
+	if p.tokenID != "" {
+		entry["token_id"] = p.tokenID
+	}
+	if p.sshKey != "" {
+		entry["ssh_key"] = p.sshKey
+	}
+	if p.tailscaleNode != "" {
+		entry["tailscale_node"] = p.tailscaleNode
+	}
+	if p.cred != nil {
+		entry["uid"] = p.cred.uid
+		entry["pid"] = p.cred.pid
+	}
 
 	s.auditMu.Lock()
 	defer s.auditMu.Unlock()
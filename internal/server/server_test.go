@@ -1,7 +1,36 @@
 package server
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/protocol"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
 )
 
 func TestExtractIP(t *testing.T) {
@@ -59,3 +88,1488 @@ func TestMatchIP(t *testing.T) {
 		})
 	}
 }
+
+func TestStreamOutputBinary(t *testing.T) {
+	// Invalid UTF-8 and more than one chunk's worth of data
+	input := bytes.Repeat([]byte{0x00, 0xff, 0xfe, '\n', 0x80}, 20000)
+
+	var buf bytes.Buffer
+	s := &Server{}
+	out := newFrameWriter(&buf, frameQueueDepth)
+	s.streamOutput(out, "", bytes.NewReader(input), protocol.TypeStdout, protocol.EncodingBase64)
+	out.Close()
+
+	var got []byte
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var msg protocol.OutputResponse
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if msg.Encoding != protocol.EncodingBase64 {
+			t.Fatalf("wrong encoding: %q", msg.Encoding)
+		}
+		data, err := protocol.DecodeData(msg.Data, msg.Encoding)
+		if err != nil {
+			t.Fatalf("decode data: %v", err)
+		}
+		got = append(got, data...)
+	}
+
+	if !bytes.Equal(got, input) {
+		t.Errorf("output mismatch: got %d bytes, want %d", len(got), len(input))
+	}
+}
+
+func TestStreamOutputText(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	input := "first\n" + long + "\nno newline"
+
+	var buf bytes.Buffer
+	s := &Server{}
+	out := newFrameWriter(&buf, frameQueueDepth)
+	s.streamOutput(out, "", strings.NewReader(input), protocol.TypeStdout, protocol.EncodingText)
+	out.Close()
+
+	var lines []string
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var msg protocol.OutputResponse
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		lines = append(lines, msg.Data)
+	}
+
+	want := []string{"first", long, "no newline"}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d: got %d bytes, want %d", i, len(lines[i]), len(want[i]))
+		}
+	}
+}
+
+func TestFrameWriterConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	out := newFrameWriter(&buf, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				out.Send(&protocol.OutputResponse{
+					Type: protocol.TypeStdout,
+					Data: strings.Repeat("y", 1000),
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if err := out.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	var last uint64
+	count := 0
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var msg protocol.OutputResponse
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatalf("frame %d: %v", count, err)
+		}
+		if msg.Seq != last+1 {
+			t.Fatalf("frame %d: seq %d after %d", count, msg.Seq, last)
+		}
+		last = msg.Seq
+		count++
+	}
+	if count != 800 {
+		t.Errorf("got %d frames, want 800", count)
+	}
+}
+
+func TestFrameWriterBackpressure(t *testing.T) {
+	pr, pw := io.Pipe()
+	out := newFrameWriter(pw, 2)
+
+	// Nobody reads the pipe: one frame blocks in the writer goroutine and
+	// two more fill the queue, so the fourth Send must block.
+	sent := make(chan int, 10)
+	go func() {
+		for i := 0; i < 4; i++ {
+			out.Send(&protocol.OutputResponse{Type: protocol.TypeStdout, Data: "z"})
+			sent <- i
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatalf("send %d blocked", i)
+		}
+	}
+	select {
+	case <-sent:
+		t.Fatal("send did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A failed connection unblocks senders
+	pr.CloseWithError(io.ErrClosedPipe)
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("send still blocked after connection failure")
+	}
+	if err := out.Send(&protocol.OutputResponse{Type: protocol.TypeStdout}); err == nil {
+		t.Error("expected error after connection failure")
+	}
+	out.Close()
+}
+
+// testConn drives a session over an in-memory connection.
+type testConn struct {
+	t       *testing.T
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+func newTestSession(t *testing.T, cfg *config.Config) *testConn {
+	t.Helper()
+	return newServerSession(t, New(cfg), cfg)
+}
+
+// newServerSession is newTestSession for a server the test set up itself.
+func newServerSession(t *testing.T, srv *Server, cfg *config.Config) *testConn {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go newSession(srv, serverConn, &cfg.Auth).serve()
+	t.Cleanup(func() { clientConn.Close() })
+	return &testConn{t: t, conn: clientConn, decoder: json.NewDecoder(clientConn)}
+}
+
+// hello negotiates features for the session and returns the reply.
+func (c *testConn) hello(features ...string) map[string]interface{} {
+	c.t.Helper()
+	c.send(protocol.HelloRequest{Type: protocol.TypeHello, Protocol: protocol.ProtocolVersion, Features: features})
+	msg := c.recv()
+	if msg["type"] != protocol.TypeHello {
+		c.t.Fatalf("expected hello, got %v", msg)
+	}
+	return msg
+}
+
+func (c *testConn) send(msg interface{}) {
+	c.t.Helper()
+	data, _ := json.Marshal(msg)
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *testConn) recv() map[string]interface{} {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg map[string]interface{}
+	if err := c.decoder.Decode(&msg); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+// runExec sends req and collects stdout until the exit or error frame.
+func (c *testConn) runExec(req protocol.ExecRequest) (stdout string, final map[string]interface{}) {
+	c.t.Helper()
+	c.send(req)
+	for {
+		msg := c.recv()
+		switch msg["type"] {
+		case protocol.TypeStdout:
+			stdout += msg["data"].(string) + "\n"
+		case protocol.TypeExit, protocol.TypeError:
+			return stdout, msg
+		}
+	}
+}
+
+// loadTestConfig loads a config file with the given contents, as the server
+// would at startup.
+func loadTestConfig(t *testing.T, yaml string) *config.Config {
+	t.Helper()
+	path := t.TempDir() + "/config.yaml"
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newAuditedServer returns a server for cfg and the path of its audit log.
+func newAuditedServer(t *testing.T, cfg *config.Config) (*Server, string) {
+	t.Helper()
+	srv := New(cfg)
+	path := t.TempDir() + "/audit.log"
+	var err error
+	if srv.auditFile, err = os.Create(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.auditFile.Close() })
+	return srv, path
+}
+
+func testConfig() *config.Config {
+	return &config.Config{
+		Auth: config.AuthConfig{Tokens: []config.Token{{Plain: "secret"}}},
+		Tools: map[string]config.Tool{
+			"echo":  {Path: "/bin/echo", PassArgs: true},
+			"cat":   {Path: "/bin/cat", PassArgs: true},
+			"sleep": {Path: "/bin/sleep", PassArgs: true},
+			"sh":    {Path: "/bin/sh", PassArgs: true},
+		},
+	}
+}
+
+func TestSessionSequentialExecs(t *testing.T) {
+	c := newTestSession(t, testConfig())
+
+	for i, word := range []string{"one", "two", "three"} {
+		stdout, final := c.runExec(protocol.ExecRequest{
+			Type: protocol.TypeExec, Token: "secret", Tool: "echo", Args: []string{word},
+		})
+		if final["type"] != protocol.TypeExit {
+			t.Fatalf("exec %d: got %v", i, final)
+		}
+		if stdout != word+"\n" {
+			t.Errorf("exec %d: stdout %q", i, stdout)
+		}
+	}
+
+	c.send(protocol.PingRequest{Type: protocol.TypePing})
+	if msg := c.recv(); msg["type"] != protocol.TypePong {
+		t.Errorf("expected pong, got %v", msg)
+	}
+}
+
+func TestSessionHello(t *testing.T) {
+	c := newTestSession(t, testConfig())
+
+	c.send(protocol.HelloRequest{
+		Type:     protocol.TypeHello,
+		Protocol: protocol.ProtocolVersion + 1,
+		Features: []string{protocol.FeatureBinary, "teleport", protocol.FeatureCompression},
+	})
+	msg := c.recv()
+	if msg["type"] != protocol.TypeHello || msg["protocol"] != float64(protocol.ProtocolVersion) {
+		t.Fatalf("unexpected hello reply: %v", msg)
+	}
+	if got := fmt.Sprint(msg["features"]); got != "[binary compression]" {
+		t.Errorf("negotiated features %s", got)
+	}
+
+	// Compressed output round-trips
+	c.send(protocol.ExecRequest{
+		Type: protocol.TypeExec, Token: "secret", Tool: "echo", Args: []string{"squeeze"},
+		Encoding: protocol.EncodingDeflate,
+	})
+	var out []byte
+	for msg = c.recv(); msg["type"] == protocol.TypeStarted || msg["type"] == protocol.TypeStdout; msg = c.recv() {
+		if msg["type"] == protocol.TypeStdout {
+			data, err := protocol.DecodeData(msg["data"].(string), msg["encoding"].(string))
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			out = append(out, data...)
+		}
+	}
+	if msg["type"] != protocol.TypeExit || string(out) != "squeeze\n" {
+		t.Errorf("compressed exec: got %q, final %v", out, msg)
+	}
+
+	// Features that were not negotiated are refused
+	_, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, ID: "x", Token: "secret", Tool: "echo"})
+	if final["type"] != protocol.TypeError || final["id"] != "x" {
+		t.Errorf("exec ID without multiplex: got %v", final)
+	}
+	c.send(protocol.CancelRequest{Type: protocol.TypeCancel})
+	if msg := c.recv(); msg["message"] != "unknown message type: cancel" {
+		t.Errorf("cancel without signals: got %v", msg)
+	}
+
+	// Hello is only accepted first
+	c.send(protocol.HelloRequest{Type: protocol.TypeHello, Protocol: protocol.ProtocolVersion})
+	if msg := c.recv(); msg["type"] != protocol.TypeError {
+		t.Errorf("second hello: got %v", msg)
+	}
+}
+
+func TestSessionErrorCodes(t *testing.T) {
+	loaded := loadTestConfig(t, "tools:\n  fixed:\n    path: /bin/echo\n    args_pattern: \"^[a-z]+$\"\n")
+	cfg := testConfig()
+	cfg.Tools["fixed"] = loaded.Tools["fixed"]
+	cfg.Tools["needy"] = config.Tool{Path: "/bin/echo", Credentials: []config.Credential{{Env: "API_KEY", Secret: "missing"}}}
+	cfg.Tools["ghost"] = config.Tool{Path: "/nonexistent/tool"}
+	c := newTestSession(t, cfg)
+
+	tests := []struct {
+		req  protocol.ExecRequest
+		code string
+	}{
+		{protocol.ExecRequest{Token: "wrong", Tool: "echo"}, protocol.ErrorAuthFailed},
+		{protocol.ExecRequest{Token: "secret", Tool: "nope"}, protocol.ErrorUnknownTool},
+		{protocol.ExecRequest{Token: "secret", Tool: "fixed", Args: []string{"X1"}}, protocol.ErrorInvalidArgs},
+		{protocol.ExecRequest{Token: "secret", Tool: "needy"}, protocol.ErrorCredentialMissing},
+		{protocol.ExecRequest{Token: "secret", Tool: "ghost"}, protocol.ErrorStartFailed},
+		{protocol.ExecRequest{Token: "secret", Tool: "echo", Encoding: "rot13"}, protocol.ErrorInvalidRequest},
+		{protocol.ExecRequest{Token: "secret", Tool: "echo", PTY: true}, protocol.ErrorUnsupported},
+	}
+	for _, tt := range tests {
+		tt.req.Type = protocol.TypeExec
+		_, final := c.runExec(tt.req)
+		if final["type"] != protocol.TypeError || final["error_code"] != tt.code {
+			t.Errorf("%s: expected %s, got %v", tt.req.Tool, tt.code, final)
+		}
+	}
+
+	c.send(protocol.ExecRequest{Type: protocol.TypeExec, Token: "secret", Tool: "sleep", Args: []string{"30"}})
+	c.recv() // started
+	_, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Token: "secret", Tool: "echo"})
+	if final["error_code"] != protocol.ErrorBusy || final["retryable"] != true {
+		t.Errorf("busy exec: got %v", final)
+	}
+}
+
+func TestSessionDiscovery(t *testing.T) {
+	cfg := testConfig()
+	cfg.Tools["cat"] = config.Tool{
+		Path: "/bin/cat", Description: "Concatenate files", NoStdin: true,
+		Credentials: []config.Credential{{Env: "API_KEY", Secret: "cat-key"}},
+	}
+	cfg.Credentials = map[string]string{"cat-key": "k"}
+	c := newTestSession(t, cfg)
+	c.hello(protocol.FeatureDiscovery)
+
+	c.send(protocol.ListToolsRequest{Type: protocol.TypeListTools, Token: "secret"})
+	msg := c.recv()
+	tools, _ := msg["tools"].([]interface{})
+	if len(tools) != 4 {
+		t.Fatalf("list_tools: got %v", msg)
+	}
+	if first := tools[0].(map[string]interface{}); first["name"] != "cat" || first["stdin"] != false || first["path"] != nil || first["credentials"] != nil {
+		t.Errorf("list_tools revealed or misreported cat: %v", first)
+	}
+
+	cfg.Discovery = config.DiscoveryConfig{ShowPaths: true, ShowCredentials: true}
+	c.send(protocol.DescribeToolRequest{Type: protocol.TypeDescribeTool, Token: "secret", Tool: "cat"})
+	info := c.recv()["tool"].(map[string]interface{})
+	if info["description"] != "Concatenate files" || info["path"] != "/bin/cat" || fmt.Sprint(info["credentials"]) != "[API_KEY=cat-key]" {
+		t.Errorf("describe_tool: got %v", info)
+	}
+
+	c.send(protocol.DescribeToolRequest{Type: protocol.TypeDescribeTool, Token: "secret", Tool: "nope"})
+	if msg := c.recv(); msg["error_code"] != protocol.ErrorUnknownTool {
+		t.Errorf("describe unknown tool: got %v", msg)
+	}
+	c.send(protocol.ListToolsRequest{Type: protocol.TypeListTools, Token: "wrong"})
+	if msg := c.recv(); msg["error_code"] != protocol.ErrorAuthFailed {
+		t.Errorf("list_tools with bad token: got %v", msg)
+	}
+
+	// A tool without stdin reads EOF whatever the client sends
+	c.send(protocol.ExecRequest{Type: protocol.TypeExec, Token: "secret", Tool: "cat"})
+	c.send(protocol.StdinData{Type: protocol.TypeStdin, Data: "ignored"})
+	for msg = c.recv(); msg["type"] == protocol.TypeStarted; msg = c.recv() {
+	}
+	if msg["type"] != protocol.TypeExit {
+		t.Errorf("no_stdin exec: got %v", msg)
+	}
+}
+
+// testCA issues certificates for TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSessionClientCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "credwrap.test", x509.ExtKeyUsageServerAuth)
+	cfg := testConfig()
+	cfg.Auth = config.AuthConfig{ClientCerts: []string{"agent-1"}}
+
+	for _, tt := range []struct {
+		name string
+		cert string
+		want string
+	}{
+		{"allowed cert", "agent-1", protocol.TypeExit},
+		{"other cert", "agent-2", protocol.TypeError},
+		{"no cert", "", protocol.TypeError},
+	} {
+		serverConn, clientConn := net.Pipe()
+		serverTLS := tls.Server(serverConn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    ca.pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		})
+		go newSession(New(cfg), serverTLS, &cfg.Auth).serve()
+
+		clientCfg := &tls.Config{RootCAs: ca.pool, ServerName: "credwrap.test"}
+		if tt.cert != "" {
+			clientCfg.Certificates = []tls.Certificate{ca.issue(t, tt.cert, x509.ExtKeyUsageClientAuth)}
+		}
+		clientTLS := tls.Client(clientConn, clientCfg)
+		c := &testConn{t: t, conn: clientTLS, decoder: json.NewDecoder(clientTLS)}
+
+		_, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Tool: "echo", Args: []string{"hi"}})
+		if final["type"] != tt.want {
+			t.Errorf("%s: got %v", tt.name, final)
+		}
+		clientTLS.Close()
+	}
+}
+
+func TestUnixPeerAuth(t *testing.T) {
+	path := t.TempDir() + "/credwrap.sock"
+	listener, err := listen(config.ListenerConfig{Address: "unix:" + path, SocketMode: "0600"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode: %v %v", fi.Mode(), err)
+	}
+
+	me := strconv.Itoa(os.Getuid())
+	cfg := testConfig()
+	cfg.Auth = config.AuthConfig{
+		Tokens: []config.Token{{Plain: "secret"}},
+		Peers:  []config.PeerRule{{User: me, Tools: []string{"echo"}}},
+	}
+	srv := New(cfg)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go newSession(srv, conn, &cfg.Auth).serve()
+		}
+	}()
+
+	dial := func() *testConn {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &testConn{t: t, conn: conn, decoder: json.NewDecoder(conn)}
+	}
+
+	// The kernel vouches for us: no token needed, but only for echo
+	c := dial()
+	if _, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Tool: "echo"}); final["type"] != protocol.TypeExit {
+		t.Errorf("echo as peer: got %v", final)
+	}
+	if _, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Token: "secret", Tool: "cat"}); final["error_code"] != protocol.ErrorToolDenied {
+		t.Errorf("cat as peer: got %v", final)
+	}
+
+	// A token does not help a local user no rule admits
+	cfg.Auth.Peers[0].User = strconv.Itoa(os.Getuid() + 1)
+	c = dial()
+	if _, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Token: "secret", Tool: "echo"}); final["error_code"] != protocol.ErrorAuthFailed {
+		t.Errorf("echo as other user: got %v", final)
+	}
+}
+
+func TestServerListeners(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig()
+	cfg.Server.Listeners = []config.ListenerConfig{
+		{Address: "unix:" + dir + "/open.sock", Auth: &config.AuthConfig{
+			Peers: []config.PeerRule{{User: strconv.Itoa(os.Getuid())}},
+		}},
+		{Address: "unix:" + dir + "/token.sock"},
+	}
+	srv := New(cfg)
+	done := make(chan error, 1)
+	go func() { done <- srv.Start() }()
+
+	dial := func(name string) *testConn {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("unix", dir+"/"+name); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &testConn{t: t, conn: conn, decoder: json.NewDecoder(conn)}
+	}
+
+	// Each listener applies its own policy
+	for _, tt := range []struct {
+		socket string
+		token  string
+		want   string
+	}{
+		{"open.sock", "", protocol.TypeExit},
+		{"token.sock", "", protocol.TypeError},
+		{"token.sock", "secret", protocol.TypeExit},
+	} {
+		c := dial(tt.socket)
+		if _, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Token: tt.token, Tool: "echo"}); final["type"] != tt.want {
+			t.Errorf("%s with token %q: got %v", tt.socket, tt.token, final)
+		}
+	}
+
+	srv.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start returned %v after Stop", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+}
+
+func TestGateway(t *testing.T) {
+	cfg := testConfig()
+	ts := httptest.NewServer(newGateway(New(cfg), &cfg.Auth, nil))
+	defer ts.Close()
+
+	do := func(method, path, token, accept, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	// Buffered exec feeds stdin and returns the whole output
+	resp, body := do("POST", protocol.HTTPPathExec, "secret", "", `{"tool":"cat","stdin":"hello"}`)
+	var result protocol.HTTPExecResult
+	json.Unmarshal([]byte(body), &result)
+	if resp.StatusCode != http.StatusOK || result.Type != protocol.TypeExit || result.Stdout != "hello" || result.Code != 0 {
+		t.Errorf("buffered exec: %d %s", resp.StatusCode, body)
+	}
+
+	// Only JSON from no page, or a page of the gateway's own origin, runs
+	post := func(contentType, origin string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", ts.URL+protocol.HTTPPathExec, strings.NewReader(`{"tool":"echo"}`))
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Content-Type", contentType)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post("text/plain", ""); status != http.StatusBadRequest {
+		t.Errorf("text/plain exec: %d", status)
+	}
+	if status := post("application/json", "https://evil.example"); status != http.StatusBadRequest {
+		t.Errorf("cross-origin exec: %d", status)
+	}
+	if status := post("application/json; charset=utf-8", ts.URL); status != http.StatusOK {
+		t.Errorf("same-origin exec: %d", status)
+	}
+
+	resp, body = do("POST", protocol.HTTPPathExec, "wrong", "", `{"tool":"echo"}`)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" || !strings.Contains(body, protocol.ErrorAuthFailed) {
+		t.Errorf("bad token: %d %s", resp.StatusCode, body)
+	}
+	resp, body = do("POST", protocol.HTTPPathExec, "secret", "", `{"tool":"nope"}`)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown tool: %d %s", resp.StatusCode, body)
+	}
+
+	// Streaming variants carry the protocol frames
+	resp, body = do("POST", protocol.HTTPPathExec, "secret", protocol.ContentTypeNDJSON, `{"tool":"echo","args":["hi"]}`)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	var last map[string]interface{}
+	json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if resp.Header.Get("Content-Type") != protocol.ContentTypeNDJSON || !strings.Contains(body, `"data":"hi`) || last["type"] != protocol.TypeExit {
+		t.Errorf("ndjson exec: %s", body)
+	}
+	_, body = do("POST", protocol.HTTPPathExec, "secret", protocol.ContentTypeSSE, `{"tool":"echo","args":["hi"]}`)
+	if !strings.Contains(body, "event: stdout\ndata: {") || !strings.HasSuffix(body, "}\n\n") || !strings.Contains(body, "event: exit\n") {
+		t.Errorf("sse exec: %q", body)
+	}
+
+	resp, body = do("GET", protocol.HTTPPathTools, "secret", "", "")
+	var tools protocol.ToolsResponse
+	json.Unmarshal([]byte(body), &tools)
+	if resp.StatusCode != http.StatusOK || len(tools.Tools) != 4 {
+		t.Errorf("list tools: %d %s", resp.StatusCode, body)
+	}
+	if resp, body = do("GET", protocol.HTTPPathTools+"/echo", "secret", "", ""); resp.StatusCode != http.StatusOK || !strings.Contains(body, `"name":"echo"`) {
+		t.Errorf("describe tool: %d %s", resp.StatusCode, body)
+	}
+	if resp, body = do("GET", protocol.HTTPPathPing, "", "", ""); resp.StatusCode != http.StatusOK || !strings.Contains(body, protocol.TypePong) {
+		t.Errorf("ping: %d %s", resp.StatusCode, body)
+	}
+}
+
+func TestGatewayWebSocket(t *testing.T) {
+	cfg := testConfig()
+	ts := httptest.NewServer(newGateway(New(cfg), &cfg.Auth, []string{"https://agent.example"}))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + protocol.HTTPPathWebSocket
+
+	dial := func(origin string) (*testConn, error) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		ws, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			return nil, err
+		}
+		conn := protocol.NewWebSocketConn(ws)
+		t.Cleanup(func() { conn.Close() })
+		return &testConn{t: t, conn: conn, decoder: json.NewDecoder(conn)}, nil
+	}
+
+	if _, err := dial("https://evil.example"); err == nil {
+		t.Error("WebSocket from a foreign origin was accepted")
+	}
+	c, err := dial("https://agent.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stdin frames reach an interactive exec
+	c.hello(protocol.FeatureMultiplex)
+	c.send(protocol.ExecRequest{Type: protocol.TypeExec, ID: "1", Token: "secret", Tool: "cat"})
+	if msg := c.recv(); msg["type"] != protocol.TypeStarted {
+		t.Fatalf("expected started, got %v", msg)
+	}
+	c.send(protocol.StdinData{Type: protocol.TypeStdin, ID: "1", Data: "over websocket\n"})
+	c.send(protocol.StdinData{Type: protocol.TypeStdinClose, ID: "1"})
+	msg := c.recv()
+	if msg["type"] != protocol.TypeStdout || msg["data"] != "over websocket" {
+		t.Errorf("expected echoed stdin, got %v", msg)
+	}
+	if msg = c.recv(); msg["type"] != protocol.TypeExit {
+		t.Errorf("expected exit, got %v", msg)
+	}
+}
+
+func TestActivatedSockets(t *testing.T) {
+	tests := []struct {
+		bound, configured string
+		want              bool
+	}{
+		{"127.0.0.1:9876", "127.0.0.1:9876", true},
+		{"127.0.0.1:9876", "127.0.0.1:9877", false},
+		{"[::]:9876", "0.0.0.0:9876", true},
+		{"[::]:9876", ":9876", true},
+		{"[::]:9876", "127.0.0.1:9876", false},
+		{"100.64.1.50:9876", "0.0.0.0:9876", false},
+	}
+	for _, tt := range tests {
+		if got := sameAddress("tcp", tt.bound, tt.configured); got != tt.want {
+			t.Errorf("sameAddress(%q, %q) = %v, want %v", tt.bound, tt.configured, got, tt.want)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sockets := activated{l}
+	if got := sockets.take("unix", l.Addr().String()); got != nil {
+		t.Error("took a TCP socket for a unix address")
+	}
+	if got := sockets.take("tcp", l.Addr().String()); got != l || len(sockets) != 0 {
+		t.Errorf("take: got %v, %d left", got, len(sockets))
+	}
+}
+
+func TestSessionPrincipals(t *testing.T) {
+	cfg := loadTestConfig(t, `
+auth:
+  tokens: [secret]
+  principals:
+    - name: reader
+      tokens: [reader-token]
+      allow: [echo]
+      args:
+        echo: {args_pattern: "^[a-z]+$"}
+    - name: ops
+      tokens: [ops-token]
+      deny: [sh]
+tools:
+  echo: {path: /bin/echo, pass_args: true}
+  cat: {path: /bin/cat, pass_args: true}
+  sh: {path: /bin/sh, pass_args: true}
+`)
+	srv, auditLog := newAuditedServer(t, cfg)
+	c := newServerSession(t, srv, cfg)
+	c.hello(protocol.FeatureDiscovery)
+
+	tests := []struct {
+		token, tool string
+		args        []string
+		want        string
+	}{
+		{"reader-token", "echo", []string{"hi"}, ""},
+		{"reader-token", "cat", nil, protocol.ErrorToolDenied},
+		{"reader-token", "echo", []string{"Hi!"}, protocol.ErrorInvalidArgs},
+		{"ops-token", "cat", []string{"/dev/null"}, ""},
+		{"ops-token", "sh", nil, protocol.ErrorToolDenied},
+		{"secret", "sh", []string{"-c", "true"}, ""},
+	}
+	for _, tt := range tests {
+		_, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Token: tt.token, Tool: tt.tool, Args: tt.args})
+		if tt.want == "" && final["type"] != protocol.TypeExit || tt.want != "" && final["error_code"] != tt.want {
+			t.Errorf("%s running %s %v: got %v", tt.token, tt.tool, tt.args, final)
+		}
+	}
+
+	c.send(protocol.ListToolsRequest{Type: protocol.TypeListTools, Token: "reader-token"})
+	if tools, _ := c.recv()["tools"].([]interface{}); len(tools) != 1 {
+		t.Errorf("reader sees tools %v", tools)
+	}
+
+	// The audit log names the principal behind each token
+	data, _ := os.ReadFile(auditLog)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var principals []string
+	for _, line := range lines {
+		var entry map[string]interface{}
+		json.Unmarshal([]byte(line), &entry)
+		name, _ := entry["principal"].(string)
+		principals = append(principals, name)
+	}
+	if got := strings.Join(principals, ","); got != "reader,reader,reader,ops,ops," {
+		t.Errorf("audit principals %q", got)
+	}
+}
+
+func TestSessionTokenLimits(t *testing.T) {
+	dir := t.TempDir()
+	soon := time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+	cfg := loadTestConfig(t, `
+server:
+  state: `+dir+`/state.json
+auth:
+  tokens:
+    - {token: expired, expires: 2020-01-01}
+    - {token: early, not_before: 2099-01-01}
+    - {id: l1, token: limited, max_uses: 2}
+    - {token: soon, expires: "`+soon+`"}
+tools:
+  echo: {path: /bin/echo, pass_args: true}
+`)
+	srv, auditLog := newAuditedServer(t, cfg)
+	c := newServerSession(t, srv, cfg)
+
+	tests := []struct{ token, want string }{
+		{"expired", protocol.ErrorTokenExpired},
+		{"early", protocol.ErrorTokenExpired},
+		{"limited", ""},
+		{"limited", ""},
+		{"limited", protocol.ErrorTokenExhausted},
+		{"soon", ""},
+	}
+	for _, tt := range tests {
+		_, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Token: tt.token, Tool: "echo"})
+		if tt.want == "" && final["type"] != protocol.TypeExit || tt.want != "" && final["error_code"] != tt.want {
+			t.Errorf("%s: got %v", tt.token, final)
+		}
+	}
+
+	// Pings with a token learn when it expires
+	c.send(protocol.PingRequest{Type: protocol.TypePing, Token: "soon"})
+	if pong := c.recv(); pong["token_expires"] != soon || !strings.Contains(fmt.Sprint(pong["warning"]), "expires in") {
+		t.Errorf("pong %v", pong)
+	}
+	c.send(protocol.PingRequest{Type: protocol.TypePing, Token: "limited"})
+	if pong := c.recv(); pong["warning"] != nil || pong["version"] != Version {
+		t.Errorf("pong %v", pong)
+	}
+
+	data, _ := os.ReadFile(auditLog)
+	if !strings.Contains(string(data), `"status":"token_exhausted","token_id":"l1"`) || !strings.Contains(string(data), `"status":"token_expired"`) {
+		t.Errorf("audit log:\n%s", data)
+	}
+
+	// Use counts survive a restart
+	srv = New(cfg)
+	if err := srv.state.load(); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := srv.authenticate(&cfg.Auth, "limited", nil, &peer{addr: "127.0.0.1:1"}); code != protocol.ErrorTokenExhausted {
+		t.Errorf("after restart: %q", code)
+	}
+
+	// Resetting the count, as rotation does, reaches a running server
+	if err := ResetTokenUses(dir+"/state.json", "l1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := srv.authenticate(&cfg.Auth, "limited", nil, &peer{addr: "127.0.0.1:1"}); code != "" {
+		t.Errorf("after reset: %q", code)
+	}
+}
+
+func TestSessionSignedRequests(t *testing.T) {
+	secret, hashed, err := config.NewToken("signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed.EnableSigning(secret)
+	data, _ := yaml.Marshal(config.AuthConfig{Tokens: []config.Token{{Plain: "plain"}, hashed}, RequireSignature: true})
+	cfg := loadTestConfig(t, "auth:\n"+indent(string(data))+"tools:\n  echo: {path: /bin/echo, pass_args: true}\n")
+	c := newTestSession(t, cfg)
+	c.hello(protocol.FeatureDiscovery)
+
+	signed := func(token string, args ...string) *protocol.ExecRequest {
+		req := &protocol.ExecRequest{Type: protocol.TypeExec, Tool: "echo", Args: args}
+		if err := protocol.Sign(req, token); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	exec := func(req *protocol.ExecRequest) string {
+		stdout, final := c.runExec(*req)
+		if final["type"] != protocol.TypeExit {
+			return fmt.Sprint(final["error_code"])
+		}
+		return stdout
+	}
+
+	if out := exec(signed("plain", "a")); out != "a\n" {
+		t.Errorf("signed with plaintext token: %q", out)
+	}
+	req := signed(secret, "b")
+	if out := exec(req); out != "b\n" {
+		t.Errorf("signed with hashed token: %q", out)
+	}
+	if out := exec(req); out != protocol.ErrorAuthFailed {
+		t.Errorf("replayed request: %q", out)
+	}
+	req = signed(secret, "c")
+	req.Args = []string{"changed"}
+	if out := exec(req); out != protocol.ErrorAuthFailed {
+		t.Errorf("modified request: %q", out)
+	}
+	req = &protocol.ExecRequest{Type: protocol.TypeExec, Tool: "echo"}
+	req.Timestamp, req.Nonce = time.Now().Add(-time.Hour).Unix(), "old"
+	mac := hmac.New(sha256.New, protocol.SigningKey(secret))
+	mac.Write(req.SigningString())
+	req.Signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	if out := exec(req); out != protocol.ErrorAuthFailed {
+		t.Errorf("stale request: %q", out)
+	}
+	if out := exec(&protocol.ExecRequest{Type: protocol.TypeExec, Token: "plain", Tool: "echo"}); out != protocol.ErrorAuthFailed {
+		t.Errorf("unsigned token under require_signature: %q", out)
+	}
+
+	list := &protocol.ListToolsRequest{Type: protocol.TypeListTools}
+	protocol.Sign(list, "plain")
+	c.send(list)
+	if msg := c.recv(); msg["type"] != protocol.TypeTools {
+		t.Errorf("signed list_tools: %v", msg)
+	}
+}
+
+// indent indents YAML by two spaces, to nest it under a key.
+func indent(s string) string {
+	return "  " + strings.ReplaceAll(strings.TrimSuffix(s, "\n"), "\n", "\n  ") + "\n"
+}
+
+func TestSessionSSHAuth(t *testing.T) {
+	newKey := func() ssh.Signer {
+		_, priv, _ := ed25519.GenerateKey(rand.Reader)
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer
+	}
+	agentKey, strangerKey := newKey(), newKey()
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(agentKey.PublicKey())))
+
+	cfg := loadTestConfig(t, `
+auth:
+  tokens: [secret]
+  authorized_keys:
+    - 'principal="reader" `+authorized+` agent@host'
+  principals:
+    - name: reader
+      allow: [echo]
+tools:
+  echo: {path: /bin/echo, pass_args: true}
+  cat: {path: /bin/cat, pass_args: true}
+`)
+	// Over TCP, so that the connection has addresses to bind to
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			newSession(New(cfg), conn, &cfg.Auth).serve()
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &testConn{t: t, conn: conn, decoder: json.NewDecoder(conn)}
+	challenge, _ := c.hello(protocol.FeatureSSHAuth)["challenge"].(string)
+	if challenge == "" {
+		t.Fatal("no challenge in hello reply")
+	}
+	binding := protocol.ChannelBinding(conn, false)
+	if binding != "tcp:"+ln.Addr().String() {
+		t.Errorf("binding %q", binding)
+	}
+
+	auth := func(signer ssh.Signer, challenge, binding string) map[string]interface{} {
+		sig, err := signer.Sign(rand.Reader, protocol.SSHAuthData(challenge, binding))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(protocol.SSHAuthRequest{
+			Type:      protocol.TypeSSHAuth,
+			PublicKey: string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+			Signature: base64.StdEncoding.EncodeToString(ssh.Marshal(sig)),
+		})
+		return c.recv()
+	}
+	if msg := auth(strangerKey, challenge, binding); msg["error_code"] != protocol.ErrorAuthFailed {
+		t.Errorf("unknown key: %v", msg)
+	}
+	if msg := auth(agentKey, "another challenge", binding); msg["error_code"] != protocol.ErrorAuthFailed {
+		t.Errorf("signature of another challenge: %v", msg)
+	}
+	// As signed by a client that a relay passed the challenge on to
+	if msg := auth(agentKey, challenge, "tcp:192.0.2.1:9876"); msg["error_code"] != protocol.ErrorAuthFailed {
+		t.Errorf("signature bound to another connection: %v", msg)
+	}
+	if msg := auth(agentKey, challenge, binding); msg["type"] != protocol.TypeSSHAuth || msg["principal"] != "reader" {
+		t.Fatalf("authorized key: %v", msg)
+	}
+
+	// The key stands in for a token, with its principal's limits
+	if out, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Tool: "echo", Args: []string{"hi"}}); out != "hi\n" {
+		t.Errorf("echo: %q, %v", out, final)
+	}
+	if _, final := c.runExec(protocol.ExecRequest{Type: protocol.TypeExec, Tool: "cat"}); final["error_code"] != protocol.ErrorToolDenied {
+		t.Errorf("cat: %v", final)
+	}
+	if msg := auth(agentKey, challenge, binding); msg["error_code"] != protocol.ErrorInvalidRequest {
+		t.Errorf("ssh_auth after a request: %v", msg)
+	}
+}
+
+func TestTailscaleAuth(t *testing.T) {
+	// A stand-in for tailscaled's LocalAPI
+	nodes := map[string]string{
+		"100.64.0.1": `{"Node": {"ID": 101, "StableID": "nAAA", "Name": "agent-host.tail1234.ts.net.", "Key": "nodekey:aaa"}, "UserProfile": {"LoginName": "alice@example.com"}}`,
+		"100.64.0.2": `{"Node": {"ID": 102, "Name": "ci-1.tail1234.ts.net.", "Tags": ["tag:agents"]}, "UserProfile": {"LoginName": "tagged-devices"}}`,
+		"100.64.0.3": `{"Node": {"ID": 103, "Name": "laptop.tail1234.ts.net."}, "UserProfile": {"LoginName": "bob@example.com"}}`,
+		"100.64.0.4": `{"Node": {"ID": 104, "Name": "build.tail1234.ts.net.", "Tags": ["tag:build"]}, "UserProfile": {"LoginName": "bob@example.com"}}`,
+	}
+	var mu sync.Mutex
+	lookups := 0
+	dir := t.TempDir()
+	ln, err := net.Listen("unix", dir+"/tailscaled.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lookups++
+		mu.Unlock()
+		host, _, _ := net.SplitHostPort(r.URL.Query().Get("addr"))
+		node, ok := nodes[host]
+		if r.Host != "local-tailscaled.sock" || r.URL.Path != "/localapi/v0/whois" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, node)
+	})}
+	go api.Serve(ln)
+	defer api.Close()
+
+	cfg := loadTestConfig(t, `
+server:
+  tailscale: {socket: `+dir+`/tailscaled.sock, cache_ttl: 1h}
+auth:
+  tailscale_nodes: [agent-host]
+  tailscale_users: [Bob@example.com]
+  tailscale_tags: ["tag:agents"]
+tools:
+  echo: {path: /bin/echo, pass_args: true}
+`)
+	srv, auditLog := newAuditedServer(t, cfg)
+
+	for _, tc := range []struct {
+		addr, node string
+		ok         bool
+	}{
+		{"100.64.0.1:40000", "agent-host.tail1234.ts.net", true}, // by node name
+		{"100.64.0.2:40000", "ci-1.tail1234.ts.net", true},       // by tag
+		{"100.64.0.3:40000", "laptop.tail1234.ts.net", true},     // by owner
+		{"100.64.0.4:40000", "", false},                          // tagged, so not bob's
+		{"100.64.0.9:40000", "", false},                          // not on the tailnet
+		{"100.64.0.1:40001", "agent-host.tail1234.ts.net", true}, // cached
+	} {
+		p, code := srv.authenticate(&cfg.Auth, "", nil, &peer{addr: tc.addr})
+		if (code == "") != tc.ok || p.tailscaleNode != tc.node {
+			t.Errorf("%s: code %q, node %q", tc.addr, code, p.tailscaleNode)
+		}
+		if tc.ok {
+			srv.audit(p, "echo", nil, 0, 0, "ok")
+		}
+	}
+	mu.Lock()
+	if lookups != 5 {
+		t.Errorf("%d lookups, want 5", lookups)
+	}
+	mu.Unlock()
+	data, _ := os.ReadFile(auditLog)
+	if !strings.Contains(string(data), `"tailscale_node":"ci-1.tail1234.ts.net"`) {
+		t.Errorf("audit log:\n%s", data)
+	}
+
+	// Stable IDs and node keys work too, and tags must look like tags
+	for _, id := range []string{"nAAA", "nodekey:aaa", "101", "agent-host.tail1234.ts.net."} {
+		auth := &config.AuthConfig{TailscaleNodes: []string{id}}
+		if _, code := srv.authenticate(auth, "", nil, &peer{addr: "100.64.0.1:1"}); code != "" {
+			t.Errorf("node %s: %q", id, code)
+		}
+	}
+	os.WriteFile(dir+"/bad.yaml", []byte("auth:\n  tailscale_tags: [agents]\n"), 0600)
+	if _, err := config.LoadConfig(dir + "/bad.yaml"); err == nil || !strings.Contains(err.Error(), "tag:name") {
+		t.Errorf("untagged tag: %v", err)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	dir := t.TempDir()
+	cfg := loadTestConfig(t, `
+server:
+  state: `+dir+`/state.json
+  lockout: {max_failures: 3, backoff: 20ms, max_backoff: 40ms, never_ban: [192.0.2.9, "principal:trusted"]}
+auth:
+  tokens: [secret, {token: dated, expires: 2099-01-01}]
+  principals:
+    - {name: ops, tokens: [ops-token]}
+    - {name: trusted, tokens: [trusted-token]}
+    - {name: bot, tokens: [{id: b0b0b0b0, token: cw_b0b0b0b0_right}]}
+tools:
+  echo: {path: /bin/echo, pass_args: true}
+`)
+	srv := New(cfg)
+	try := func(auth *config.AuthConfig, addr, token, want string) {
+		t.Helper()
+		if _, code := srv.authenticate(auth, token, nil, &peer{addr: addr}); code != want {
+			t.Errorf("%s with %q: code %q, want %q", addr, token, code, want)
+		}
+	}
+
+	// Each failure doubles the wait before the next attempt counts
+	try(&cfg.Auth, "192.0.2.1:1", "guess", protocol.ErrorAuthFailed)
+	try(&cfg.Auth, "192.0.2.1:2", "secret", protocol.ErrorThrottled)
+	time.Sleep(25 * time.Millisecond)
+	try(&cfg.Auth, "192.0.2.1:1", "guess", protocol.ErrorAuthFailed)
+	time.Sleep(25 * time.Millisecond)
+	try(&cfg.Auth, "192.0.2.1:1", "secret", protocol.ErrorThrottled)
+	time.Sleep(25 * time.Millisecond)
+	try(&cfg.Auth, "192.0.2.1:1", "guess", protocol.ErrorAuthFailed)
+
+	// The third failure in a row bans the address, even once backoff passes
+	time.Sleep(50 * time.Millisecond)
+	try(&cfg.Auth, "192.0.2.1:1", "secret", protocol.ErrorThrottled)
+	try(&cfg.Auth, "192.0.2.2:1", "secret", "")
+	bans, err := Bans(dir + "/state.json")
+	if ban, ok := bans["192.0.2.1"]; err != nil || !ok || ban.Failures != 3 || time.Until(ban.Until) < 59*time.Minute {
+		t.Errorf("bans %v %v", bans, err)
+	}
+
+	// never_ban addresses are not throttled
+	for i := 0; i < 5; i++ {
+		try(&cfg.Auth, "192.0.2.9:1", "guess", protocol.ErrorAuthFailed)
+	}
+	try(&cfg.Auth, "192.0.2.9:1", "secret", "")
+
+	// A principal's credentials failing from elsewhere lock out the principal
+	strict := cfg.Auth
+	strict.RequireToken = true
+	strict.AllowedIPs = []string{"10.0.0.0/8"}
+	for i := 0; i < 3; i++ {
+		try(&strict, "192.0.2.9:1", "ops-token", protocol.ErrorAuthFailed)
+		try(&strict, "192.0.2.9:1", "trusted-token", protocol.ErrorAuthFailed)
+		time.Sleep(50 * time.Millisecond)
+	}
+	try(&strict, "10.0.0.1:1", "ops-token", protocol.ErrorThrottled)
+	try(&strict, "10.0.0.1:1", "trusted-token", "")
+	try(&strict, "10.0.0.1:1", "secret", "")
+
+	// Bans survive a restart, and clearing them reaches a running server
+	srv = New(cfg)
+	if err := srv.state.load(); err != nil {
+		t.Fatal(err)
+	}
+	try(&cfg.Auth, "192.0.2.1:1", "secret", protocol.ErrorThrottled)
+	cleared, err := ClearBans(dir+"/state.json", "192.0.2.1", "192.0.2.200")
+	if err != nil || len(cleared) != 1 || cleared[0] != "192.0.2.1" {
+		t.Errorf("cleared %v %v", cleared, err)
+	}
+	try(&cfg.Auth, "192.0.2.1:1", "secret", "")
+	try(&strict, "10.0.0.1:1", "ops-token", protocol.ErrorThrottled)
+	if cleared, err := ClearBans(dir + "/state.json"); err != nil || len(cleared) != 1 || cleared[0] != "principal:ops" {
+		t.Errorf("cleared %v %v", cleared, err)
+	}
+	try(&strict, "10.0.0.1:1", "ops-token", "")
+
+	// Wrong secrets for a principal's token ID count against the principal
+	for i := 0; i < 3; i++ {
+		try(&cfg.Auth, "192.0.2.9:1", "cw_b0b0b0b0_wrong", protocol.ErrorAuthFailed)
+		time.Sleep(50 * time.Millisecond)
+	}
+	try(&cfg.Auth, "10.0.0.1:1", "cw_b0b0b0b0_right", protocol.ErrorThrottled)
+	try(&cfg.Auth, "10.0.0.1:1", "secret", "")
+
+	// Pings check tokens like requests: guesses count, and a throttled
+	// client learns nothing about a token
+	ping := func(addr, token string) string {
+		return srv.pong(&cfg.Auth, "", token, &peer{addr: addr}).TokenExpires
+	}
+	if ping("192.0.2.3:1", "dated") == "" {
+		t.Error("ping with a valid token did not say when it expires")
+	}
+	for i := 0; i < 3; i++ {
+		ping("192.0.2.4:1", "guess")
+		time.Sleep(50 * time.Millisecond)
+	}
+	if ping("192.0.2.4:1", "dated") != "" {
+		t.Error("banned client learned when a token expires")
+	}
+	try(&cfg.Auth, "192.0.2.4:1", "secret", protocol.ErrorThrottled)
+}
+
+func TestAuthRules(t *testing.T) {
+	cfg := loadTestConfig(t, `
+server:
+  tls: {cert: server.pem, key: server.key, client_ca: ca.pem}
+auth:
+  tokens: [{id: t1, token: shared}]
+  principals:
+    - {name: ops, tokens: [{id: o1, token: ops-token}]}
+  rules:
+    - {name: lan, cidrs: [192.168.0.0/16], action: deny}
+    - {name: ops-local, principals: [ops], local: true, peer_users: ["`+strconv.Itoa(os.Getuid())+`"], action: allow}
+    - {name: ops-remote, principals: [ops], cidrs: [10.0.0.0/8], action: allow}
+    - {name: certs, client_certs: [agent-1], action: allow}
+    - {name: shared, token_ids: [t1], local: false, action: allow}
+tools:
+  echo: {path: /bin/echo, pass_args: true}
+`)
+	srv := New(cfg)
+	me := &peerCred{uid: os.Getuid(), gid: os.Getgid(), pid: 1}
+	for _, tc := range []struct {
+		name  string
+		token string
+		p     *peer
+		want  string
+	}{
+		{"shared token", "shared", &peer{addr: "203.0.113.1:1"}, ""},
+		{"shared token from the lan", "shared", &peer{addr: "192.168.1.5:1"}, protocol.ErrorAuthFailed},
+		{"shared token locally", "shared", &peer{addr: "@", cred: me}, protocol.ErrorAuthFailed},
+		{"ops token locally", "ops-token", &peer{addr: "@", cred: me}, ""},
+		{"ops token from 10/8", "ops-token", &peer{addr: "10.1.2.3:1"}, ""},
+		{"ops token elsewhere", "ops-token", &peer{addr: "203.0.113.1:1"}, protocol.ErrorAuthFailed},
+		{"client certificate", "", &peer{addr: "203.0.113.1:1", certNames: []string{"agent-1"}}, ""},
+		{"certificate named like a principal", "", &peer{addr: "10.1.2.3:1", certNames: []string{"ops"}, principal: "ops"}, protocol.ErrorAuthFailed},
+		{"login named like a principal", "", &peer{addr: "@", cred: me, principal: "ops"}, protocol.ErrorAuthFailed},
+		{"nothing", "", &peer{addr: "203.0.113.1:1"}, protocol.ErrorAuthFailed},
+	} {
+		if _, code := srv.authenticate(&cfg.Auth, tc.token, nil, tc.p); code != tc.want {
+			t.Errorf("%s: code %q, want %q", tc.name, code, tc.want)
+		}
+	}
+
+	d := Decide(&cfg.Auth, &AuthRequest{IP: "10.1.2.3", Token: true, TokenID: "o1", Principal: "ops"})
+	if !d.Allowed || len(d.Tried) != 3 || d.Tried[2].Rule.Name != "ops-remote" || strings.Join(d.Tried[1].Unmet, ",") != "local,peer_users" {
+		t.Errorf("decision %+v", d)
+	}
+	if d := Decide(&cfg.Auth, &AuthRequest{IP: "203.0.113.1"}); d.Matched || d.Allowed || len(d.Tried) != 5 {
+		t.Errorf("unmatched decision %+v", d)
+	}
+
+	// Without rules, require_token ignores Tailscale identity; rules can
+	// ask for both
+	node := &TailscaleIdentity{Node: "agent-host.tail1234.ts.net"}
+	legacy := &config.AuthConfig{RequireToken: true, TailscaleNodes: []string{"agent-host"}}
+	if d := Decide(legacy, &AuthRequest{Token: true}); !d.Allowed {
+		t.Errorf("legacy: %+v", d)
+	}
+	yes := true
+	both := &config.AuthConfig{Rules: []config.AuthRule{{Token: &yes, TailscaleNodes: []string{"agent-host"}, Action: config.RuleAllow}}}
+	if d := Decide(both, &AuthRequest{Token: true}); d.Allowed {
+		t.Errorf("token without node: %+v", d)
+	}
+	if d := Decide(both, &AuthRequest{Token: true, Tailscale: node}); !d.Allowed {
+		t.Errorf("token and node: %+v", d)
+	}
+}
+
+func TestToolEnvironment(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	c := newTestSession(t, testConfig())
+
+	stdout, final := c.runExec(protocol.ExecRequest{
+		Type: protocol.TypeExec, Token: "secret", Tool: "sh", Args: []string{"-c", "echo ${NOTIFY_SOCKET:-none} ${WATCHDOG_USEC:-none}"},
+	})
+	if final["type"] != protocol.TypeExit || stdout != "none none\n" {
+		t.Errorf("tool saw systemd variables: stdout %q, final %v", stdout, final)
+	}
+}
+
+func TestSessionStdinTeardown(t *testing.T) {
+	c := newTestSession(t, testConfig())
+
+	c.send(protocol.ExecRequest{Type: protocol.TypeExec, Token: "secret", Tool: "cat"})
+	if msg := c.recv(); msg["type"] != protocol.TypeStarted {
+		t.Fatalf("expected started, got %v", msg)
+	}
+	c.send(protocol.StdinData{Type: protocol.TypeStdin, Data: "hello\n"})
+	c.send(protocol.StdinData{Type: protocol.TypeStdinClose})
+
+	var stdout string
+	for {
+		msg := c.recv()
+		if msg["type"] == protocol.TypeStdout {
+			stdout += msg["data"].(string)
+			continue
+		}
+		if msg["type"] != protocol.TypeExit {
+			t.Fatalf("expected exit, got %v", msg)
+		}
+		break
+	}
+	if stdout != "hello" {
+		t.Errorf("stdout %q", stdout)
+	}
+
+	// Stray stdin after exit must not be swallowed as a request or leak
+	// into the next exec.
+	c.send(protocol.StdinData{Type: protocol.TypeStdin, Data: "stale\n"})
+	stdout, final := c.runExec(protocol.ExecRequest{
+		Type: protocol.TypeExec, Token: "secret", Tool: "echo", Args: []string{"next"},
+	})
+	if final["type"] != protocol.TypeExit || stdout != "next\n" {
+		t.Errorf("second exec: stdout %q, final %v", stdout, final)
+	}
+}
+
+func TestSessionMultiplexedExecs(t *testing.T) {
+	c := newTestSession(t, testConfig())
+	c.hello(protocol.FeatureMultiplex)
+
+	// "a" blocks on stdin while "b" runs to completion
+	c.send(protocol.ExecRequest{Type: protocol.TypeExec, ID: "a", Token: "secret", Tool: "cat"})
+	c.send(protocol.ExecRequest{Type: protocol.TypeExec, ID: "b", Token: "secret", Tool: "echo", Args: []string{"bee"}})
+
+	// Reusing a running ID is rejected
+	c.send(protocol.ExecRequest{Type: protocol.TypeExec, ID: "a", Token: "secret", Tool: "echo"})
+
+	output := map[string]string{}
+	exited := map[string]bool{}
+	rejected := false
+	for !exited["b"] || !rejected {
+		msg := c.recv()
+		id, _ := msg["id"].(string)
+		switch msg["type"] {
+		case protocol.TypeStdout:
+			output[id] += msg["data"].(string)
+		case protocol.TypeExit:
+			exited[id] = true
+		case protocol.TypeError:
+			if id != "a" {
+				t.Fatalf("unexpected error: %v", msg)
+			}
+			rejected = true
+		}
+	}
+	if exited["a"] {
+		t.Fatal("exec a exited before its stdin was closed")
+	}
+
+	c.send(protocol.StdinData{Type: protocol.TypeStdin, ID: "a", Data: "ay"})
+	c.send(protocol.StdinData{Type: protocol.TypeStdinClose, ID: "a"})
+	for !exited["a"] {
+		msg := c.recv()
+		id, _ := msg["id"].(string)
+		switch msg["type"] {
+		case protocol.TypeStdout:
+			output[id] += msg["data"].(string)
+		case protocol.TypeExit:
+			exited[id] = true
+		}
+	}
+
+	if output["a"] != "ay" || output["b"] != "bee" {
+		t.Errorf("output = %v", output)
+	}
+}
+
+func TestSessionSignalAndCancel(t *testing.T) {
+	c := newTestSession(t, testConfig())
+	c.hello(protocol.FeatureMultiplex, protocol.FeatureSignals)
+
+	tests := []struct {
+		control  interface{}
+		signal   string
+		canceled bool
+	}{
+		{protocol.SignalRequest{Type: protocol.TypeSignal, ID: "s", Signal: protocol.SignalInterrupt}, "SIGINT", false},
+		{protocol.CancelRequest{Type: protocol.TypeCancel, ID: "s"}, "SIGTERM", true},
+	}
+
+	for _, tt := range tests {
+		c.send(protocol.ExecRequest{Type: protocol.TypeExec, ID: "s", Token: "secret", Tool: "sleep", Args: []string{"30"}})
+		if msg := c.recv(); msg["type"] != protocol.TypeStarted {
+			t.Fatalf("expected started, got %v", msg)
+		}
+		c.send(tt.control)
+
+		msg := c.recv()
+		if msg["type"] != protocol.TypeExit {
+			t.Fatalf("expected exit, got %v", msg)
+		}
+		if msg["signal"] != tt.signal {
+			t.Errorf("signal = %v, want %s", msg["signal"], tt.signal)
+		}
+		canceled, _ := msg["canceled"].(bool)
+		if canceled != tt.canceled {
+			t.Errorf("canceled = %v, want %v", canceled, tt.canceled)
+		}
+		if code := msg["code"].(float64); code != float64(128+int(clientSignals[tt.signal])) {
+			t.Errorf("code = %v", code)
+		}
+	}
+}
+
+func TestSessionPTY(t *testing.T) {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no pseudo-terminal support")
+	}
+	c := newTestSession(t, testConfig())
+	c.hello(protocol.FeatureMultiplex, protocol.FeaturePTY)
+
+	c.send(protocol.ExecRequest{
+		Type: protocol.TypeExec, ID: "p", Token: "secret", Tool: "sh",
+		Args: []string{"-c", "test -t 0 && test -t 1 && stty size; read x; stty size"},
+		PTY:  true, Rows: 10, Cols: 20,
+	})
+	if msg := c.recv(); msg["type"] != protocol.TypeStarted {
+		t.Fatalf("expected started, got %v", msg)
+	}
+
+	var output string
+	for !strings.Contains(output, "10 20") {
+		msg := c.recv()
+		if msg["type"] != protocol.TypeStdout {
+			t.Fatalf("expected output, got %v (output so far %q)", msg, output)
+		}
+		output += msg["data"].(string)
+	}
+
+	c.send(protocol.ResizeRequest{Type: protocol.TypeResize, ID: "p", Rows: 30, Cols: 100})
+	c.send(protocol.StdinData{Type: protocol.TypeStdin, ID: "p", Data: "\n"})
+	for {
+		msg := c.recv()
+		if msg["type"] == protocol.TypeExit {
+			break
+		}
+		output += msg["data"].(string)
+	}
+	if !strings.Contains(output, "30 100") {
+		t.Errorf("resize not applied, output %q", output)
+	}
+}
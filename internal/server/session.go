@@ -0,0 +1,500 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// tlsHandshakeTimeout bounds how long a TLS client may take to handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// maxExecsPerConn limits how many execs one connection may run at once.
+const maxExecsPerConn = 32
+
+// session holds the state of one client connection.
+//
+// Each exec on a connection is identified by the ID the client gave it. An
+// ID is busy from the exec request until that exec's final frame has been
+// produced, after which it may be reused, so a connection can run many execs
+// concurrently and any number one after another. Only serve reads from the
+// connection: control messages are handled inline and stdin frames are handed
+// to the exec they name. All execs share the connection's frame writer, so a
+// client that stops reading throttles every exec on the connection.
+type session struct {
+	srv  *Server
+	auth *config.AuthConfig // policy of the listener that accepted conn
+	conn net.Conn
+	peer *peer
+	out  *frameWriter
+
+	// Set by the hello exchange. A session that never receives hello
+	// speaks protocol version 1 with no optional features.
+	protocol int
+	features map[string]bool
+	greeted  bool // a message other than hello has been seen
+
+	challenge string // nonce for ssh_auth, sent in the hello reply
+	requested bool   // a request other than hello or ssh_auth has been seen
+
+	mu      sync.Mutex
+	running map[string]*execution // by exec ID
+
+	execs sync.WaitGroup // exec and query goroutines still running
+}
+
+func newSession(s *Server, conn net.Conn, auth *config.AuthConfig) *session {
+	return &session{
+		srv:      s,
+		auth:     auth,
+		conn:     conn,
+		peer:     &peer{addr: conn.RemoteAddr().String()},
+		out:      newFrameWriter(conn, frameQueueDepth),
+		protocol: protocol.ProtocolV1,
+		features: make(map[string]bool),
+		running:  make(map[string]*execution),
+	}
+}
+
+// serve reads client messages until the connection closes.
+func (sess *session) serve() {
+	defer sess.close()
+
+	// Finish the TLS handshake up front so the client certificate is
+	// known before the first request is authenticated.
+	if tc, ok := sess.conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			log.Printf("[%s] TLS handshake failed: %v", sess.peer.addr, err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+	}
+	sess.peer = newPeer(sess.conn)
+
+	reader := bufio.NewReader(sess.conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[%s] read error: %v", sess.peer.addr, err)
+			}
+			return
+		}
+
+		// Parse the message type first
+		var msg struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+		}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			sess.srv.sendError(sess.out, "", protocol.ErrorInvalidRequest, "invalid JSON")
+			continue
+		}
+
+		if msg.Type == protocol.TypeHello {
+			var req protocol.HelloRequest
+			if err := json.Unmarshal(line, &req); err != nil {
+				sess.srv.sendError(sess.out, "", protocol.ErrorInvalidRequest, "invalid hello request")
+				continue
+			}
+			sess.hello(&req)
+			continue
+		}
+		if msg.Type == protocol.TypeSSHAuth && sess.features[protocol.FeatureSSHAuth] {
+			sess.sshAuth(line)
+			continue
+		}
+		sess.greeted = true
+		sess.requested = true
+
+		// Messages belonging to a feature the client did not negotiate
+		// are answered as an older server would answer them.
+		if f := messageFeature(msg.Type); f != "" && !sess.features[f] {
+			sess.srv.sendError(sess.out, msg.ID, protocol.ErrorUnsupported, fmt.Sprintf("unknown message type: %s", msg.Type))
+			continue
+		}
+
+		switch msg.Type {
+		case protocol.TypePing:
+			var req protocol.PingRequest
+			json.Unmarshal(line, &req)
+			sess.out.Send(sess.srv.pong(sess.auth, msg.ID, req.Token, sess.peer))
+
+		case protocol.TypeExec:
+			var req protocol.ExecRequest
+			if err := json.Unmarshal(line, &req); err != nil {
+				sess.srv.sendError(sess.out, msg.ID, protocol.ErrorInvalidRequest, "invalid exec request")
+				continue
+			}
+			if err := sess.checkExec(&req); err != nil {
+				sess.srv.sendError(sess.out, req.ID, protocol.ErrorUnsupported, err.Error())
+				continue
+			}
+			sess.startExec(&req)
+
+		case protocol.TypeStdin:
+			var data protocol.StdinData
+			if err := json.Unmarshal(line, &data); err != nil {
+				continue
+			}
+			if f := protocol.EncodingFeature(data.Encoding); f != "" && !sess.features[f] {
+				continue
+			}
+			buf, err := protocol.DecodeData(data.Data, data.Encoding)
+			if err != nil {
+				continue
+			}
+			// Stdin for an exec that is not running has arrived after
+			// the exec exited and is dropped.
+			if ex := sess.lookup(data.ID); ex != nil {
+				ex.write(buf)
+			}
+
+		case protocol.TypeStdinClose:
+			if ex := sess.lookup(msg.ID); ex != nil {
+				ex.closeStdin()
+			}
+
+		case protocol.TypeSignal:
+			var req protocol.SignalRequest
+			if err := json.Unmarshal(line, &req); err != nil {
+				continue
+			}
+			sig, ok := clientSignals[req.Signal]
+			if !ok {
+				log.Printf("[%s] ignoring unsupported signal %q", sess.peer.addr, req.Signal)
+				continue
+			}
+			// Like stdin, signals for an exec that is not running are
+			// dropped rather than answered with an error frame, which
+			// the client would take as the end of that exec.
+			if ex := sess.lookup(req.ID); ex != nil {
+				ex.signal(sig)
+			}
+
+		case protocol.TypeCancel:
+			if ex := sess.lookup(msg.ID); ex != nil {
+				ex.cancel()
+			}
+
+		case protocol.TypeResize:
+			var req protocol.ResizeRequest
+			if err := json.Unmarshal(line, &req); err != nil {
+				continue
+			}
+			if ex := sess.lookup(req.ID); ex != nil {
+				ex.resize(req.Rows, req.Cols)
+			}
+
+		case protocol.TypeListTools:
+			var req protocol.ListToolsRequest
+			if err := json.Unmarshal(line, &req); err != nil {
+				sess.srv.sendError(sess.out, msg.ID, protocol.ErrorInvalidRequest, "invalid list_tools request")
+				continue
+			}
+			sess.query(func() interface{} { return sess.srv.handleListTools(sess, &req) })
+
+		case protocol.TypeDescribeTool:
+			var req protocol.DescribeToolRequest
+			if err := json.Unmarshal(line, &req); err != nil {
+				sess.srv.sendError(sess.out, msg.ID, protocol.ErrorInvalidRequest, "invalid describe_tool request")
+				continue
+			}
+			sess.query(func() interface{} { return sess.srv.handleDescribeTool(sess, &req) })
+
+		default:
+			sess.srv.sendError(sess.out, msg.ID, protocol.ErrorUnsupported, fmt.Sprintf("unknown message type: %s", msg.Type))
+		}
+	}
+}
+
+// hello negotiates the protocol version and features for the session. It
+// is only accepted as the first message on a connection.
+func (sess *session) hello(req *protocol.HelloRequest) {
+	if sess.greeted {
+		sess.srv.sendError(sess.out, "", protocol.ErrorInvalidRequest, "hello must be the first message")
+		return
+	}
+	if req.Protocol < protocol.ProtocolV1 {
+		sess.srv.sendError(sess.out, "", protocol.ErrorUnsupported, fmt.Sprintf("unsupported protocol version: %d", req.Protocol))
+		return
+	}
+	sess.greeted = true
+
+	sess.protocol = req.Protocol
+	if sess.protocol > protocol.ProtocolVersion {
+		sess.protocol = protocol.ProtocolVersion
+	}
+	agreed := []string{}
+	if sess.protocol >= protocol.ProtocolVersion {
+		for _, f := range req.Features {
+			if supportedFeatures[f] && !sess.features[f] {
+				sess.features[f] = true
+				agreed = append(agreed, f)
+			}
+		}
+	}
+	if req.Client != "" {
+		log.Printf("[%s] client %s, protocol %d, features %v", sess.peer.addr, req.Client, sess.protocol, agreed)
+	}
+
+	if sess.features[protocol.FeatureSSHAuth] {
+		sess.challenge = newChallenge()
+	}
+
+	sess.out.Send(&protocol.HelloResponse{
+		Type:      protocol.TypeHello,
+		Protocol:  sess.protocol,
+		Features:  agreed,
+		Server:    Version,
+		Challenge: sess.challenge,
+	})
+}
+
+// checkExec rejects an exec request that relies on features the session
+// has not negotiated.
+func (sess *session) checkExec(req *protocol.ExecRequest) error {
+	if req.ID != "" && !sess.features[protocol.FeatureMultiplex] {
+		return fmt.Errorf("exec IDs require the %s feature", protocol.FeatureMultiplex)
+	}
+	if f := protocol.EncodingFeature(req.Encoding); f != "" && !sess.features[f] {
+		return fmt.Errorf("encoding %s requires the %s feature", req.Encoding, f)
+	}
+	if req.PTY && !sess.features[protocol.FeaturePTY] {
+		return fmt.Errorf("pty requires the %s feature", protocol.FeaturePTY)
+	}
+	return nil
+}
+
+// startExec registers req under its ID and runs it in the background.
+func (sess *session) startExec(req *protocol.ExecRequest) {
+	sess.mu.Lock()
+	if _, busy := sess.running[req.ID]; busy {
+		sess.mu.Unlock()
+		sess.srv.sendError(sess.out, req.ID, protocol.ErrorBusy, "exec already in progress")
+		return
+	}
+	if len(sess.running) >= maxExecsPerConn {
+		sess.mu.Unlock()
+		sess.srv.sendError(sess.out, req.ID, protocol.ErrorBusy, "too many concurrent execs")
+		return
+	}
+	ex := newExecution()
+	sess.running[req.ID] = ex
+	sess.mu.Unlock()
+
+	sess.execs.Add(1)
+	go func() {
+		defer sess.execs.Done()
+		final := sess.srv.handleExec(sess, req, ex)
+
+		// Release the ID before the client learns the exec is over, so
+		// that reusing it is never rejected as busy.
+		ex.finish()
+		sess.mu.Lock()
+		delete(sess.running, req.ID)
+		sess.mu.Unlock()
+
+		sess.out.Send(final)
+	}()
+}
+
+// query answers a request that runs no tool in the background, since
+// authenticating it may involve a network round trip.
+func (sess *session) query(answer func() interface{}) {
+	sess.execs.Add(1)
+	go func() {
+		defer sess.execs.Done()
+		sess.out.Send(answer())
+	}()
+}
+
+func (sess *session) lookup(id string) *execution {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.running[id]
+}
+
+// close tears the session down once the client has gone away. Running
+// execs have nobody left to report to and are canceled.
+func (sess *session) close() {
+	sess.mu.Lock()
+	running := make([]*execution, 0, len(sess.running))
+	for _, ex := range sess.running {
+		running = append(running, ex)
+	}
+	sess.mu.Unlock()
+
+	for _, ex := range running {
+		ex.cancel()
+	}
+	sess.execs.Wait()
+	sess.out.Close()
+	sess.conn.Close()
+}
+
+// execution is the client-facing side of a running exec. The session's read
+// loop queues stdin with write, which pumpStdin copies to the process, and
+// delivers signals to the process group.
+type execution struct {
+	stdin chan []byte   // queued stdin data; a nil slice means EOF
+	done  chan struct{} // closed by finish once the process has exited
+
+	pump       sync.WaitGroup
+	finishOnce sync.Once
+	eofOnce    sync.Once
+
+	mu       sync.Mutex
+	pgid     int      // process group, once started
+	tty      *os.File // terminal master for PTY execs
+	exited   bool
+	canceled bool
+}
+
+func newExecution() *execution {
+	return &execution{
+		stdin: make(chan []byte, 16),
+		done:  make(chan struct{}),
+	}
+}
+
+// write queues stdin data, blocking while the pump is behind. Data for an
+// exec that has finished is dropped.
+func (e *execution) write(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	select {
+	case e.stdin <- data:
+	case <-e.done:
+	}
+}
+
+// closeStdin queues EOF for the process stdin.
+func (e *execution) closeStdin() {
+	e.eofOnce.Do(func() {
+		select {
+		case e.stdin <- nil:
+		case <-e.done:
+		}
+	})
+}
+
+// pumpStdin copies queued data to w until EOF or until the process exits.
+// It must be started with startPump.
+func (e *execution) pumpStdin(w io.WriteCloser) {
+	defer e.pump.Done()
+	defer w.Close()
+	for {
+		select {
+		case data := <-e.stdin:
+			if data == nil {
+				return
+			}
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// startPump starts pumpStdin for w.
+func (e *execution) startPump(w io.WriteCloser) {
+	e.pump.Add(1)
+	go e.pumpStdin(w)
+}
+
+// finish stops the stdin pump and waits for it to exit. It is safe to call
+// more than once and before the pump has been started.
+func (e *execution) finish() {
+	e.finishOnce.Do(func() { close(e.done) })
+	e.pump.Wait()
+}
+
+// started records the process group of the started tool. A cancel that
+// arrived before the process existed takes effect now.
+func (e *execution) started(pgid int) {
+	e.mu.Lock()
+	e.pgid = pgid
+	canceled := e.canceled
+	e.mu.Unlock()
+
+	if canceled {
+		e.terminate()
+	}
+}
+
+// reaped records that the tool has exited, after which no more signals are
+// sent to its process group.
+func (e *execution) reaped() {
+	e.mu.Lock()
+	e.exited = true
+	e.mu.Unlock()
+}
+
+// signal delivers sig to the tool's process group.
+func (e *execution) signal(sig syscall.Signal) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pgid == 0 || e.exited {
+		return nil
+	}
+	return syscall.Kill(-e.pgid, sig)
+}
+
+// cancel stops the tool: SIGTERM now, SIGKILL after cancelGracePeriod.
+func (e *execution) cancel() {
+	e.mu.Lock()
+	already := e.canceled
+	e.canceled = true
+	e.mu.Unlock()
+
+	if !already {
+		e.terminate()
+	}
+}
+
+func (e *execution) terminate() {
+	e.signal(syscall.SIGTERM)
+	time.AfterFunc(cancelGracePeriod, func() {
+		e.signal(syscall.SIGKILL)
+	})
+}
+
+// setTTY records the terminal of a PTY exec so it can be resized.
+func (e *execution) setTTY(tty *os.File) {
+	e.mu.Lock()
+	e.tty = tty
+	e.mu.Unlock()
+}
+
+// resize changes the window size of a PTY exec. It is a no-op for execs
+// without a terminal.
+func (e *execution) resize(rows, cols uint16) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.tty == nil || e.exited || rows == 0 || cols == 0 {
+		return nil
+	}
+	return resizePTY(e.tty, rows, cols)
+}
+
+func (e *execution) wasCanceled() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.canceled
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// cancelGracePeriod is how long a canceled tool has to exit after SIGTERM
+// before its process group is killed.
+const cancelGracePeriod = 5 * time.Second
+
+// clientSignals are the signals a client may send to a running tool.
+var clientSignals = map[string]syscall.Signal{
+	protocol.SignalHangup:    syscall.SIGHUP,
+	protocol.SignalInterrupt: syscall.SIGINT,
+	protocol.SignalQuit:      syscall.SIGQUIT,
+	protocol.SignalKill:      syscall.SIGKILL,
+	protocol.SignalTerminate: syscall.SIGTERM,
+}
+
+// signalNames names the signals reported in exit frames.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGUSR2: "SIGUSR2",
+}
+
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("SIG%d", int(sig))
+}
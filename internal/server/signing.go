@@ -0,0 +1,69 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// signatureSkew is how far a signed request's timestamp may be from the
+// server's clock.
+const signatureSkew = 5 * time.Minute
+
+// nonceCache remembers the nonces of recent signed requests, so that each
+// is accepted once. A nonce is kept until its request's timestamp falls
+// outside the skew window, after which the timestamp check rejects it.
+type nonceCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time // nonce -> when it may be forgotten
+	prune time.Time            // next sweep for forgettable nonces
+}
+
+// add records nonce, reporting false if it was already seen.
+func (c *nonceCache) add(nonce string, stamp, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[string]time.Time)
+	}
+	if now.After(c.prune) {
+		for n, until := range c.seen {
+			if now.After(until) {
+				delete(c.seen, n)
+			}
+		}
+		c.prune = now.Add(time.Minute)
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = stamp.Add(signatureSkew)
+	return true
+}
+
+// lookupToken finds the token a request authenticates with: the token it
+// carries or, for a signed request, the token it was signed with. A
+// signature only counts if its timestamp is within signatureSkew and its
+// nonce is new. Under require_signature, tokens sent as they are do not
+// count.
+func (s *Server) lookupToken(auth *config.AuthConfig, token string, req protocol.Signable) (*config.Token, *config.Principal, bool) {
+	if req == nil || !req.Signed() {
+		if auth.RequireSignature {
+			return nil, nil, false
+		}
+		return auth.LookupToken(token)
+	}
+
+	stamp, nonce := req.Stamp()
+	now := time.Now()
+	if nonce == "" || stamp.Before(now.Add(-signatureSkew)) || stamp.After(now.Add(signatureSkew)) {
+		return nil, nil, false
+	}
+	match, principal, ok := auth.LookupSigned(req)
+	if !ok || !s.nonces.add(nonce, stamp, now) {
+		return nil, nil, false
+	}
+	return match, principal, true
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// newChallenge returns a random nonce for a client to sign with its SSH key.
+func newChallenge() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// sshAuth handles an ssh_auth request. If the key is in the listener's
+// authorized_keys and its signature of the session's challenge verifies,
+// the key and its principal become the identity of the session.
+func (sess *session) sshAuth(line []byte) {
+	var req protocol.SSHAuthRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		sess.srv.sendError(sess.out, "", protocol.ErrorInvalidRequest, "invalid ssh_auth request")
+		return
+	}
+	if sess.requested {
+		sess.srv.sendError(sess.out, "", protocol.ErrorInvalidRequest, "ssh_auth must come before other requests")
+		return
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		sess.srv.sendError(sess.out, "", protocol.ErrorInvalidRequest, "invalid public key")
+		return
+	}
+
+	addr := addrKey(sess.peer.addr)
+	entry, principal, ok := sess.auth.LookupKey(key)
+	who := ""
+	if ok {
+		who = principalKey(entry.Principal)
+	}
+	if sess.srv.lockout.blocked(addr, who) {
+		sess.srv.sendError(sess.out, "", protocol.ErrorThrottled, "too many failed authentications; try again later")
+		return
+	}
+	if ok {
+		var sig ssh.Signature
+		blob, err := base64.StdEncoding.DecodeString(req.Signature)
+		ok = err == nil && ssh.Unmarshal(blob, &sig) == nil &&
+			key.Verify(protocol.SSHAuthData(sess.challenge, protocol.ChannelBinding(sess.conn, true)), &sig) == nil
+	}
+	if !ok {
+		sess.srv.lockout.fail(addr, who)
+		log.Printf("[%s] SSH key %s not accepted", sess.peer.addr, ssh.FingerprintSHA256(key))
+		sess.srv.sendError(sess.out, "", protocol.ErrorAuthFailed, "SSH key not accepted")
+		return
+	}
+
+	sess.srv.lockout.succeed(addr, who)
+	p := *sess.peer
+	p.sshKey = entry.Fingerprint()
+	if principal != nil {
+		p.principal = principal.Name
+		p.grant = principal
+	}
+	sess.peer = &p
+	log.Printf("[%s] authenticated with SSH key %s %s", p.addr, p.sshKey, entry.Comment)
+
+	sess.out.Send(&protocol.SSHAuthResponse{
+		Type:        protocol.TypeSSHAuth,
+		Fingerprint: p.sshKey,
+		Principal:   entry.Principal,
+	})
+}
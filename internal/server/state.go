@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/config"
+)
+
+// serverState is what the server knows beyond the config: how often each
+// token with max_uses has been used, which clients are banned, and when a
+// warning about a token's expiry was last logged. Use counts and bans are
+// kept in the server.state file, if one is configured.
+//
+// Bans may be lifted and use counts reset while the server runs
+// (credwrap-server bans clear and tokens rotate rewrite the file); the
+// server rereads the file whenever it changes under it.
+type serverState struct {
+	mu     sync.Mutex
+	path   string                      // server.state; kept in memory only if empty
+	uses   map[string]int              // by token ID
+	bans   map[string]Ban              // by address or "principal:NAME"
+	warned map[*config.Token]time.Time // last expiry warning logged
+	file   os.FileInfo                 // the file as last read or written
+}
+
+// Ban is a client address or principal refused after failing to
+// authenticate too often.
+type Ban struct {
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"` // failures in a row that led to it
+}
+
+// stateFile is the format of the server.state file.
+type stateFile struct {
+	TokenUses map[string]int `json:"token_uses"`
+	Bans      map[string]Ban `json:"bans,omitempty"`
+}
+
+func newServerState(path string) *serverState {
+	return &serverState{
+		path:   path,
+		uses:   make(map[string]int),
+		bans:   make(map[string]Ban),
+		warned: make(map[*config.Token]time.Time),
+	}
+}
+
+// readState reads a server.state file. A missing file is empty.
+func readState(path string) (*stateFile, error) {
+	state := &stateFile{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = []byte("{}"), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parsing state %s: %w", path, err)
+	}
+	if state.TokenUses == nil {
+		state.TokenUses = map[string]int{}
+	}
+	if state.Bans == nil {
+		state.Bans = map[string]Ban{}
+	}
+	return state, nil
+}
+
+// writeState replaces a server.state file.
+func writeState(path string, state *stateFile) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// TokenUses reads the use counts, by token ID, from a server.state file.
+// A missing file has no counts.
+func TokenUses(path string) (map[string]int, error) {
+	state, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+	return state.TokenUses, nil
+}
+
+// Bans reads the bans in force from a server.state file, by the address
+// or "principal:NAME" they apply to.
+func Bans(path string) (map[string]Ban, error) {
+	state, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for key, ban := range state.Bans {
+		if !now.Before(ban.Until) {
+			delete(state.Bans, key)
+		}
+	}
+	return state.Bans, nil
+}
+
+// ResetTokenUses forgets the uses counted for the token with id in a
+// server.state file, as when its secret is rotated. A running server
+// notices the change the next time it counts a use.
+func ResetTokenUses(path, id string) error {
+	state, err := readState(path)
+	if err != nil {
+		return err
+	}
+	if _, ok := state.TokenUses[id]; !ok {
+		return nil
+	}
+	delete(state.TokenUses, id)
+	return writeState(path, state)
+}
+
+// ClearBans lifts the bans on keys, or every ban if none are given, in a
+// server.state file. It returns the keys that were banned, sorted. A
+// running server notices the change the next time it checks a ban.
+func ClearBans(path string, keys ...string) ([]string, error) {
+	state, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expired := 0
+	for key, ban := range state.Bans {
+		if !now.Before(ban.Until) {
+			delete(state.Bans, key)
+			expired++
+		}
+	}
+	if len(keys) == 0 {
+		for key := range state.Bans {
+			keys = append(keys, key)
+		}
+	}
+	var cleared []string
+	for _, key := range keys {
+		if _, ok := state.Bans[key]; ok {
+			delete(state.Bans, key)
+			cleared = append(cleared, key)
+		}
+	}
+	if len(cleared) == 0 && expired == 0 {
+		return nil, nil
+	}
+	sort.Strings(cleared)
+	return cleared, writeState(path, state)
+}
+
+// load reads the counts and bans saved by an earlier run.
+func (t *serverState) load() error {
+	if t.path == "" {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, err := readState(t.path)
+	if err != nil {
+		return err
+	}
+	t.uses, t.bans = state.TokenUses, state.Bans
+	t.file, _ = os.Stat(t.path)
+	return nil
+}
+
+// refresh rereads the counts and bans if the file was changed by someone
+// else. Since the server saves every change it makes, the file holds all
+// it knows. The caller holds t.mu.
+func (t *serverState) refresh() {
+	if t.path == "" {
+		return
+	}
+	// The file is always replaced, never rewritten in place, so a change
+	// shows even when it lands within the resolution of modification times.
+	fi, _ := os.Stat(t.path)
+	if fi == nil && t.file == nil {
+		return
+	}
+	if fi != nil && t.file != nil && os.SameFile(fi, t.file) && fi.ModTime().Equal(t.file.ModTime()) {
+		return
+	}
+	state, err := readState(t.path)
+	if err != nil {
+		log.Printf("Warning: rereading state: %v", err)
+		return
+	}
+	t.uses, t.bans = state.TokenUses, state.Bans
+	t.file = fi
+}
+
+// save writes the counts and bans to the state file. The caller holds
+// t.mu.
+func (t *serverState) save() error {
+	if t.path == "" {
+		return nil
+	}
+	t.refresh()
+	if err := writeState(t.path, &stateFile{TokenUses: t.uses, Bans: t.bans}); err != nil {
+		return err
+	}
+	t.file, _ = os.Stat(t.path)
+	return nil
+}
+
+// banned returns the ban in force on key, if any.
+func (t *serverState) banned(key string, now time.Time) (Ban, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refresh()
+	ban, ok := t.bans[key]
+	if ok && !now.Before(ban.Until) {
+		delete(t.bans, key)
+		return Ban{}, false
+	}
+	return ban, ok
+}
+
+// ban records a ban on key.
+func (t *serverState) ban(key string, ban Ban) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refresh()
+	t.bans[key] = ban
+	if err := t.save(); err != nil {
+		log.Printf("Warning: saving bans: %v", err)
+	}
+}
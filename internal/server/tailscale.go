@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/config"
+)
+
+// whoisTimeout bounds a LocalAPI lookup, so a wedged tailscaled cannot
+// stall authentication.
+const whoisTimeout = 2 * time.Second
+
+// whois is what tailscaled knows about the tailnet node behind an address.
+type whois struct {
+	Node struct {
+		ID       json.Number
+		StableID string
+		Name     string // MagicDNS name, with a trailing dot
+		Key      string // "nodekey:..."
+		Tags     []string
+	}
+	UserProfile struct {
+		LoginName string
+	}
+}
+
+// identity returns the node as auth rules see it.
+func (w *whois) identity() *TailscaleIdentity {
+	id := &TailscaleIdentity{
+		Node: strings.TrimSuffix(w.Node.Name, "."),
+		Tags: w.Node.Tags,
+		User: w.UserProfile.LoginName,
+	}
+	for _, other := range []string{w.Node.StableID, w.Node.ID.String(), w.Node.Key} {
+		if other != "" {
+			id.IDs = append(id.IDs, other)
+		}
+	}
+	return id
+}
+
+// TailscaleIdentity is the tailnet node a client connects from, as auth
+// rules see it.
+type TailscaleIdentity struct {
+	Node string   // MagicDNS name, e.g. "agent-host.tail1234.ts.net"
+	IDs  []string // Other names for the node: stable ID, numeric ID, node key
+	User string   // Login name of the node's owner
+	Tags []string // ACL tags
+}
+
+// matches reports whether the node is one of nodes (by ID, key, MagicDNS
+// name or host name), carries one of tags, or is owned by one of users.
+// Tagged nodes belong to their tags rather than to whoever added them, so
+// users never match them.
+func (id *TailscaleIdentity) matches(nodes, users, tags []string) bool {
+	host, _, _ := strings.Cut(id.Node, ".")
+	for _, allowed := range nodes {
+		allowed = strings.TrimSuffix(allowed, ".")
+		if allowed == "" {
+			continue
+		}
+		if allowed == id.Node || allowed == host {
+			return true
+		}
+		for _, other := range id.IDs {
+			if allowed == other {
+				return true
+			}
+		}
+	}
+	for _, tag := range id.Tags {
+		for _, allowed := range tags {
+			if tag == allowed {
+				return true
+			}
+		}
+	}
+	if len(id.Tags) == 0 && id.User != "" {
+		for _, allowed := range users {
+			if strings.EqualFold(id.User, allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tailscaleClient looks up clients in tailscaled's LocalAPI, which it
+// serves over a unix socket. Answers, including "not a tailnet node" and
+// failed lookups, are reused until the cache TTL passes.
+type tailscaleClient struct {
+	socket string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedWhois // by client IP
+}
+
+type cachedWhois struct {
+	who     *whois // nil if the address is not a known node
+	expires time.Time
+}
+
+func newTailscaleClient(cfg config.TailscaleConfig) *tailscaleClient {
+	socket := cfg.SocketPath()
+	var dialer net.Dialer
+	return &tailscaleClient{
+		socket: socket,
+		ttl:    cfg.TTL(),
+		client: &http.Client{
+			Timeout: whoisTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		cache: make(map[string]cachedWhois),
+	}
+}
+
+// whois returns the node behind remoteAddr, or nil if tailscaled does not
+// know it or cannot be asked.
+func (t *tailscaleClient) whois(remoteAddr string) *whois {
+	ip := net.ParseIP(extractIP(remoteAddr))
+	if ip == nil {
+		return nil
+	}
+	key := ip.String()
+	now := time.Now()
+
+	t.mu.Lock()
+	entry, ok := t.cache[key]
+	t.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.who
+	}
+
+	who, err := t.query(key)
+	if err != nil {
+		log.Printf("Warning: tailscale whois %s: %v", key, err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, e := range t.cache {
+		if !now.Before(e.expires) {
+			delete(t.cache, addr)
+		}
+	}
+	t.cache[key] = cachedWhois{who: who, expires: now.Add(t.ttl)}
+	return who
+}
+
+// query asks tailscaled about ip. An address that is not on the tailnet
+// gives a nil whois and no error.
+func (t *tailscaleClient) query(ip string) (*whois, error) {
+	// The LocalAPI only answers requests addressed to this host name.
+	u := "http://local-tailscaled.sock/localapi/v0/whois?addr=" + url.QueryEscape(net.JoinHostPort(ip, "1"))
+	resp, err := t.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("%s: %s", t.socket, resp.Status)
+	}
+	var who whois
+	if err := json.NewDecoder(resp.Body).Decode(&who); err != nil {
+		return nil, fmt.Errorf("parsing whois: %w", err)
+	}
+	return &who, nil
+}
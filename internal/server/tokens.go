@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/openclaw/credwrap/internal/config"
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// expiryWarning is how long before a token expires the server starts
+// warning about it, in the log and in answers to pings.
+const expiryWarning = 7 * 24 * time.Hour
+
+// use counts one use of the token with id, unless it has already been used
+// max times.
+func (t *serverState) use(id string, max int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refresh()
+	if t.uses[id] >= max {
+		return false
+	}
+	t.uses[id]++
+	if err := t.save(); err != nil {
+		log.Printf("Warning: saving token use counts: %v", err)
+	}
+	return true
+}
+
+// warn logs that tok expires soon, at most once a day per token.
+func (t *serverState) warn(tok *config.Token, now time.Time) {
+	left := tok.ExpiresAt().Sub(now)
+	if tok.ExpiresAt().IsZero() || left <= 0 || left > expiryWarning {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if last, ok := t.warned[tok]; ok && now.Sub(last) < 24*time.Hour {
+		return
+	}
+	t.warned[tok] = now
+	log.Printf("Warning: %s expires in %s (%s); rotate it", tokenLabel(tok), formatRemaining(left), tok.ExpiresAt().UTC().Format(time.RFC3339))
+}
+
+// checkToken enforces the validity period and use limit of a token a
+// request presented, counting the use. It returns the error code to reject
+// the request with, or "" if the token may be used.
+func (s *Server) checkToken(tok *config.Token) string {
+	now := time.Now()
+	if !tok.Active(now) {
+		return protocol.ErrorTokenExpired
+	}
+	s.state.warn(tok, now)
+	if tok.MaxUses > 0 && !s.state.use(tok.ID, tok.MaxUses) {
+		return protocol.ErrorTokenExhausted
+	}
+	return ""
+}
+
+// logTokenExpiry logs the configured tokens that have expired or expire
+// soon, so they can be rotated before clients start failing.
+func (s *Server) logTokenExpiry() {
+	now := time.Now()
+	check := func(tokens []config.Token) {
+		for i := range tokens {
+			tok := &tokens[i]
+			if !tok.ExpiresAt().IsZero() && !now.Before(tok.ExpiresAt()) {
+				log.Printf("Warning: %s expired at %s", tokenLabel(tok), tok.ExpiresAt().UTC().Format(time.RFC3339))
+				continue
+			}
+			s.state.warn(tok, now)
+		}
+	}
+	auths := []*config.AuthConfig{&s.cfg.Auth}
+	for _, lc := range s.cfg.Server.ListenerConfigs() {
+		if lc.Auth != nil {
+			auths = append(auths, lc.Auth)
+		}
+	}
+	for _, auth := range auths {
+		check(auth.Tokens)
+		for _, p := range auth.Principals {
+			check(p.Tokens)
+		}
+	}
+}
+
+// pong answers a ping from p. When the ping carries a token that expires
+// and p may authenticate with it, the answer says when, and warns once
+// expiry is near. The token is checked like a request's, throttling and
+// failures included, so pings cannot be used to guess tokens; unlike a
+// request, a ping does not count as a use.
+func (s *Server) pong(auth *config.AuthConfig, id, token string, p *peer) *protocol.PongResponse {
+	resp := &protocol.PongResponse{Type: protocol.TypePong, ID: id, Version: Version}
+	if token == "" {
+		return resp
+	}
+	_, tok, code := s.checkCredentials(auth, token, nil, p)
+	if code != "" || tok == nil || tok.ExpiresAt().IsZero() {
+		return resp
+	}
+	resp.TokenExpires = tok.ExpiresAt().UTC().Format(time.RFC3339)
+	switch left := time.Until(tok.ExpiresAt()); {
+	case left <= 0:
+		resp.Warning = "token has expired"
+	case left <= expiryWarning:
+		resp.Warning = fmt.Sprintf("token expires in %s", formatRemaining(left))
+		s.state.warn(tok, time.Now())
+	}
+	return resp
+}
+
+// authError returns the error frame for an authentication failure code
+// returned by authenticate.
+func authError(id, code string) *protocol.ErrorResponse {
+	switch code {
+	case protocol.ErrorTokenExpired:
+		return errorResponse(id, code, "token expired or not yet valid")
+	case protocol.ErrorTokenExhausted:
+		return errorResponse(id, code, "token use limit reached")
+	case protocol.ErrorThrottled:
+		return errorResponse(id, code, "too many failed authentications; try again later")
+	}
+	return errorResponse(id, protocol.ErrorAuthFailed, "authentication failed")
+}
+
+func tokenLabel(tok *config.Token) string {
+	if tok.ID == "" {
+		return "plaintext token"
+	}
+	if tok.Name != "" {
+		return fmt.Sprintf("token %s (%s)", tok.ID, tok.Name)
+	}
+	return "token " + tok.ID
+}
+
+// formatRemaining formats a time left for humans: whole days when there
+// are at least two, otherwise hours and minutes.
+func formatRemaining(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("%d days", d/(24*time.Hour))
+	}
+	return d.Round(time.Minute).String()
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package server
+
+// withUmask runs fn. This platform has no umask.
+func withUmask(mask int, fn func() error) error {
+	return fn()
+}
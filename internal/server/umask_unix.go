@@ -0,0 +1,22 @@
+//go:build unix
+
+package server
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var umaskMu sync.Mutex
+
+// withUmask runs fn with the process umask set to mask. The umask is shared
+// by the whole process, so files other goroutines create meanwhile get it
+// too; callers only ever tighten it.
+func withUmask(mask int, fn func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := unix.Umask(mask)
+	defer unix.Umask(old)
+	return fn()
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/openclaw/credwrap/internal/protocol"
+)
+
+// frameQueueDepth is how many response frames may be queued per connection
+// before senders block. Together with outputChunkSize it bounds the memory a
+// slow client can make the server hold.
+const frameQueueDepth = 64
+
+// errWriterClosed is returned when sending on a closed frame writer.
+var errWriterClosed = errors.New("frame writer closed")
+
+// frameWriter serializes response frames onto a single connection.
+//
+// All frames for a connection go through one writer goroutine, so frames
+// from concurrent producers never interleave on the wire. The queue is
+// bounded: when the client reads slowly, Send blocks, which stops the output
+// pumps from reading the tool's pipes and in turn throttles the tool.
+type frameWriter struct {
+	enc    *json.Encoder
+	frames chan interface{}
+	done   chan struct{} // closed when the writer goroutine exits
+	failed chan struct{} // closed when a write fails
+
+	mu     sync.Mutex // serializes Send so seq order matches queue order
+	seq    uint64
+	closed bool
+
+	err error // first write error, set before failed is closed
+}
+
+func newFrameWriter(w io.Writer, depth int) *frameWriter {
+	fw := &frameWriter{
+		enc:    json.NewEncoder(w),
+		frames: make(chan interface{}, depth),
+		done:   make(chan struct{}),
+		failed: make(chan struct{}),
+	}
+	go fw.run()
+	return fw
+}
+
+func (w *frameWriter) run() {
+	defer close(w.done)
+	for frame := range w.frames {
+		if err := w.enc.Encode(frame); err != nil {
+			w.err = err
+			close(w.failed)
+			// Drop anything still queued; senders see failed and stop.
+			for range w.frames {
+			}
+			return
+		}
+	}
+}
+
+// Send assigns the next sequence number to frame and queues it, blocking
+// while the queue is full. It returns an error once the connection has failed
+// or the writer has been closed.
+func (w *frameWriter) Send(frame interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errWriterClosed
+	}
+	select {
+	case <-w.failed:
+		return w.err
+	default:
+	}
+	if f, ok := frame.(protocol.Sequenced); ok {
+		w.seq++
+		f.SetSeq(w.seq)
+	}
+
+	select {
+	case w.frames <- frame:
+		return nil
+	case <-w.failed:
+		return w.err
+	}
+}
+
+// Close flushes queued frames and stops the writer goroutine.
+func (w *frameWriter) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.frames)
+	}
+	w.mu.Unlock()
+
+	<-w.done
+	select {
+	case <-w.failed:
+		return w.err
+	default:
+		return nil
+	}
+}
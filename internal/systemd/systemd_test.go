@@ -0,0 +1,75 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := Notify("READY=1"); err != nil {
+		t.Errorf("Notify without a socket: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	if err := Notify("READY=1\nSTATUS=ok"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "READY=1\nSTATUS=ok" {
+		t.Errorf("received %q, %v", buf[:n], err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	if got := WatchdogInterval(); got != 30*time.Second {
+		t.Errorf("got %v, want 30s", got)
+	}
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(1<<30))
+	if got := WatchdogInterval(); got != 0 {
+		t.Errorf("watchdog for another process: got %v", got)
+	}
+}
+
+func TestListenersOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if ls, err := Listeners(); ls != nil || err != nil {
+		t.Errorf("got %v, %v for another process's sockets", ls, err)
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("CREDWRAP_TEST", "kept")
+	env := strings.Join(Environ(), "\n")
+	for _, v := range serviceVars {
+		if strings.Contains("\n"+env, "\n"+v+"=") {
+			t.Errorf("%s passed on", v)
+		}
+	}
+	if !strings.Contains(env, "CREDWRAP_TEST=kept") {
+		t.Error("other variables dropped")
+	}
+	if os.Getenv("NOTIFY_SOCKET") == "" || WatchdogInterval() != 30*time.Second {
+		t.Error("the service's own variables were cleared")
+	}
+}
@@ -171,7 +171,9 @@ Description=credwrap credential injection server
 After=network.target
 
 [Service]
-Type=simple
+# Ready once the credentials are unlocked and the listeners are open
+Type=notify
+WatchdogSec=30
 User=$SERVICE_USER
 Group=$SERVICE_USER
 ExecStart=$INSTALL_DIR/credwrap-server \\
@@ -189,10 +191,23 @@ PrivateTmp=true
 
 [Install]
 WantedBy=multi-user.target
+EOF
+
+    # Socket activation: systemd holds the port and starts the server on
+    # the first connection
+    cat > /etc/systemd/system/credwrap.socket << EOF
+[Unit]
+Description=credwrap credential injection server socket
+
+[Socket]
+ListenStream=${BIND_ADDR}:${LISTEN_PORT}
+
+[Install]
+WantedBy=sockets.target
 EOF
 
     systemctl daemon-reload
-    log_info "Systemd service created: credwrap.service"
+    log_info "Systemd units created: credwrap.service, credwrap.socket"
 fi
 
 # 7. Print summary
@@ -225,11 +240,18 @@ echo ""
 echo "4. Start the service:"
 echo "   sudo systemctl start credwrap"
 echo "   sudo systemctl enable credwrap  # auto-start on boot"
+echo "   # or start it on the first connection instead:"
+echo "   sudo systemctl enable --now credwrap.socket"
 echo ""
 echo "5. Configure client (~/.credwrap.yaml):"
 echo "   server: \"${BIND_ADDR}:${LISTEN_PORT}\""
 echo "   token: \"<token from config.yaml>\""
 echo ""
-echo "6. Test:"
+echo "6. Keep only a hash of the token in the config (copy it first):"
+echo "   sudo credwrap-server tokens hash $CONFIG_DIR/config.yaml"
+echo "   # or issue a separate token per agent:"
+echo "   sudo credwrap-server tokens create $CONFIG_DIR/config.yaml my-agent"
+echo ""
+echo "7. Test:"
 echo "   credwrap echo 'Hello from credwrap!'"
 echo ""